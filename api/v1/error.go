@@ -0,0 +1,29 @@
+package log_v1
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrOffsetOutOfRange is returned when reading an offset the log doesn't hold
+type ErrOffsetOutOfRange struct {
+	Offset uint64
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return fmt.Sprintf("offset out of range: %d", e.Offset)
+}
+
+// Is matches any ErrOffsetOutOfRange, whatever its offset, so errors.Is can test for the error
+// with the zero value and errors.As gets the offset
+func (e ErrOffsetOutOfRange) Is(target error) bool {
+	_, ok := target.(ErrOffsetOutOfRange)
+	return ok
+}
+
+// GRPCStatus lets the gRPC server send the error with the OutOfRange code
+func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
+	return status.New(codes.OutOfRange, e.Error())
+}
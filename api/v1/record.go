@@ -0,0 +1,31 @@
+package log_v1
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ErrNoPayload is returned by UnpackRecord for records without a typed payload
+var ErrNoPayload = fmt.Errorf("record has no payload")
+
+// PackRecord returns a record carrying msg as its payload, tagged with its type URL so
+// consumers can tell which message it is
+func PackRecord(msg proto.Message) (*Record, error) {
+	payload, err := anypb.New(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Payload: payload}, nil
+}
+
+// UnpackRecord unmarshals rec's payload into into, failing if the payload is a different
+// message type. Use rec.Payload.MessageIs to check the type first, or
+// rec.Payload.UnmarshalNew to unpack any registered type
+func UnpackRecord(rec *Record, into proto.Message) error {
+	if rec.Payload == nil {
+		return ErrNoPayload
+	}
+	return rec.Payload.UnmarshalTo(into)
+}
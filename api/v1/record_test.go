@@ -0,0 +1,29 @@
+package log_v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPackRecord(t *testing.T) {
+	want := &Server{Id: "node-1", RpcAddr: "localhost:8400", IsLeader: true}
+	record, err := PackRecord(want)
+	require.NoError(t, err)
+	require.Equal(t, "type.googleapis.com/log.v1.Server", record.Payload.TypeUrl)
+	require.Nil(t, record.Value)
+
+	// the payload survives the record being marshaled, as the log stores it
+	b, err := proto.Marshal(record)
+	require.NoError(t, err)
+	read := &Record{}
+	require.NoError(t, proto.Unmarshal(b, read))
+	got := &Server{}
+	require.NoError(t, UnpackRecord(read, got))
+	require.True(t, proto.Equal(want, got))
+
+	// unpacking into the wrong type, or a record of raw bytes, fails
+	require.Error(t, UnpackRecord(read, &ConsumeRequest{}))
+	require.Equal(t, ErrNoPayload, UnpackRecord(&Record{Value: []byte("hello world")}, got))
+}
@@ -1,12 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/magus-1/proglog/internal/config"
+	commitlog "github.com/magus-1/proglog/internal/log"
+	"github.com/magus-1/proglog/internal/metrics"
+	"github.com/magus-1/proglog/internal/security"
 	"github.com/magus-1/proglog/internal/server"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	path := flag.String("config", "config.json", "path to the JSON config file")
+	recoverIndexes := flag.Bool("recover", false,
+		"rebuild missing or damaged segment indexes from their stores before opening the log")
+	flag.Parse()
+
+	srvConfig, logConfig, err := config.Load(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *recoverIndexes {
+		rebuilt, err := commitlog.RebuildIndexes(srvConfig.DataDir, logConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("rebuilt the indexes of %d segments: %v", len(rebuilt), rebuilt)
+	}
+	logConfig.Metrics = metrics.Default()
+	clog, err := commitlog.NewLog(srvConfig.DataDir, logConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConfig *tls.Config
+	if srvConfig.CertFile != "" {
+		tlsConfig, err = security.SetupTLSConfig(security.TLSConfig{
+			CertFile: srvConfig.CertFile,
+			KeyFile:  srvConfig.KeyFile,
+			CAFile:   srvConfig.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	srv := server.NewHTTPServer(srvConfig.Addr, clog, tlsConfig)
+	if len(srvConfig.BasicAuth) > 0 {
+		basicAuth, err := server.NewBasicAuth(srvConfig.BasicAuth)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.Handler = basicAuth.Middleware(srv.Handler)
+	}
+
+	// serve until SIGINT/SIGTERM, then let in-flight requests finish
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	case <-sigc:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/casbin/casbin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ACL is an Authorizer enforcing a Casbin model and policy, so operators can express rules
+// like "readers can consume, admins can produce and consume" in the policy file
+type ACL struct {
+	model, policy string
+
+	mu       sync.RWMutex
+	enforcer *casbin.Enforcer
+}
+
+// New loads the Casbin model and policy files
+func New(model, policy string) (*ACL, error) {
+	a := &ACL{
+		model:  model,
+		policy: policy,
+	}
+	return a, a.Reload()
+}
+
+// Reload rereads the model and policy files. If either fails to load, the ACL keeps
+// enforcing what it had
+func (a *ACL) Reload() error {
+	enforcer, err := casbin.NewEnforcerSafe(a.model, a.policy)
+	if err != nil {
+		return err
+	}
+	// the enforcer ignores errors loading its policy, so load it again to see them
+	if err = enforcer.LoadPolicy(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.enforcer = enforcer
+	return nil
+}
+
+// Enforce reports whether the policy lets subject perform action on object
+func (a *ACL) Enforce(subject, object, action string) (bool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.enforcer.EnforceSafe(subject, object, action)
+}
+
+func (a *ACL) Authorize(subject, object, action string) error {
+	ok, err := a.Enforce(subject, object, action)
+	if err != nil {
+		return status.Errorf(codes.Internal, "enforcing policy: %s", err)
+	}
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s not permitted to %s to %s", subject, action, object)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// aclModel grants policy rules to subjects directly or through their roles
+const aclModel = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && (p.obj == "*" || r.obj == p.obj) && r.act == p.act
+`
+
+func TestACL(t *testing.T) {
+	model := writePolicy(t, aclModel)
+	policy := writePolicy(t, `
+p, reader, *, consume
+p, admin, *, produce
+p, admin, *, consume
+g, root, admin
+`)
+	acl, err := New(model, policy)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, action string
+		want            bool
+	}{
+		{"reader", "consume", true},
+		{"reader", "produce", false},
+		{"admin", "produce", true},
+		{"root", "produce", true},
+		{"nobody", "consume", false},
+	} {
+		ok, err := acl.Enforce(tc.subject, "*", tc.action)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, ok, "%s %s", tc.subject, tc.action)
+	}
+	err = acl.Authorize("reader", "*", "produce")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.NoError(t, acl.Authorize("reader", "*", "consume"))
+
+	_, err = New(model, "missing.csv")
+	require.Error(t, err)
+}
+
+func TestACLReload(t *testing.T) {
+	model := writePolicy(t, aclModel)
+	policy := writePolicy(t, "p, reader, *, consume\n")
+	acl, err := New(model, policy)
+	require.NoError(t, err)
+	ok, err := acl.Enforce("reader", "*", "produce")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// grant produce at runtime
+	require.NoError(t, writeFile(policy, "p, reader, *, consume\np, reader, *, produce\n"))
+	require.NoError(t, acl.Reload())
+	ok, err = acl.Enforce("reader", "*", "produce")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// a model that doesn't load leaves the ACL as it was
+	require.NoError(t, writeFile(model, "[request_definition]\n"))
+	require.Error(t, acl.Reload())
+	ok, err = acl.Enforce("reader", "*", "produce")
+	require.NoError(t, err)
+	require.True(t, ok)
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Wildcard matches any subject, object or action in a policy rule
+const Wildcard = "*"
+
+// Authorizer decides whether subject may perform action on object, returning a
+// codes.PermissionDenied status error if it may not
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+// rule grants subject the action on object, any of which may be the wildcard
+type rule struct {
+	subject, object, action string
+}
+
+func (r rule) matches(subject, object, action string) bool {
+	return (r.subject == Wildcard || r.subject == subject) &&
+		(r.object == Wildcard || r.object == object) &&
+		(r.action == Wildcard || r.action == action)
+}
+
+// FileAuthorizer allows the requests granted by the rules in a policy file. Each line of the
+// file is a comma-separated subject, object and action, e.g. "client,*,produce", and blank lines
+// and lines starting with # are ignored. Anything not granted is denied
+type FileAuthorizer struct {
+	rules []rule
+}
+
+// NewFileAuthorizer loads the policy file at path
+func NewFileAuthorizer(path string) (*FileAuthorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &FileAuthorizer{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want subject,object,action, got %q", path, line, text)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		a.rules = append(a.rules, rule{fields[0], fields[1], fields[2]})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthorizer) Authorize(subject, object, action string) error {
+	for _, r := range a.rules {
+		if r.matches(subject, object, action) {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "%s not permitted to %s to %s", subject, action, object)
+}
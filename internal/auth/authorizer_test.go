@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "policy")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	_, err = f.WriteString(policy)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func writeFile(name, contents string) error {
+	return ioutil.WriteFile(name, []byte(contents), 0644)
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	a, err := NewFileAuthorizer(writePolicy(t, `
+# producers write, anyone reads
+producer, *, produce
+*, *, consume
+`))
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("producer", "*", "produce"))
+	require.NoError(t, a.Authorize("producer", "*", "consume"))
+	require.NoError(t, a.Authorize("consumer", "*", "consume"))
+	err = a.Authorize("consumer", "*", "produce")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = NewFileAuthorizer(writePolicy(t, "producer,produce\n"))
+	require.Error(t, err)
+	_, err = NewFileAuthorizer("missing.policy")
+	require.Error(t, err)
+}
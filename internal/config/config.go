@@ -0,0 +1,44 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/magus-1/proglog/internal/server"
+)
+
+// file is the layout of a config file
+type file struct {
+	Server server.Config
+	Log    log.Config
+}
+
+// Load reads the server and log config from the JSON file at path. Fields left out of
+// the file keep their defaults, and a missing file returns the defaults
+func Load(path string) (server.Config, log.Config, error) {
+	c := file{
+		Server: server.Config{
+			Addr:    ":8080",
+			DataDir: filepath.Join(os.TempDir(), "proglog"),
+		},
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c.Server, c.Log, nil
+	}
+	if err != nil {
+		return server.Config{}, log.Config{}, err
+	}
+	defer f.Close()
+
+	// reject unknown fields so a typo doesn't silently fall back to a default
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&c); err != nil {
+		return server.Config{}, log.Config{}, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return c.Server, c.Log, nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+		"Server": {"Addr": ":9090", "DataDir": "/var/lib/proglog"},
+		"Log": {"Segment": {"MaxStoreBytes": 4096, "MaxIndexBytes": 2048}}
+	}`)
+	srv, log, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, ":9090", srv.Addr)
+	require.Equal(t, "/var/lib/proglog", srv.DataDir)
+	require.Equal(t, uint64(4096), log.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(2048), log.Segment.MaxIndexBytes)
+}
+
+func TestLoadMissing(t *testing.T) {
+	srv, log, err := Load(filepath.Join(os.TempDir(), "does-not-exist.json"))
+	require.NoError(t, err)
+	require.Equal(t, ":8080", srv.Addr)
+	require.NotEmpty(t, srv.DataDir)
+	require.Equal(t, uint64(0), log.Segment.MaxStoreBytes)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	// unknown fields are rejected
+	_, _, err := Load(writeConfig(t, `{"Server": {"Adr": ":9090"}}`))
+	require.Error(t, err)
+
+	// as is malformed JSON
+	_, _, err = Load(writeConfig(t, `{"Server": `))
+	require.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestLeaderDiscovery(t *testing.T) {
+	c := newFakeCluster(t, 3)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", Name, c.servers[2].addr),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogServiceClient(conn)
+	ctx := context.Background()
+
+	// produces go to the leader
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}, grpc.WaitForReady(true))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// consumes are spread over the followers
+	served := map[uint64]bool{}
+	require.Eventually(t, func() bool {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{})
+		require.NoError(t, err)
+		served[res.Record.Offset] = true
+		return len(served) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	require.False(t, served[0])
+
+	// once the leader changes, the client finds the new one
+	c.setLeader(1)
+	require.Eventually(t, func() bool {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		if err != nil {
+			require.Equal(t, codes.FailedPrecondition, status.Code(err))
+			return false
+		}
+		return res.Offset == 1
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// fakeCluster serves the LogService from n servers that agree on which of them is the leader
+type fakeCluster struct {
+	mu      sync.Mutex
+	leader  int
+	servers []*fakeServer
+}
+
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+	t.Helper()
+	c := &fakeCluster{}
+	for i := 0; i < n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv := &fakeServer{cluster: c, id: i, addr: ln.Addr().String()}
+		gsrv := grpc.NewServer()
+		api.RegisterLogServiceServer(gsrv, srv)
+		go gsrv.Serve(ln)
+		t.Cleanup(gsrv.Stop)
+		c.servers = append(c.servers, srv)
+	}
+	return c
+}
+
+func (c *fakeCluster) setLeader(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = id
+}
+
+func (c *fakeCluster) isLeader(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader == id
+}
+
+// fakeServer answers produces with its own ID as the offset if it's the leader, and consumes
+// with its ID as the record's offset
+type fakeServer struct {
+	api.UnimplementedLogServiceServer
+	cluster *fakeCluster
+	id      int
+	addr    string
+}
+
+func (s *fakeServer) Produce(context.Context, *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if !s.cluster.isLeader(s.id) {
+		return nil, status.Error(codes.FailedPrecondition, "not the leader")
+	}
+	return &api.ProduceResponse{Offset: uint64(s.id)}, nil
+}
+
+func (s *fakeServer) Consume(context.Context, *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	return &api.ConsumeResponse{Record: &api.Record{Offset: uint64(s.id)}}, nil
+}
+
+func (s *fakeServer) GetServers(context.Context, *api.GetServersRequest) (*api.GetServersResponse, error) {
+	res := &api.GetServersResponse{}
+	for _, srv := range s.cluster.servers {
+		res.Servers = append(res.Servers, &api.Server{
+			Id:       fmt.Sprintf("%d", srv.id),
+			RpcAddr:  srv.addr,
+			IsLeader: s.cluster.isLeader(srv.id),
+		})
+	}
+	return res, nil
+}
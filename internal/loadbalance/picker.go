@@ -0,0 +1,101 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	balancer.Register(builder{})
+}
+
+// builder builds a base balancer whose pickers can ask the client connection to re-resolve
+type builder struct{}
+
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{clientConn: cc}
+	return base.NewBalancerBuilder(Name, pb, base.Config{}).Build(cc, opts)
+}
+
+func (builder) Name() string {
+	return Name
+}
+
+type pickerBuilder struct {
+	clientConn balancer.ClientConn
+}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+// Build is called with the ready connections whenever the resolved servers or their
+// connections' states change
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{clientConn: b.clientConn}
+	for sc, scInfo := range info.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderAttr{}).(bool)
+		if isLeader {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+// Picker sends produces to the leader and round-robins consumes over the followers, falling
+// back to the leader if there are none
+type Picker struct {
+	clientConn balancer.ClientConn
+	leader     balancer.SubConn
+	followers  []balancer.SubConn
+	current    uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Consume") && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		// wait for the resolver to find a leader
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	result.Done = p.done(info.FullMethodName)
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+	return p.followers[cur%uint64(len(p.followers))]
+}
+
+// done re-resolves the cluster when a produce is refused with FailedPrecondition by a server
+// that's no longer the leader, or any call finds its server unavailable, so the next picker routes around it
+func (p *Picker) done(method string) func(balancer.DoneInfo) {
+	return func(info balancer.DoneInfo) {
+		switch status.Code(info.Err) {
+		case codes.Unavailable:
+		case codes.FailedPrecondition:
+			if !isProduce(method) {
+				return
+			}
+		default:
+			return
+		}
+		p.clientConn.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+func isProduce(method string) bool {
+	return strings.Contains(method, "Produce")
+}
@@ -0,0 +1,127 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the resolver's scheme and the balancer's name. Dial "proglog:///host:port", where
+// host:port is any server in the cluster, to send produces to the leader and spread consumes
+// over the followers
+const Name = "proglog"
+
+// isLeaderAttr marks the resolved address of the cluster's leader
+type isLeaderAttr struct{}
+
+// how long the resolver waits for GetServers
+var resolveTimeout = 5 * time.Second
+
+// serviceConfig picks the balancer and retries consumes on another server if theirs is
+// unavailable. Produces aren't idempotent, so they aren't retried
+var serviceConfig = fmt.Sprintf(`{
+	"loadBalancingConfig": [{%q: {}}],
+	"methodConfig": [{
+		"name": [
+			{"service": %[2]q, "method": "Consume"},
+			{"service": %[2]q, "method": "ConsumeBatch"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.01s",
+			"maxBackoff": "0.1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`, Name, api.LogService_ServiceDesc.ServiceName)
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+// Resolver discovers the cluster's servers by calling GetServers on the target server
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+}
+
+var _ resolver.Builder = (*Resolver)(nil)
+
+func (r *Resolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (
+	resolver.Resolver, error) {
+	// each client connection gets its own resolver
+	res := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+	}
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	}
+	if opts.Dialer != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(opts.Dialer))
+	}
+	res.serviceConfig = cc.ParseServiceConfig(serviceConfig)
+	var err error
+	if res.resolverConn, err = grpc.Dial(target.Endpoint(), dialOpts...); err != nil {
+		return nil, err
+	}
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	return res, nil
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// ResolveNow asks the target server for the cluster's servers and updates the client
+// connection with their addresses. gRPC calls it when a connection fails, and the picker
+// when a produce reaches a server that's no longer the leader
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	client := api.NewLogServiceClient(r.resolverConn)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		// the leader flag is an address attribute rather than a balancer one so a change of
+		// leader counts as a new address, giving the balancer a new picker
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderAttr{}, server.IsLeader),
+		})
+	}
+	if err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update servers", zap.Error(err))
+	}
+}
+
+func (r *Resolver) Close() {
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close resolver connection", zap.Error(err))
+	}
+}
@@ -0,0 +1,117 @@
+package loadbalance
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// idempotentMethods are the calls that can be repeated without changing the result: reads,
+// and commits, which set a group's offset to the same value again. Produces append the
+// record again, so they're only retried if they're idempotent, see idempotent
+var idempotentMethods = map[string]bool{
+	"/" + api.LogService_ServiceDesc.ServiceName + "/Consume":      true,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/ConsumeBatch": true,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/GetServers":   true,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/CommitOffset": true,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/FetchOffset":  true,
+}
+
+// idempotent reports whether the call can be retried, a produce only if it carries a producer
+// ID and sequence # for the server to deduplicate it by
+func idempotent(method string, req interface{}) bool {
+	if produce, ok := req.(*api.ProduceRequest); ok {
+		return produce.ProducerId != ""
+	}
+	return idempotentMethods[method]
+}
+
+// transientCodes are the codes of failures that can pass, e.g. while the cluster elects a
+// leader or a server restarts or sheds load
+var transientCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.ResourceExhausted: true,
+	codes.Aborted:           true,
+}
+
+// Retry retries idempotent calls that fail with a transient error, backing off exponentially
+// with jitter between attempts, so clients ride out cluster churn rather than fail with it.
+// It works with any target, not only the proglog resolver's
+type Retry struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// NewRetry makes up to maxAttempts attempts at each call. The wait before each retry is random,
+// up to initialBackoff before the first and doubling with each one after, to at most maxBackoff
+func NewRetry(maxAttempts int, initialBackoff, maxBackoff time.Duration) *Retry {
+	return &Retry{
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+	}
+}
+
+// backoff returns the wait before retry n, counting from 0
+func (r *Retry) backoff(n int) time.Duration {
+	max := r.initialBackoff
+	for i := 0; i < n && max < r.maxBackoff; i++ {
+		max *= 2
+	}
+	if max > r.maxBackoff {
+		max = r.maxBackoff
+	}
+	if max <= 0 {
+		return 0
+	}
+	// full jitter, so clients that failed together don't retry together
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// wait sleeps for retry n's backoff, reporting false if the context is done first or its
+// deadline would pass before the retry
+func (r *Retry) wait(ctx context.Context, n int) bool {
+	d := r.backoff(n)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// DialOptions returns dial options that retry the client connection's idempotent unary calls,
+// within their contexts' deadlines. A call that runs out of attempts or time fails with the
+// last attempt's error
+func (r *Retry) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req,
+			reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption) error {
+			if !idempotent(method, req) {
+				return invoker(ctx, method, req, reply, cc, opts...)
+			}
+			var err error
+			for n := 0; ; n++ {
+				err = invoker(ctx, method, req, reply, cc, opts...)
+				if err == nil || !transientCodes[status.Code(err)] || n+1 >= r.maxAttempts {
+					return err
+				}
+				if !r.wait(ctx, n) {
+					return err
+				}
+			}
+		}),
+	}
+}
@@ -0,0 +1,139 @@
+package loadbalance
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetry(t *testing.T) {
+	srv := &flakyServer{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer()
+	api.RegisterLogServiceServer(gsrv, srv)
+	go gsrv.Serve(ln)
+	defer gsrv.Stop()
+
+	dial := func(r *Retry) api.LogServiceClient {
+		opts := append(r.DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := grpc.Dial(ln.Addr().String(), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewLogServiceClient(conn)
+	}
+	client := dial(NewRetry(3, time.Millisecond, 10*time.Millisecond))
+	ctx := context.Background()
+
+	// idempotent calls that fail twice succeed on the third attempt
+	srv.fail(2, codes.Unavailable)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+	srv.fail(2, codes.Unavailable)
+	_, err = client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 3, srv.attempts())
+
+	// produces aren't retried, unless they're idempotent
+	srv.fail(2, codes.Unavailable)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, srv.attempts())
+	srv.fail(2, codes.Unavailable)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:     &api.Record{},
+		ProducerId: "producer",
+		Sequence:   1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, srv.attempts())
+
+	// nor are errors that won't pass
+	srv.fail(2, codes.InvalidArgument)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, 1, srv.attempts())
+
+	// calls fail with the last error once they're out of attempts
+	srv.fail(3, codes.Unavailable)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 3, srv.attempts())
+
+	// or out of time, rather than wait for a retry past their deadline
+	client = dial(NewRetry(3, time.Hour, time.Hour))
+	srv.fail(2, codes.Unavailable)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Consume(ctx, &api.ConsumeRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// flakyServer fails the next calls it's told to, then answers consumes with the # of attempts
+// the call took as the record's offset
+type flakyServer struct {
+	api.UnimplementedLogServiceServer
+	mu       sync.Mutex
+	failures int
+	code     codes.Code
+	calls    int
+}
+
+// fail fails the next n calls with code
+func (s *flakyServer) fail(n int, code codes.Code) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.code, s.calls = n, code, 0
+}
+
+// attempts returns the # of calls since fail
+func (s *flakyServer) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *flakyServer) call() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return 0, status.Error(s.code, "flaky")
+	}
+	return s.calls, nil
+}
+
+func (s *flakyServer) Produce(context.Context, *api.ProduceRequest) (*api.ProduceResponse, error) {
+	n, err := s.call()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: uint64(n)}, nil
+}
+
+func (s *flakyServer) Consume(context.Context, *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	n, err := s.call()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeResponse{Record: &api.Record{Offset: uint64(n)}}, nil
+}
+
+func (s *flakyServer) GetServers(context.Context, *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if _, err := s.call(); err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{}, nil
+}
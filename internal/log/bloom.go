@@ -0,0 +1,200 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"os"
+	"path"
+)
+
+// bloomExt names the file a sealed segment's key filter is kept in, alongside its index
+const bloomExt = ".bloom"
+
+// bloomFalsePositiveRate is the rate filters are sized for, at the # of keys they're sized for
+const bloomFalsePositiveRate = 0.01
+
+// bloomMagic starts a filter file, followed by the # of hashes, a CRC32 of the bits and the bits
+var bloomMagic = []byte("PLBF")
+
+// bloomFilter is a Bloom filter over a segment's record keys: it has every key that was added,
+// and each key that wasn't with about bloomFalsePositiveRate odds
+type bloomFilter struct {
+	bits []uint64
+	k    uint32
+}
+
+// newBloomFilter returns a filter sized for n keys
+func newBloomFilter(n uint64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	// the optimal # of bits and hashes for the rate
+	m := math.Ceil(-float64(n) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (uint64(m)+63)/64), k: uint32(k)}
+}
+
+// positions calls fn with each of the key's k bit positions, derived from two halves of its
+// FNV-1a hash
+func (f *bloomFilter) positions(key []byte, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum>>32, sum&math.MaxUint32
+	n := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		fn((h1 + i*h2) % n)
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.positions(key, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+// mightContain reports whether key may have been added, false means it certainly wasn't
+func (f *bloomFilter) mightContain(key []byte) bool {
+	has := true
+	f.positions(key, func(bit uint64) {
+		has = has && f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return has
+}
+
+// marshal encodes the filter for its file
+func (f *bloomFilter) marshal() []byte {
+	b := make([]byte, len(bloomMagic)+8, len(bloomMagic)+8+8*len(f.bits))
+	copy(b, bloomMagic)
+	enc.PutUint32(b[len(bloomMagic):], f.k)
+	for _, word := range f.bits {
+		b = enc.AppendUint64(b, word)
+	}
+	enc.PutUint32(b[len(bloomMagic)+4:], crc32.ChecksumIEEE(b[len(bloomMagic)+8:]))
+	return b
+}
+
+// unmarshalBloomFilter decodes a filter file written by marshal
+func unmarshalBloomFilter(b []byte) (*bloomFilter, error) {
+	header := len(bloomMagic) + 8
+	if len(b) < header || !bytes.Equal(b[:len(bloomMagic)], bloomMagic) ||
+		(len(b)-header)%8 != 0 || len(b) == header {
+		return nil, fmt.Errorf("invalid bloom filter")
+	}
+	if crc32.ChecksumIEEE(b[header:]) != enc.Uint32(b[len(bloomMagic)+4:]) {
+		return nil, fmt.Errorf("bloom filter doesn't match its checksum")
+	}
+	f := &bloomFilter{k: enc.Uint32(b[len(bloomMagic):])}
+	for p := header; p < len(b); p += 8 {
+		f.bits = append(f.bits, enc.Uint64(b[p:]))
+	}
+	return f, nil
+}
+
+// loadBloom sets up the key filter of a segment being opened with Config.Keys.Bloom: a new
+// segment starts an empty one that its appends add to, a sealed one loads the filter it was
+// sealed with. One without a usable filter file, e.g. the active segment of a log that was
+// closed or one written before filters were enabled, has it built from its records, except
+// read-only ones, which are left without one rather than scanned
+func (s *segment) loadBloom() {
+	if !s.config.Keys.Bloom {
+		return
+	}
+	if s.nextOffset == s.baseOffset {
+		s.bloom = newBloomFilter(s.maxEntries())
+		return
+	}
+	b, err := os.ReadFile(s.config.segmentPath(s.dir, s.baseOffset, bloomExt))
+	if err == nil {
+		if s.bloom, err = unmarshalBloomFilter(b); err == nil {
+			s.bloomSaved = true
+			return
+		}
+	}
+	if !s.config.readOnly {
+		s.bloom = s.buildBloom()
+	}
+}
+
+// maxEntries returns the most index entries the segment's index holds
+func (s *segment) maxEntries() uint64 {
+	return (s.config.Segment.MaxIndexBytes - s.index.header) / s.index.entWidth
+}
+
+// buildBloom returns a filter of the keys of the segment's records, nil if they can't be read,
+// e.g. a store of AppendRaw appends
+func (s *segment) buildBloom() *bloomFilter {
+	f := newBloomFilter(s.maxEntries())
+	for off := s.baseOffset; off < s.nextOffset; off++ {
+		record, err := s.peek(off)
+		if err != nil {
+			return nil
+		}
+		if len(record.Key) > 0 {
+			f.add(record.Key)
+		}
+	}
+	return f
+}
+
+// addKey adds the key of a record appended to the segment to its filter
+func (s *segment) addKey(key []byte) {
+	if s.bloom == nil || len(key) == 0 {
+		return
+	}
+	s.bloom.add(key)
+	// a saved filter no longer has every key
+	s.bloomSaved = false
+}
+
+// saveBloom writes the filter of a segment being sealed to its file next to the index, so
+// it's loaded rather than rebuilt when the segment's next opened. Read-only segments don't
+// write their files, and memory-backed ones have none
+func (s *segment) saveBloom() error {
+	if s.bloom == nil || s.bloomSaved || s.config.readOnly {
+		return nil
+	}
+	if _, ok := s.store.(*store); !ok {
+		return nil
+	}
+	b := s.bloom.marshal()
+	name := path.Join(s.dir, s.config.segmentName(s.baseOffset, bloomExt))
+	if err := writeFile(name, bytes.NewReader(b), uint64(len(b)), s.config); err != nil {
+		return err
+	}
+	s.bloomSaved = true
+	return nil
+}
+
+// removeBloom removes the segment's filter file, if it has one
+func (s *segment) removeBloom() error {
+	err := os.Remove(s.config.segmentPath(s.dir, s.baseOffset, bloomExt))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// reports whether any record in the log may have key, false means none does, letting a
+// lookup skip scanning the log for a key it doesn't have. Each segment's key filter, kept with
+// Config.Keys.Bloom, rules it out with about 1% odds of a false positive; a segment without a
+// filter, such as any without Keys.Bloom, can't be ruled out
+func (l *Log) MightContain(key []byte) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.nextOffset == s.baseOffset {
+			continue
+		}
+		if s.bloom == nil || s.bloom.mightContain(key) {
+			return true
+		}
+	}
+	return false
+}
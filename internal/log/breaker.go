@@ -0,0 +1,65 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrCircuitOpen is returned by appends while the breaker is open: Config.Breaker.Failures
+// appends in a row failed writing to the log's files, e.g. with the disk full or read-only, so
+// appends fail fast until the cooldown is over rather than keep retrying the disk
+var ErrCircuitOpen = fmt.Errorf("circuit open")
+
+// defaultCooldown is how long the breaker stays open unless Config.Breaker.Cooldown is set
+const defaultCooldown = time.Second
+
+// breaker counts consecutive failed appends, tripping once there are Config.Breaker.Failures.
+// It's guarded by the log's write lock
+type breaker struct {
+	failures  int
+	lastErr   error
+	open      bool
+	openUntil time.Time
+}
+
+// allowWrite returns ErrCircuitOpen while the breaker is open and cooling down. Once the
+// cooldown is over the next append goes ahead as a probe: if it succeeds the breaker closes,
+// if it fails it opens for another cooldown. The caller must hold the write lock
+func (l *Log) allowWrite() error {
+	b := &l.breaker
+	if !b.open || !l.Config.clock().Now().Before(b.openUntil) {
+		return nil
+	}
+	return fmt.Errorf("%w: %d appends in a row failed, the last with: %v",
+		ErrCircuitOpen, b.failures, b.lastErr)
+}
+
+// recordWrite counts the result of an append, tripping the breaker once enough fail in a row.
+// Errors with the append itself rather than the disk, e.g. a record too large, don't count.
+// The caller must hold the write lock
+func (l *Log) recordWrite(err error) {
+	max := l.Config.Breaker.Failures
+	if max <= 0 {
+		return
+	}
+	b := &l.breaker
+	if err == nil {
+		*b = breaker{}
+		return
+	}
+	if errors.Is(err, ErrRecordTooLarge) || errors.Is(err, ErrBackpressure) ||
+		errors.Is(err, ErrInvalidRecord) {
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.open || b.failures >= max {
+		cooldown := l.Config.Breaker.Cooldown
+		if cooldown <= 0 {
+			cooldown = defaultCooldown
+		}
+		b.open = true
+		b.openUntil = l.Config.clock().Now().Add(cooldown)
+	}
+}
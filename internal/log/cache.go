@@ -0,0 +1,144 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// segmentCache remembers the segments recent reads found, so reads in a hot range of offsets
+// skip searching every segment. Reads share the log's read lock, so the slots are atomic and
+// a hit writes nothing; misses replace the slots in turn. A nil cache is disabled
+type segmentCache struct {
+	slots []atomic.Pointer[segment]
+	next  atomic.Uint64
+}
+
+// newSegmentCache returns a cache of up to size segments, or nil if size is zero
+func newSegmentCache(size int) *segmentCache {
+	if size <= 0 {
+		return nil
+	}
+	return &segmentCache{slots: make([]atomic.Pointer[segment], size)}
+}
+
+// get returns the cached segment holding off, or nil. The caller must hold the log's lock,
+// so the segments' offsets don't change underneath it
+func (c *segmentCache) get(off uint64) *segment {
+	if c == nil {
+		return nil
+	}
+	for i := range c.slots {
+		if s := c.slots[i].Load(); s != nil && s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+// add caches s in place of the oldest cached segment
+func (c *segmentCache) add(s *segment) {
+	if c == nil {
+		return
+	}
+	i := (c.next.Add(1) - 1) % uint64(len(c.slots))
+	c.slots[i].Store(s)
+}
+
+// reset forgets every segment, whenever the log's segments change. The caller must hold the
+// log's write lock, so no read is adding one back
+func (c *segmentCache) reset() {
+	if c == nil {
+		return
+	}
+	for i := range c.slots {
+		c.slots[i].Store(nil)
+	}
+}
+
+// recordCache keeps the most recently read records, decoded, so repeated reads of hot offsets
+// skip the index lookup, the store read and unmarshaling. Reads share the log's read lock, so
+// it has its own. It holds copies, so callers can't change what later reads get. A nil cache
+// is disabled
+type recordCache struct {
+	max int
+	mu  sync.Mutex
+	// lru holds the cached records, most recently read first, and offsets their elements
+	lru     *list.List
+	offsets map[uint64]*list.Element
+}
+
+// newRecordCache returns a cache of up to size records, or nil if size is zero
+func newRecordCache(size int) *recordCache {
+	if size <= 0 {
+		return nil
+	}
+	return &recordCache{
+		max:     size,
+		lru:     list.New(),
+		offsets: make(map[uint64]*list.Element, size),
+	}
+}
+
+// get returns a copy of the cached record at off, or nil
+func (c *recordCache) get(off uint64) *api.Record {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.offsets[off]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return proto.Clone(e.Value.(*api.Record)).(*api.Record)
+}
+
+// add caches a copy of record, evicting the least recently read record if the cache is full
+func (c *recordCache) add(record *api.Record) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.offsets[record.Offset]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.offsets[record.Offset] = c.lru.PushFront(proto.Clone(record))
+	if c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.offsets, oldest.Value.(*api.Record).Offset)
+	}
+}
+
+// evictBelow forgets the records below off, once the segments holding them are truncated
+func (c *recordCache) evictBelow(off uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for o, e := range c.offsets {
+		if o < off {
+			c.lru.Remove(e)
+			delete(c.offsets, o)
+		}
+	}
+}
+
+// reset forgets every record, whenever offsets may be reused or renumbered
+func (c *recordCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.offsets = make(map[uint64]*list.Element, c.max)
+}
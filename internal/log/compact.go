@@ -0,0 +1,296 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// compactDir holds the segments a compaction writes until they're swapped in
+	compactDir = ".compact"
+	// compactDone is written to compactDir once its segments are durable, listing the
+	// base offset of the active segment then the base offset of each compacted segment
+	compactDone = "done"
+)
+
+// rewrites the sealed segments keeping only the newest record for each key, plus every
+// record without a key. Surviving records are renumbered from the oldest segment's base
+// offset, so their offsets change and offsets below the active segment stop being stable:
+// compaction is only for logs read by key for their latest values.
+// The active segment is left as is. The compacted segments are written and synced alongside
+// the log before the old ones are removed, so a crash part way through leaves either the old
+// segments or, once setup finishes the swap, the compacted ones
+func (l *Log) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	defer l.reportSize()
+	sealed := l.segments[:len(l.segments)-1]
+	if len(sealed) == 0 {
+		return nil
+	}
+	if err := l.forEachSegment(true, func(s *segment) error {
+		if _, ok := s.store.(*store); !ok {
+			return fmt.Errorf("compaction needs file-backed stores")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// find each key's newest offset, which may be in the active segment
+	latest := make(map[string]uint64)
+	if err := l.forEachSegment(false, func(s *segment) error {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.peek(off)
+			if err != nil {
+				return err
+			}
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = off
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// write the survivors to new segments in the compaction directory
+	tmp, err := l.newCompactDir()
+	if err != nil {
+		return err
+	}
+	compacted, err := l.writeCompacted(tmp, sealed, latest)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err = l.swapCompacted(tmp, sealed, compacted); err != nil {
+		return err
+	}
+	l.cache.reset()
+	// the surviving records are renumbered
+	l.records.reset()
+	if l.keys != nil {
+		if err = l.indexKeys(); err != nil {
+			return err
+		}
+	}
+	if l.producers != nil {
+		// producers' last offsets are renumbered too, so a retry gets the record's new offset
+		return l.indexProducers()
+	}
+	return nil
+}
+
+// newCompactDir empties the compaction directory left by any earlier attempt and returns it
+func (l *Log) newCompactDir() (string, error) {
+	tmp := path.Join(l.Dir, compactDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	return tmp, l.Config.mkdirAll(tmp)
+}
+
+// swapCompacted replaces the sealed segments with the closed segments rewritten from them in
+// tmp, first making them durable and writing the done marker, after which a crash leaves
+// setup to finish the swap. The caller must hold the write lock
+func (l *Log) swapCompacted(tmp string, sealed, compacted []*segment) error {
+	done := []string{strconv.FormatUint(l.activeSegment.baseOffset, 10)}
+	for _, c := range compacted {
+		if err := syncPath(c.store.Name()); err != nil {
+			return err
+		}
+		if err := syncPath(c.index.Name()); err != nil {
+			return err
+		}
+		done = append(done, strconv.FormatUint(c.baseOffset, 10))
+	}
+
+	// once the done marker is durable the compaction will complete, even after a crash
+	if err := ioutil.WriteFile(
+		path.Join(tmp, compactDone),
+		[]byte(strings.Join(done, "\n")),
+		l.Config.fileMode(),
+	); err != nil {
+		return err
+	}
+	if err := syncPath(path.Join(tmp, compactDone)); err != nil {
+		return err
+	}
+	if err := syncPath(tmp); err != nil {
+		return err
+	}
+
+	// swap the compacted segments in
+	for _, s := range sealed {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	if err := finishCompaction(l.Dir, l.Config.Tier.ColdDir); err != nil {
+		return err
+	}
+	segments := make([]*segment, 0, len(compacted)+1)
+	for _, c := range compacted {
+		s, err := newSegment(l.Dir, c.baseOffset, l.Config)
+		if err != nil {
+			return err
+		}
+		if err = s.Seal(); err != nil {
+			return err
+		}
+		if err = l.handles.add(s); err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	l.segments = append(segments, l.activeSegment)
+	return nil
+}
+
+// writes the sealed segments' surviving records to new segments in dir, returning them closed
+func (l *Log) writeCompacted(dir string, sealed []*segment, latest map[string]uint64) (
+	[]*segment, error) {
+	var compacted []*segment
+	closeAll := func() {
+		for _, c := range compacted {
+			c.Close()
+		}
+	}
+	next := sealed[0].baseOffset
+	for _, s := range sealed {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.peek(off)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			if len(record.Key) > 0 && latest[string(record.Key)] != off {
+				// superseded by a newer record for the key
+				continue
+			}
+			if len(compacted) == 0 || compacted[len(compacted)-1].IsMaxed() {
+				c, err := newSegment(dir, next, l.Config)
+				if err != nil {
+					closeAll()
+					return nil, err
+				}
+				compacted = append(compacted, c)
+			}
+			if _, err = compacted[len(compacted)-1].write(record); err != nil {
+				closeAll()
+				return nil, err
+			}
+			next++
+		}
+	}
+	for i, c := range compacted {
+		if err := c.Close(); err != nil {
+			for _, c := range compacted[i+1:] {
+				c.Close()
+			}
+			return nil, err
+		}
+	}
+	return compacted, nil
+}
+
+// finishCompaction replaces the log's sealed segments with those in its compaction directory
+// if the compaction got as far as writing its done marker, otherwise it discards them.
+// The compacted segments replace those in coldDir too, if it's set.
+// It's safe to run again if it's interrupted
+func finishCompaction(dir, coldDir string) error {
+	tmp := path.Join(dir, compactDir)
+	b, err := ioutil.ReadFile(path.Join(tmp, compactDone))
+	if os.IsNotExist(err) {
+		return os.RemoveAll(tmp)
+	}
+	if err != nil {
+		return err
+	}
+	var bases []uint64
+	for _, line := range strings.Split(string(b), "\n") {
+		base, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return fmt.Errorf("compaction marker %q: %w", line, err)
+		}
+		bases = append(bases, base)
+	}
+	files, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	activeBase, keep := bases[0], make(map[string]bool)
+	for _, file := range files {
+		keep[file.Name()] = true
+	}
+
+	// remove the old sealed segments, except the files the compacted ones replace by name,
+	// which old segments named with another Config.Segment.NameWidth don't.
+	// The compacted segments are all moved into dir, so every old one in coldDir goes
+	if err = removeSegments(dir, activeBase, keep); err != nil {
+		return err
+	}
+	if coldDir != "" {
+		if err = removeSegments(coldDir, activeBase, nil); err != nil {
+			return err
+		}
+	}
+
+	// then move the compacted segments in, replacing any old ones with the same name
+	for _, file := range files {
+		if file.Name() == compactDone {
+			continue
+		}
+		if err = os.Rename(path.Join(tmp, file.Name()), path.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	if err = syncPath(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(tmp)
+}
+
+// removeSegments removes the files of the segments in dir based below activeBase, their key
+// filters included, except those named in keep
+func removeSegments(dir string, activeBase uint64, keep map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".index" && ext != bloomExt {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err != nil || base >= activeBase || keep[file.Name()] {
+			continue
+		}
+		if err = os.Remove(path.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncPath fsyncs the file or directory at p
+func syncPath(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -1,9 +1,266 @@
 package log
 
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/magus-1/proglog/api/v1"
+	"go.opentelemetry.io/otel/trace"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
-		InitialOffset uint64
+		// InitialIndexBytes is the size an index file starts at. It doubles, up to
+		// MaxIndexBytes, whenever the next entry wouldn't fit, so sparse segments don't take up
+		// the max index size each. Zero, the default, starts indexes at MaxIndexBytes
+		InitialIndexBytes uint64
+		InitialOffset     uint64
+		// NameWidth zero-pads the base offsets new segment files are named with to this many
+		// digits, so listing them lexically lists them in order, e.g. 00000000000000001024.store
+		// with 20, the most a uint64 takes. Zero names them with the plain base offset.
+		// Existing segments keep the names they were created with, padded or not
+		NameWidth int
+		// MaxRecordBytes rejects appends whose marshaled record is larger with ErrRecordTooLarge,
+		// zero allows records of any size
+		MaxRecordBytes uint64
+		// CacheSize is the # of recently read segments reads remember to skip searching the
+		// segments for each offset, zero disables the cache
+		CacheSize int
+	}
+	Store struct {
+		// DisableChecksum reads and writes records without the CRC32 field,
+		// for stores written before checksums were added
+		DisableChecksum bool
+		// ByteOrder encodes lengths, checksums and index entries of new logs, defaults to big
+		// endian. Indexes record a non-default order, and an existing log keeps the order it
+		// was written with whatever this is set to
+		ByteOrder binary.ByteOrder `json:"-"`
+		// Compression is the codec new records are written with. Each record is tagged
+		// with its codec, so a store can hold records written with different codecs
+		Compression Compression
+		// BufferSize is the # of bytes of appends buffered before they're written to the file,
+		// zero keeps bufio's default of 4KB. Larger buffers mean fewer writes for bulk loads,
+		// but more appends a crash can lose with SyncNone
+		BufferSize int
+		// Sync controls when appends are fsynced to disk
+		Sync SyncMode
+		// SyncInterval is how often SyncPeriodic syncs, defaults to a second
+		SyncInterval time.Duration
+		// MaxUnsyncedBytes is the high-water mark for the bytes appended to the active segment
+		// since it was last fsynced: once they reach it appends are rejected with
+		// ErrBackpressure until a sync catches up, so producers slow down rather than run
+		// ahead of durability. Only SyncPeriodic syncs by itself, in the other modes it takes
+		// a Log.Sync. Zero never rejects appends
+		MaxUnsyncedBytes uint64
+		// FlushInterval is how often SyncNone writes buffered appends to the file, bounding
+		// what a crash of the process loses without fsyncing. Zero leaves them buffered
+		// until a read, rollover or close
+		FlushInterval time.Duration
+	}
+	Index struct {
+		// OffWidth and PosWidth are the # of bytes used for each index entry's relative
+		// offset (2 or 4) and store position (2, 4 or 8), defaulting to 4 and 8. They're
+		// recorded in new indexes, so existing ones keep the widths they were written with
+		OffWidth uint64
+		PosWidth uint64
+		// Checksum ends each entry of new indexes with a CRC32 of its offset and position, so
+		// a corrupt entry is read as ErrCorruptIndex rather than sending the read to the
+		// wrong place in the store. Like the widths it's recorded in the index
+		Checksum bool
+	}
+	// openStore opens each segment's store, defaulting to openFileStore. Tests swap in
+	// openMemStore to keep records in memory
+	openStore storeFactory
+	// readOnly opens the segments' files read-only, set by OpenReadOnly
+	readOnly bool
+	// appendHook is called by each append once MaxConcurrentAppends lets it in, before it takes
+	// the log's lock. Tests set it to watch how many are in flight
+	appendHook func()
+	Retention  struct {
+		// MaxBytes removes the oldest segments once the stores' total size exceeds it
+		MaxBytes uint64
+		// MaxAge removes segments once their newest record is older than it
+		MaxAge time.Duration
+	}
+	Tier struct {
+		// ColdDir is where sealed segments move once they're older than ColdAge, e.g. on a
+		// cheaper disk than Dir. Like Dir it belongs to the log, which removes it with the log.
+		// Empty keeps every segment in Dir
+		ColdDir string
+		// ColdAge moves a sealed segment to ColdDir once its newest record is older than it
+		ColdAge time.Duration
+	}
+	Permissions struct {
+		// File is the mode the log's store and index files are created with, defaulting to 0644
+		File os.FileMode
+		// Dir is the mode the log's directories are created with, defaulting to 0755. The modes
+		// are set whatever the process's umask, but only on creation, existing ones are kept
+		Dir os.FileMode
+	}
+	Keys struct {
+		// Index keeps an in-memory map from each record key to its newest offset for
+		// ReadLatestByKey. It's rebuilt by scanning the log on startup and grows with the # of keys
+		Index bool
+		// Bloom keeps a Bloom filter of each segment's record keys for MightContain, saved in
+		// a .bloom file next to the index as the segment's sealed and loaded when it's opened.
+		// Segments without one, e.g. those written before it was set, have theirs built from
+		// their records when they're opened
+		Bloom bool
+	}
+	Producers struct {
+		// Dedupe keeps each producer's last sequence # and the offset its record was given, for
+		// AppendIdempotent. They're kept in the records, and rebuilt by scanning the log on
+		// startup
+		Dedupe bool
+		// TTL forgets producers whose last record is older than it, so the state stays bounded
+		// and startup only scans the segments appended to within it. A retry that comes later is
+		// appended again. Zero keeps every producer
+		TTL time.Duration
+	}
+	Partitions struct {
+		// Max is the most partitions Partition creates, counting those already on disk, after
+		// which it fails with ErrTooManyPartitions. Zero doesn't limit them
+		Max int
+	}
+	Breaker struct {
+		// Failures trips a circuit breaker once this many appends in a row fail writing to the
+		// log's files, after which appends fail fast with ErrCircuitOpen for Cooldown. The
+		// first append after it is let through to probe the disk, closing the breaker if it
+		// succeeds and opening it again if not. Zero never trips
+		Failures int
+		// Cooldown is how long the breaker stays open, defaulting to a second
+		Cooldown time.Duration
+	}
+	Debug struct {
+		// VerifyOrdering checks that each append's offset follows the segment's last indexed
+		// one, and that the records reads return were indexed and stored with the offset read,
+		// failing them with ErrOutOfOrder otherwise. It costs an index read per append and
+		// a check per read, so it's for tracking down corruption rather than production
+		VerifyOrdering bool
+	}
+	// Raft configures replication for a DistributedLog, NewLog ignores it
+	Raft struct {
+		raft.Config
+		// Transport carries Raft's RPCs between the nodes
+		Transport raft.Transport `json:"-"`
+		// Bootstrap starts a new cluster with this node as its only voter
+		Bootstrap bool
+	}
+	// MaxOpenSegments bounds how many segments keep their store and index files open, to stay
+	// under the file descriptor limit. Once more are open, the least recently read sealed
+	// segments' files are closed, and reopened when they're next read. The active segment is
+	// always open, so it's at least 1. Zero keeps every segment open
+	MaxOpenSegments int
+	// StartupConcurrency is the # of segments opening a log opens at once, loading their
+	// indexes, recovering them from a crash and building key filters, which speeds up opening
+	// logs with many segments. Zero or one opens them one at a time
+	StartupConcurrency int
+	// MaxConcurrentAppends bounds how many appends by Append, AppendContext, AppendBatch,
+	// AppendIdempotent and AppendRaw are in flight at once, waiting on the log's lock or
+	// writing, so a flood of producers doesn't pile up goroutines each holding its records.
+	// The rest queue until one finishes, AppendContext's giving up once its context is done.
+	// Zero doesn't bound them
+	MaxConcurrentAppends int
+	// ReadCacheSize is the # of recently read records Read keeps decoded, so repeated reads of
+	// hot offsets skip the index, the store and unmarshaling. Zero disables the cache
+	ReadCacheSize int
+	// Preallocate reserves the disk blocks of new index files, as they're grown, and of new
+	// store files, up to MaxStoreBytes, with fallocate, rather than leaving them sparse to be
+	// allocated block by block as they fill, so appends don't stall on allocation. The
+	// unused blocks are handed back once a segment is sealed or closed. Where fallocate
+	// isn't supported the files are left sparse
+	Preallocate bool
+	// Validator checks each record Append, AppendContext and AppendBatch are given, and those it
+	// returns an error for are rejected with ErrInvalidRecord rather than appended. Records
+	// replicated from another log aren't checked again. Nil appends every record
+	Validator func(*api.Record) error `json:"-"`
+	// DeadLetter keeps the records Validator rejects for later inspection, appended with its own
+	// offsets. It must be a different log from the one validating. Nil drops them
+	DeadLetter *Log `json:"-"`
+	// Clock stamps appended records and decides the age of segments for Retention.MaxAge and
+	// Tier.ColdAge, defaulting to the system clock. Tests set a fake one to control time
+	Clock Clock `json:"-"`
+	// Metrics is told about appends, reads and the log's size, defaulting to a no-op
+	Metrics Metrics `json:"-"`
+	// TracerProvider traces appends and reads, as children of the spans in their contexts.
+	// Nil traces nothing
+	TracerProvider trace.TracerProvider `json:"-"`
+}
+
+// Compression identifies the codec a record's payload is stored with
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the default Clock, the system's
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// setDefaults fills in the segment limits left zero
+func (c *Config) setDefaults() {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
 	}
 }
+
+// clock returns the configured clock or the system's
+func (c Config) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
+}
+
+// storeFactory returns the configured store factory or the file-backed default
+func (c Config) storeFactory() storeFactory {
+	if c.openStore == nil {
+		return openFileStore
+	}
+	return c.openStore
+}
+
+// metrics returns the configured metrics or a no-op
+func (c Config) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
+
+// byteOrder returns the configured byte order or the default
+func (c Config) byteOrder() binary.ByteOrder {
+	if c.Store.ByteOrder == nil {
+		return enc
+	}
+	return c.Store.ByteOrder
+}
+
+// SyncMode trades append throughput for durability
+type SyncMode uint8
+
+const (
+	// SyncNone leaves appends in the write buffer until a read or close flushes them
+	SyncNone SyncMode = iota
+	// SyncOnAppend flushes and fsyncs every append before it returns
+	SyncOnAppend
+	// SyncPeriodic flushes and fsyncs every SyncInterval
+	SyncPeriodic
+)
@@ -0,0 +1,73 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// copies every segment's store and index files to destDir and returns a log opened there, with
+// the source's config. The source holds its read lock while its files are copied, so the copy is
+// of a consistent set of segments and appends wait for it, and is otherwise left as it was.
+// destDir must be empty or not exist yet. The copy keeps all its segments in destDir, with no
+// cold directory to share with the source, and is writable even if the source is read-only
+func (l *Log) Copy(destDir string) (*Log, error) {
+	c := l.Config
+	c.Tier.ColdDir, c.readOnly = "", false
+	if files, err := os.ReadDir(destDir); err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("%s isn't empty", destDir)
+	}
+	if err := c.mkdirAll(destDir); err != nil {
+		return nil, err
+	}
+	if err := l.copySegments(destDir, c); err != nil {
+		return nil, err
+	}
+	return NewLog(destDir, c)
+}
+
+// copySegments writes each segment's files to dir and syncs it, removing what it wrote if a
+// copy fails
+func (l *Log) copySegments(dir string, c Config) (err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var copied []string
+	defer func() {
+		if err != nil {
+			for _, name := range copied {
+				os.Remove(name)
+			}
+		}
+	}()
+	for _, s := range l.segments {
+		if _, ok := s.store.(*store); !ok {
+			return fmt.Errorf("copying a log needs file-backed stores")
+		}
+		names, err := copySegment(dir, s, c)
+		copied = append(copied, names...)
+		if err != nil {
+			return err
+		}
+	}
+	return syncPath(dir)
+}
+
+// copySegment writes s's store and index files to dir and returns the names of those it wrote
+func copySegment(dir string, s *segment, c Config) ([]string, error) {
+	if err := s.handles.acquire(s); err != nil {
+		return nil, err
+	}
+	defer s.handles.release(s)
+	storeDst := path.Join(dir, c.segmentName(s.baseOffset, ".store"))
+	// store.ReadAt flushes any buffered appends
+	if err := writeFile(storeDst, io.NewSectionReader(s.store, 0, int64(s.store.Size())),
+		s.store.Size(), c); err != nil {
+		return []string{storeDst}, err
+	}
+	indexDst := path.Join(dir, c.segmentName(s.baseOffset, ".index"))
+	// only the entries in use, not the file's preallocated tail
+	err := writeFile(indexDst, io.NewSectionReader(s.index.file, 0, int64(s.index.size)),
+		s.index.size, c)
+	return []string{storeDst, indexDst}, err
+}
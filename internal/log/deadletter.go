@@ -0,0 +1,40 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrInvalidRecord is returned by appends of a record Config.Validator rejects, wrapping the
+// validator's error
+var ErrInvalidRecord = fmt.Errorf("invalid record")
+
+// ErrDeadLettered is also wrapped by the error once the rejected record is in Config.DeadLetter
+var ErrDeadLettered = fmt.Errorf("dead-lettered")
+
+// validate runs Config.Validator over record. A rejected record is appended to
+// Config.DeadLetter, if there is one, and the error says at which offset. A nil record is
+// always rejected
+func (c Config) validate(record *api.Record) error {
+	if record == nil {
+		return fmt.Errorf("%w: no record", ErrInvalidRecord)
+	}
+	if c.Validator == nil {
+		return nil
+	}
+	err := c.Validator(record)
+	if err == nil {
+		return nil
+	}
+	if c.DeadLetter == nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRecord, err)
+	}
+	// the dead-letter log assigns its own offset and timestamp, the caller's record keeps its own
+	off, dlErr := c.DeadLetter.Append(proto.Clone(record).(*api.Record))
+	if dlErr != nil {
+		return fmt.Errorf("%w: %w, and dead-lettering it failed: %v", ErrInvalidRecord, err, dlErr)
+	}
+	return fmt.Errorf("%w: %w: %w at offset %d", ErrInvalidRecord, err, ErrDeadLettered, off)
+}
@@ -0,0 +1,342 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// how long an append waits for Raft to commit it
+var applyTimeout = 10 * time.Second
+
+// DistributedLog replicates a Log with Raft: appends are proposed to the cluster and applied
+// to every node's local log once committed, while reads are served from the local log.
+// The local log is rebuilt from Raft's snapshot and log each time the node starts
+type DistributedLog struct {
+	config    Config
+	log       *Log
+	raft      *raft.Raft
+	boltStore *raftboltdb.BoltStore
+}
+
+// NewDistributedLog creates a node of a replicated log, keeping its local log and Raft's
+// state under dataDir. config.Raft must set a LocalID and a Transport
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := l.config.mkdirAll(logDir); err != nil {
+		return err
+	}
+	var err error
+	if l.log, err = NewLog(logDir, l.config); err != nil {
+		return err
+	}
+	// Raft replays every committed record into the log on start, so start it empty
+	return l.log.Reset()
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	if l.config.Raft.LocalID == "" {
+		return fmt.Errorf("raft config needs a local ID")
+	}
+	if l.config.Raft.Transport == nil {
+		return fmt.Errorf("raft config needs a transport")
+	}
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := l.config.mkdirAll(raftDir); err != nil {
+		return err
+	}
+
+	// Raft's log entries and its term and vote are kept in bolt
+	var err error
+	l.boltStore, err = raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	logStore, err := raft.NewLogCache(512, l.boltStore)
+	if err != nil {
+		return err
+	}
+	retain := 1
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, retain, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	// defaults, overridden by whatever the config sets
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.Logger != nil {
+		config.Logger = l.config.Raft.Logger
+	}
+
+	transport := l.config.Raft.Transport
+	l.raft, err = raft.NewRaft(config, &fsm{log: l.log}, logStore, l.boltStore, snapshots, transport)
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(logStore, l.boltStore, snapshots)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		err = l.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return err
+}
+
+// Append proposes the record to the cluster, returning its offset once it's committed.
+// Only the leader can append, and it's the leader that runs Config.Validator
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	if err := l.config.validate(record); err != nil {
+		return 0, err
+	}
+	// the leader timestamps the record so every node stores the same one
+	record.Timestamp = l.config.clock().Now().UnixNano()
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// apply encodes the request behind its type and waits for the FSM to apply it
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := buf.WriteByte(byte(reqType)); err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = buf.Write(b); err != nil {
+		return nil, err
+	}
+	future := l.raft.Apply(buf.Bytes(), applyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read reads the record at off from the local log, which may lag the leader
+func (l *DistributedLog) Read(off uint64) (*api.Record, error) {
+	return l.log.Read(off)
+}
+
+// Join adds the server with the given ID and Raft address to the cluster as a voter.
+// It must be called on the leader
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// the server has already joined
+				return nil
+			}
+			// the ID or the address moved, so remove the stale server first
+			if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server with the given ID from the cluster. It must be called on the leader
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// GetServers returns the servers in the cluster's Raft configuration, flagging the leader.
+// Nodes serve their RPCs on their Raft address, so it's given as each server's RPC address
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leaderID := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: server.ID == leaderID,
+		})
+	}
+	return servers, nil
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or timeout passes
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down the node's Raft and closes its local log
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.boltStore.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+// RequestType tags each command in Raft's log with the request it encodes
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = 0
+)
+
+// fsm applies committed commands to the local log
+type fsm struct {
+	log *Log
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	if len(buf) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	switch RequestType(buf[0]) {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	}
+	return fmt.Errorf("unknown request type %d", buf[0])
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offset, err := f.log.appendReplicated(req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+// Snapshot captures the log's stores as they are now; appends applied while the snapshot
+// is persisted aren't part of it
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+// Restore replaces the log with the records in a snapshot
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	framing, err := newFraming(f.log.Config)
+	if err != nil {
+		return err
+	}
+	frames := &storeReader{framing: framing, r: bufio.NewReader(r)}
+	for i := 0; ; i++ {
+		p, _, err := frames.Next()
+		if err == io.EOF {
+			if i == 0 {
+				// an empty snapshot restores an empty log
+				f.log.Config.Segment.InitialOffset = 0
+				return f.log.Reset()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if i == 0 {
+			// start the log where the snapshot's oldest record is
+			f.log.Config.Segment.InitialOffset = record.Offset
+			if err = f.log.Reset(); err != nil {
+				return err
+			}
+		}
+		if _, err = f.log.appendReplicated(record); err != nil {
+			return err
+		}
+	}
+}
+
+// snapshot streams a copy of the log's stores to Raft's snapshot sink
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
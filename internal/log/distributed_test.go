@@ -0,0 +1,197 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributedLog(t *testing.T) {
+	var logs []*DistributedLog
+	var transports []*raft.InmemTransport
+	nodeCount := 3
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		_, transport := raft.NewInmemTransport(raft.ServerAddress(fmt.Sprintf("node-%d", i)))
+		// wire each node to the ones before it, both ways
+		for _, peer := range transports {
+			transport.Connect(peer.LocalAddr(), peer)
+			peer.Connect(transport.LocalAddr(), transport)
+		}
+		transports = append(transports, transport)
+
+		c := Config{}
+		c.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		c.Raft.Transport = transport
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		// only the first node bootstraps, the others join it
+		c.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, c)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(string(c.Raft.LocalID), string(transport.LocalAddr())))
+		}
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		// followers apply the record once it's committed
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				got, err := l.Read(off)
+				if err != nil {
+					return false
+				}
+				if !bytes.Equal(got.Value, record.Value) || got.Timestamp != record.Timestamp {
+					return false
+				}
+			}
+			return true
+		}, 2*time.Second, 20*time.Millisecond)
+	}
+
+	// every node agrees there's one leader
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			servers, err := l.GetServers()
+			require.NoError(t, err)
+			leaders := 0
+			for _, server := range servers {
+				if server.IsLeader {
+					leaders++
+					require.Equal(t, "0", server.Id)
+				}
+			}
+			return len(servers) == 3 && leaders == 1
+		}, 2*time.Second, 20*time.Millisecond)
+	}
+
+	// a server that leaves stops receiving records
+	require.NoError(t, logs[0].Leave("1"))
+	off, err := logs[0].Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := logs[2].Read(off)
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, err = logs[1].Read(off)
+	require.Error(t, err)
+
+	// followers can't append
+	_, err = logs[2].Append(&api.Record{Value: []byte("fourth")})
+	require.Error(t, err)
+}
+
+func TestDistributedLogRestart(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "distributed-log-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	open := func() *DistributedLog {
+		_, transport := raft.NewInmemTransport("node-0")
+		c := Config{}
+		c.Raft.LocalID = "0"
+		c.Raft.Transport = transport
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.Bootstrap = true
+		l, err := NewDistributedLog(dataDir, c)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+	l := open()
+	off, err := l.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.NoError(t, l.log.CommitOffset("group", off+1))
+	require.NoError(t, l.Close())
+
+	// the records are replayed into the reset log, and the committed offsets are kept
+	l = open()
+	defer l.Close()
+	require.Eventually(t, func() bool {
+		_, err := l.Read(off)
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+	committed, err := l.log.FetchOffset("group")
+	require.NoError(t, err)
+	require.Equal(t, off+1, committed)
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	src := newTestFSM(t, 5)
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := src.log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	// the snapshot doesn't include records appended after it's taken
+	_, err = src.log.Append(&api.Record{Value: []byte("d")})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	b, err := io.ReadAll(snap.(*snapshot).reader)
+	require.NoError(t, err)
+	buf.Write(b)
+
+	dst := newTestFSM(t, 0)
+	_, err = dst.log.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+	require.NoError(t, dst.Restore(io.NopCloser(&buf)))
+
+	lowest, err := dst.log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lowest)
+	highest, err := dst.log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), highest)
+	for off := lowest; off <= highest; off++ {
+		want, err := src.log.Read(off)
+		require.NoError(t, err)
+		got, err := dst.log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+}
+
+func newTestFSM(t *testing.T, initialOffset uint64) *fsm {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fsm-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.InitialOffset = initialOffset
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return &fsm{log: l}
+}
@@ -0,0 +1,163 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// exportRecord is a record's NDJSON form. Value is a []byte, so it's base64 encoded
+type exportRecord struct {
+	Offset    uint64         `json:"offset"`
+	Timestamp int64          `json:"timestamp"`
+	Key       []byte         `json:"key,omitempty"`
+	Value     []byte         `json:"value"`
+	Payload   *exportPayload `json:"payload,omitempty"`
+}
+
+// exportPayload is a typed payload's NDJSON form, its type URL and marshaled message
+type exportPayload struct {
+	TypeURL string `json:"type_url"`
+	Value   []byte `json:"value"`
+}
+
+// writes the records from the from offset to the to offset (inclusive) to w as
+// newline-delimited JSON, one object per record. The range is clamped to the offsets the log holds
+func (l *Log) ExportJSON(w io.Writer, from, to uint64) error {
+	if from > to {
+		return fmt.Errorf("export range %d-%d is empty", from, to)
+	}
+	l.mu.RLock()
+	lowest, next := l.segments[0].baseOffset, l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	if next == lowest {
+		// nothing to export
+		return nil
+	}
+	if from < lowest {
+		from = lowest
+	}
+	if to >= next {
+		to = next - 1
+	}
+
+	bw := bufio.NewWriter(w)
+	e := json.NewEncoder(bw)
+	// read a record at a time so appends aren't blocked behind a slow writer
+	for off := from; off <= to; off++ {
+		record, err := l.Read(off)
+		if err != nil {
+			return err
+		}
+		er := exportRecord{
+			Offset:    record.Offset,
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Value:     record.Value,
+		}
+		if record.Payload != nil {
+			er.Payload = &exportPayload{TypeURL: record.Payload.TypeUrl, Value: record.Payload.Value}
+		}
+		if err = e.Encode(er); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// appends the NDJSON records read from r, as written by ExportJSON, and returns how many
+// were imported. The log assigns new offsets and timestamps, so those in the input are ignored.
+// Import stops at the first malformed line, leaving the records before it appended
+func (l *Log) ImportJSON(r io.Reader) (uint64, error) {
+	br := bufio.NewReader(r)
+	var n uint64
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			record, perr := parseExportRecord(b)
+			if perr != nil {
+				return n, fmt.Errorf("line %d: %w", line, perr)
+			}
+			imported := &api.Record{Key: record.Key, Value: record.Value}
+			if record.Payload != nil {
+				imported.Payload = &anypb.Any{TypeUrl: record.Payload.TypeURL, Value: record.Payload.Value}
+			}
+			if _, aerr := l.Append(imported); aerr != nil {
+				return n, fmt.Errorf("line %d: %w", line, aerr)
+			}
+			n++
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+// appends the records read from r, framed as in the log's stores, e.g. by another log's Reader,
+// and returns how many were appended. It skips the JSON of ImportJSON, so it's the faster way to
+// bulk-load one log from another, but both must be configured with the same framing, i.e.
+// Store.DisableChecksum and Store.ByteOrder. Like ImportJSON the log assigns new offsets, but
+// records keep their timestamps. It stops at the first frame that can't be read, leaving the
+// records before it appended, and a truncated final frame is reported with the bytes consumed
+func (l *Log) AppendFrom(r io.Reader) (uint64, error) {
+	framing, err := newFraming(l.Config)
+	if err != nil {
+		return 0, err
+	}
+	frames := &storeReader{framing: framing, r: bufio.NewReader(r)}
+	var n uint64
+	for {
+		p, pos, err := frames.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return n, fmt.Errorf("truncated frame after %d bytes: %w", frames.pos, err)
+		}
+		if err != nil {
+			return n, fmt.Errorf("frame at byte %d: %w", frames.pos, err)
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return n, fmt.Errorf("frame at byte %d: %w", pos, err)
+		}
+		if err = l.appendFrame(record); err != nil {
+			return n, fmt.Errorf("frame at byte %d: %w", pos, err)
+		}
+		n++
+	}
+}
+
+// appends a record read by AppendFrom, checking it like Append but keeping its timestamp
+func (l *Log) appendFrame(record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.Config.validate(record); err != nil {
+		return err
+	}
+	_, err := l.write(record)
+	return err
+}
+
+// parses a single line of NDJSON, rejecting unknown fields and anything after the object
+func parseExportRecord(b []byte) (*exportRecord, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	record := &exportRecord{}
+	if err := d.Decode(record); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("unexpected data after record")
+	}
+	return record, nil
+}
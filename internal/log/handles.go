@@ -0,0 +1,125 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+)
+
+// openSegments bounds how many sealed segments keep their files open, closing the least
+// recently read once there are more than max and reopening them when they're next read.
+// Reads share the log's read lock, so a segment's files are only closed once no read holds
+// them. The active segment isn't tracked, it's always open. A nil openSegments keeps every
+// segment open
+type openSegments struct {
+	max int
+	mu  sync.Mutex
+	// lru holds the tracked segments whose files are open, most recently read first
+	lru *list.List
+}
+
+// newOpenSegments returns an openSegments keeping up to max segments open, counting the
+// active one, or nil if max is zero
+func newOpenSegments(max int) *openSegments {
+	if max <= 0 {
+		return nil
+	}
+	// the active segment takes one of the slots
+	return &openSegments{max: max - 1, lru: list.New()}
+}
+
+// add starts tracking a segment that's just been sealed, with its files open. Only
+// file-backed segments are tracked, memory-backed ones have no files to close
+func (o *openSegments) add(s *segment) error {
+	if o == nil {
+		return nil
+	}
+	if _, ok := s.store.(*store); !ok {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s.handles, s.tracked = o, true
+	s.elem = o.lru.PushFront(s)
+	return o.evict()
+}
+
+// acquire reopens s's files if they were closed and keeps them open until release.
+// Untracked segments are always open
+func (o *openSegments) acquire(s *segment) error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !s.tracked {
+		return nil
+	}
+	if s.elem == nil {
+		if err := s.reopenFiles(); err != nil {
+			return err
+		}
+		s.elem = o.lru.PushFront(s)
+	} else {
+		o.lru.MoveToFront(s.elem)
+	}
+	s.refs++
+	return o.evict()
+}
+
+// release lets s's files be closed again. They're closed by the next acquire or add that
+// finds too many open, so a failure to close them is returned there
+func (o *openSegments) release(s *segment) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s.tracked && s.refs > 0 {
+		s.refs--
+	}
+}
+
+// remove stops tracking s, which is being closed, and reports whether its files are already
+func (o *openSegments) remove(s *segment) bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !s.tracked {
+		return false
+	}
+	s.tracked = false
+	if s.elem == nil {
+		return true
+	}
+	o.lru.Remove(s.elem)
+	s.elem = nil
+	return false
+}
+
+// evict closes the files of the least recently read segments no read holds until no more
+// than max are open, the caller must hold o.mu
+func (o *openSegments) evict() error {
+	for e := o.lru.Back(); e != nil && o.lru.Len() > o.max; {
+		prev := e.Prev()
+		if s := e.Value.(*segment); s.refs == 0 {
+			o.lru.Remove(e)
+			s.elem = nil
+			if err := s.releaseFiles(); err != nil {
+				return err
+			}
+		}
+		e = prev
+	}
+	return nil
+}
+
+// lock holds off closing and reopening files, for reading the segments' file sizes
+func (o *openSegments) lock() func() {
+	if o == nil {
+		return func() {}
+	}
+	o.mu.Lock()
+	return o.mu.Unlock
+}
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 
@@ -13,16 +16,99 @@ var (
 	entWidth        = offWidth + posWidth
 )
 
+var (
+	// indexMagic starts the header of an index with non-default entry widths, checksums or byte
+	// order. Headerless indexes use the default widths without checksums, and since their first
+	// entry's offset is always 0 they can't be mistaken for a header
+	indexMagic = []byte("PLIX")
+)
+
+// # of bytes in an index header: the magic, the offset, position and checksum widths, and the
+// byte order
+const indexHeaderWidth uint64 = 8
+
+// the byte orders an index header records its segment's index and store were written with.
+// Headers written before the order was recorded have orderUnrecorded, as do headerless
+// indexes, so they're read with the configured order
+const (
+	orderUnrecorded byte = iota
+	orderBigEndian
+	orderLittleEndian
+)
+
+// orderByte returns the header byte recording enc
+func orderByte(enc binary.ByteOrder) byte {
+	switch enc {
+	case binary.BigEndian:
+		return orderBigEndian
+	case binary.LittleEndian:
+		return orderLittleEndian
+	}
+	return orderUnrecorded
+}
+
+// byteOrder returns the order header byte b records, nil if it's orderUnrecorded
+func byteOrder(b byte) (binary.ByteOrder, error) {
+	switch b {
+	case orderUnrecorded:
+		return nil, nil
+	case orderBigEndian:
+		return binary.BigEndian, nil
+	case orderLittleEndian:
+		return binary.LittleEndian, nil
+	}
+	return nil, fmt.Errorf("invalid index byte order: %d", b)
+}
+
+// recordedOrder returns c with the byte order the index of the segment at baseOffset in dir
+// records, so its store is read with the order it was written with. c is returned as it is
+// if the index is missing or records no order
+func (c Config) recordedOrder(dir string, baseOffset uint64) (Config, error) {
+	f, err := os.Open(c.segmentPath(dir, baseOffset, ".index"))
+	if err != nil {
+		return c, nil
+	}
+	defer f.Close()
+	header := make([]byte, indexHeaderWidth)
+	if _, err = io.ReadFull(f, header); err != nil ||
+		string(header[:len(indexMagic)]) != string(indexMagic) {
+		return c, nil
+	}
+	order, err := byteOrder(header[len(indexMagic)+3])
+	if err != nil || order == nil {
+		return c, err
+	}
+	c.Store.ByteOrder = order
+	return c, nil
+}
+
+// ErrCorruptIndex is returned when an index entry's checksum doesn't match its offset and position
+var ErrCorruptIndex = fmt.Errorf("corrupt index entry")
+
 type index struct {
 	file *os.File
 	mmap gommap.MMap
 	size uint64
+	enc  binary.ByteOrder
+	// the entry layout and the bytes ahead of the first entry. sumWidth is 0, or crcWidth for
+	// indexes whose entries end with a checksum of their offset and position
+	offWidth, posWidth, sumWidth, entWidth uint64
+	header                                 uint64
+	// readOnly indexes map the file as it is and reject writes
+	readOnly bool
+	// maxBytes is the most the file grows to, see Config.Segment.InitialIndexBytes
+	maxBytes uint64
+	// preallocate reserves the file's blocks each time it grows, see Config.Preallocate
+	preallocate bool
 }
 
 func newIndex(f *os.File, c Config) (*index, error) {
 	// creates an index for the given file f
 	idx := &index{
-		file: f,
+		file:        f,
+		enc:         c.byteOrder(),
+		maxBytes:    c.Segment.MaxIndexBytes,
+		preallocate: c.Preallocate,
 	}
 	fi, err := os.Stat(f.Name())
 	if err != nil {
@@ -31,12 +117,25 @@ func newIndex(f *os.File, c Config) (*index, error) {
 
 	// track the size of the file as we add entries
 	idx.size = uint64(fi.Size())
+	if err = idx.layout(c); err != nil {
+		return nil, err
+	}
+	if c.readOnly {
+		idx.readOnly = true
+		return idx, idx.mapReadOnly()
+	}
 	if err = os.Truncate(
-		// We grow the file to the max index size before MMapping
-		f.Name(), int64(c.Segment.MaxIndexBytes),
+		// We grow the file to the max index size, or as far as it needs to grow
+		// from the initial size, before MMapping
+		f.Name(), int64(idx.initialBytes(c)),
 	); err != nil {
 		return nil, err
 	}
+	if idx.preallocate {
+		if err = preallocate(f, idx.initialBytes(c)); err != nil {
+			return nil, err
+		}
+	}
 	if idx.mmap, err = gommap.Map(
 		idx.file.Fd(),
 		gommap.PROT_READ|gommap.PROT_WRITE,
@@ -44,51 +143,390 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	); err != nil {
 		return nil, err
 	}
+	idx.trimPadding()
+	if idx.size == 0 && idx.header > 0 {
+		// new index with custom widths: record them so it's always read back with them
+		if uint64(len(idx.mmap)) < idx.header {
+			return nil, io.EOF
+		}
+		copy(idx.mmap, indexMagic)
+		idx.mmap[len(indexMagic)] = byte(idx.offWidth)
+		idx.mmap[len(indexMagic)+1] = byte(idx.posWidth)
+		idx.mmap[len(indexMagic)+2] = byte(idx.sumWidth)
+		idx.mmap[len(indexMagic)+3] = orderByte(idx.enc)
+		idx.size = idx.header
+	}
 	return idx, nil
 }
+
+// initialBytes returns the size to map the index file at: the max index size, or with
+// Config.Segment.InitialIndexBytes, the first doubling of it that holds the file's bytes
+func (i *index) initialBytes(c Config) uint64 {
+	n := c.Segment.InitialIndexBytes
+	if n == 0 || n >= i.maxBytes {
+		return i.maxBytes
+	}
+	for n < i.size || n < i.header {
+		n *= 2
+	}
+	if n > i.maxBytes {
+		n = i.maxBytes
+	}
+	return n
+}
+
+// grow doubles the file, up to the max index size, until the next entry fits and remaps it.
+// The entries written so far are in the shared mapping, so they're in the file's pages and
+// survive the remap
+func (i *index) grow() error {
+	n := uint64(len(i.mmap))
+	if n == 0 || n >= i.maxBytes {
+		return io.EOF
+	}
+	for n < i.size+i.entWidth {
+		n *= 2
+	}
+	if n > i.maxBytes {
+		n = i.maxBytes
+	}
+	if n < i.size+i.entWidth {
+		return io.EOF
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	if err := i.file.Truncate(int64(n)); err != nil {
+		return err
+	}
+	if i.preallocate {
+		if err := preallocate(i.file, n); err != nil {
+			return err
+		}
+	}
+	var err error
+	i.mmap, err = gommap.Map(
+		i.file.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	)
+	return err
+}
+
+// mapReadOnly maps the index file read-only at its current size
+func (i *index) mapReadOnly() error {
+	if i.size <= i.header {
+		// nothing to map, and reads return io.EOF before touching the mmap
+		return nil
+	}
+	var err error
+	if i.mmap, err = gommap.Map(
+		i.file.Fd(),
+		gommap.PROT_READ,
+		gommap.MAP_SHARED,
+	); err != nil {
+		return err
+	}
+	i.trimPadding()
+	return nil
+}
+
+// trimPadding drops the zeros past the last entry of an index that wasn't closed, because it's
+// still open for writing or its process crashed, and so is still padded to the max index size.
+// Only the first entry can be all zeros, with offset 0 at position 0 and no checksum
+func (i *index) trimPadding() {
+	if i.size <= i.header {
+		return
+	}
+	i.size -= (i.size - i.header) % i.entWidth
+	for i.size > i.header+i.entWidth && i.zero(i.size-i.entWidth) {
+		i.size -= i.entWidth
+	}
+}
+
+// zero reports whether the entry at pos is all zeros
+func (i *index) zero(pos uint64) bool {
+	for _, b := range i.mmap[pos : pos+i.entWidth] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// layout sets the entry widths and byte order: an existing index keeps those it was written
+// with, a new one takes them from the config
+func (i *index) layout(c Config) error {
+	i.offWidth, i.posWidth = offWidth, posWidth
+	if i.size == 0 {
+		if c.Index.OffWidth != 0 {
+			i.offWidth = c.Index.OffWidth
+		}
+		if c.Index.PosWidth != 0 {
+			i.posWidth = c.Index.PosWidth
+		}
+		if c.Index.Checksum {
+			i.sumWidth = crcWidth
+		}
+		if i.offWidth != offWidth || i.posWidth != posWidth || i.sumWidth != 0 ||
+			i.enc != enc {
+			i.header = indexHeaderWidth
+		}
+	} else {
+		header := make([]byte, indexHeaderWidth)
+		if _, err := i.file.ReadAt(header, 0); err != nil && err != io.EOF {
+			return err
+		}
+		if string(header[:len(indexMagic)]) == string(indexMagic) {
+			i.offWidth = uint64(header[len(indexMagic)])
+			i.posWidth = uint64(header[len(indexMagic)+1])
+			// indexes written before checksums were added have a zero here
+			i.sumWidth = uint64(header[len(indexMagic)+2])
+			i.header = indexHeaderWidth
+			order, err := byteOrder(header[len(indexMagic)+3])
+			if err != nil {
+				return err
+			}
+			if order != nil {
+				i.enc = order
+			}
+		}
+	}
+	// offsets are relative to the segment and returned as uint32s
+	if i.offWidth != 2 && i.offWidth != 4 {
+		return fmt.Errorf("invalid index offset width: %d", i.offWidth)
+	}
+	if i.posWidth != 2 && i.posWidth != 4 && i.posWidth != 8 {
+		return fmt.Errorf("invalid index position width: %d", i.posWidth)
+	}
+	if i.sumWidth != 0 && i.sumWidth != crcWidth {
+		return fmt.Errorf("invalid index checksum width: %d", i.sumWidth)
+	}
+	i.entWidth = i.offWidth + i.posWidth + i.sumWidth
+	return nil
+}
+
 func (i *index) Close() error {
+	if i.readOnly {
+		if i.mmap != nil {
+			if err := i.mmap.UnsafeUnmap(); err != nil {
+				return err
+			}
+			i.mmap = nil
+		}
+		return i.file.Close()
+	}
+	// shrink the file to the bytes in use so closed indexes don't waste disk
+	if err := i.Truncate(i.size); err != nil {
+		return err
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	return i.file.Close()
+}
+
+// release closes the index of a sealed segment, shrinking and syncing its file, until reopen
+func (i *index) release() error {
+	return i.Close()
+}
+
+// reopen maps the index's file again after release. Its segment is sealed, so it's mapped
+// read-only at the size it was shrunk to
+func (i *index) reopen() error {
+	f, err := os.Open(i.Name())
+	if err != nil {
+		return err
+	}
+	i.file, i.readOnly = f, true
+	if err = i.mapReadOnly(); err != nil {
+		f.Close()
+		return err
+	}
+	return nil
+}
+
+// Sync writes the mapped entries back to the file and fsyncs it
+func (i *index) Sync() error {
+	if i.readOnly {
+		// nothing's been written to the mapping
+		return nil
+	}
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
+	return i.file.Sync()
+}
+
+// Truncate syncs the index and shrinks its file to size bytes, dropping any entries past it.
+// The mapping isn't resized, so the index must be reopened with newIndex before more writes
+func (i *index) Truncate(size uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
+	if err := i.Sync(); err != nil {
 		return err
 	}
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(size)); err != nil {
 		return err
 	}
-	return i.file.Close()
+	if size < i.size {
+		i.size = size
+	}
+	return nil
 }
+
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	// Read(int64) takes in an offset and returns the associated record's position in the store
-	if i.size == 0 {
+	if i.size <= i.header {
 		return 0, 0, io.EOF
 	}
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
+		out = uint32(((i.size - i.header) / i.entWidth) - 1)
 	} else {
 		out = uint32(in)
 	}
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	pos = i.header + uint64(out)*i.entWidth
+	if i.size < pos+i.entWidth {
 		return 0, 0, io.EOF
 	}
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
-	return out, pos, nil
+	e, err := i.entryAt(pos)
+	return e.Off, e.Pos, err
+}
+
+// entry is an index entry: a record's offset relative to its segment and its position in the store
+type entry struct {
+	Off uint32
+	Pos uint64
 }
+
+// ReadRange returns up to count entries from the start'th on, fewer if the index ends first,
+// decoding them in one pass over the mmap so a range scan can then read the store sequentially.
+// It returns io.EOF if there's no start'th entry
+func (i *index) ReadRange(start, count int64) ([]entry, error) {
+	if start < 0 || count < 0 {
+		return nil, fmt.Errorf("invalid index range: %d entries from %d", count, start)
+	}
+	n := int64(i.entries())
+	if start >= n {
+		return nil, io.EOF
+	}
+	if count > n-start {
+		count = n - start
+	}
+	entries := make([]entry, count)
+	pos := i.header + uint64(start)*i.entWidth
+	for j := range entries {
+		var err error
+		if entries[j], err = i.entryAt(pos); err != nil {
+			return nil, err
+		}
+		pos += i.entWidth
+	}
+	return entries, nil
+}
+
+// entryAt decodes the entry at pos in the mmap, checking its checksum if the index has them
+func (i *index) entryAt(pos uint64) (entry, error) {
+	if i.sumWidth > 0 && i.get(pos+i.offWidth+i.posWidth, i.sumWidth) != i.checksum(pos) {
+		return entry{}, fmt.Errorf("%w: entry %d", ErrCorruptIndex, (pos-i.header)/i.entWidth)
+	}
+	return entry{
+		Off: uint32(i.get(pos, i.offWidth)),
+		Pos: i.get(pos+i.offWidth, i.posWidth),
+	}, nil
+}
+
 func (i *index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
-		// Validate that there is space available
-		return io.EOF
+	if i.readOnly {
+		return ErrReadOnly
+	}
+	if uint64(len(i.mmap)) < i.size+i.entWidth {
+		// Validate that there is space available, growing the file if it can
+		if err := i.grow(); err != nil {
+			return err
+		}
+	}
+	if i.overflows(uint64(off), i.offWidth) || i.overflows(pos, i.posWidth) {
+		return fmt.Errorf("index entry (%d, %d) doesn't fit the index widths", off, pos)
 	}
 	// Encode offset and position to MMap file
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	i.put(i.size, i.offWidth, uint64(off))
+	i.put(i.size+i.offWidth, i.posWidth, pos)
+	if i.sumWidth > 0 {
+		i.put(i.size+i.offWidth+i.posWidth, i.sumWidth, i.checksum(i.size))
+	}
 
 	// Increment position for next write
-	i.size += uint64(entWidth)
+	i.size += i.entWidth
 	return nil
 }
+
+// checksum returns the checksum of the offset and position of the entry at pos in the mmap
+func (i *index) checksum(pos uint64) uint64 {
+	return uint64(crc32.ChecksumIEEE(i.mmap[pos : pos+i.offWidth+i.posWidth]))
+}
+
+// get decodes the width-byte integer at pos in the mmap
+func (i *index) get(pos, width uint64) uint64 {
+	b := i.mmap[pos : pos+width]
+	switch width {
+	case 2:
+		return uint64(i.enc.Uint16(b))
+	case 4:
+		return uint64(i.enc.Uint32(b))
+	default:
+		return i.enc.Uint64(b)
+	}
+}
+
+// put encodes v as a width-byte integer at pos in the mmap
+func (i *index) put(pos, width, v uint64) {
+	b := i.mmap[pos : pos+width]
+	switch width {
+	case 2:
+		i.enc.PutUint16(b, uint16(v))
+	case 4:
+		i.enc.PutUint32(b, uint32(v))
+	default:
+		i.enc.PutUint64(b, v)
+	}
+}
+
+// overflows reports whether v needs more than width bytes
+func (i *index) overflows(v, width uint64) bool {
+	return width < 8 && v >= 1<<(8*width)
+}
+
+// IndexStats describes a segment's index
+type IndexStats struct {
+	// Entries is the # of records indexed
+	Entries uint64
+	// Size is the # of bytes the entries and any header use
+	Size uint64
+	// FileSize is the # of bytes the file takes, which while it's open for writing is
+	// preallocated to the max index size
+	FileSize uint64
+}
+
+// Stats returns the index's entry count and sizes. The index has no lock of its own, so the
+// caller must hold its segment's log's lock
+func (i *index) Stats() IndexStats {
+	st := IndexStats{Entries: i.entries(), Size: i.size, FileSize: i.size}
+	if uint64(len(i.mmap)) > st.FileSize {
+		st.FileSize = uint64(len(i.mmap))
+	}
+	return st
+}
+
+// entries returns the # of entries in the index
+func (i *index) entries() uint64 {
+	if i.size <= i.header {
+		return 0
+	}
+	return (i.size - i.header) / i.entWidth
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
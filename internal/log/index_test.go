@@ -1,6 +1,7 @@
 package log
 
 import (
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"os"
@@ -56,3 +57,267 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexByteOrder(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_byte_order_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Store.ByteOrder = binary.LittleEndian
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(1, 10))
+	// the order's recorded in the header, ahead of the entries
+	require.Equal(t, orderLittleEndian, idx.mmap[len(indexMagic)+3])
+	require.Equal(t, uint32(1), binary.LittleEndian.Uint32(
+		idx.mmap[indexHeaderWidth:indexHeaderWidth+offWidth],
+	))
+	require.NoError(t, idx.Close())
+
+	// and it's read back with it whatever the config says
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	c.Store.ByteOrder = nil
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(10), pos)
+}
+
+func TestIndexTruncate(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_truncate_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for off := uint32(0); off < 3; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*10))
+	}
+	require.NoError(t, idx.Close())
+
+	// closed indexes shrink to exactly the bytes the entries use
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(3*entWidth), fi.Size())
+
+	// and grow back to the max size when reopened for writes
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	fi, err = os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(c.Segment.MaxIndexBytes), fi.Size())
+	require.NoError(t, idx.Write(3, 30))
+	_, pos, err := idx.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), pos)
+
+	// truncating drops the entries past the new size
+	require.NoError(t, idx.Truncate(2*entWidth))
+	_, _, err = idx.Read(2)
+	require.Equal(t, io.EOF, err)
+	fi, err = os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(2*entWidth), fi.Size())
+}
+
+func TestIndexStats(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_stats_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, IndexStats{FileSize: 1024}, idx.Stats())
+	for off := uint32(0); off < 3; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*10))
+	}
+	require.Equal(t, IndexStats{Entries: 3, Size: 3 * entWidth, FileSize: 1024}, idx.Stats())
+	require.NoError(t, idx.Close())
+
+	// read-only indexes are mapped at the size they were closed at
+	f, _ = os.Open(f.Name())
+	c.readOnly = true
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	require.Equal(t, IndexStats{Entries: 3, Size: 3 * entWidth, FileSize: 3 * entWidth}, idx.Stats())
+}
+
+func TestIndexGrowth(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_growth_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.InitialIndexBytes = 32
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	fileSize := func() int64 {
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	require.Equal(t, int64(32), fileSize())
+
+	// ten entries take 120 bytes, so the file doubles twice
+	for off := uint32(0); off < 10; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*10))
+	}
+	require.Equal(t, int64(128), fileSize())
+	for off := uint32(0); off < 10; off++ {
+		_, pos, err := idx.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, uint64(off)*10, pos)
+	}
+	require.Equal(t, IndexStats{Entries: 10, Size: 10 * entWidth, FileSize: 128}, idx.Stats())
+	require.NoError(t, idx.Close())
+
+	// reopening maps just enough for the entries, and writes grow it up to the max
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, int64(128), fileSize())
+	off := uint32(10)
+	for ; idx.Write(off, uint64(off)*10) == nil; off++ {
+	}
+	require.Equal(t, uint32(c.Segment.MaxIndexBytes/entWidth), off)
+	require.Equal(t, int64(1024), fileSize())
+	_, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(off-1)*10, pos)
+	_, pos, err = idx.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(30), pos)
+	require.NoError(t, idx.Close())
+}
+
+func TestIndexWidths(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_widths_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Index.OffWidth = 2
+	c.Index.PosWidth = 4
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for off := uint32(0); off < 3; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*1000))
+	}
+	for off := uint32(0); off < 3; off++ {
+		got, pos, err := idx.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, off, got)
+		require.Equal(t, uint64(off)*1000, pos)
+	}
+	// positions past the width's range are rejected rather than truncated
+	require.Error(t, idx.Write(3, 1<<32))
+	require.NoError(t, idx.Close())
+
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(indexHeaderWidth+3*6), fi.Size())
+
+	// reopening with the default widths still reads the entries with the recorded ones
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	c.Index.OffWidth, c.Index.PosWidth = 0, 0
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), idx.entWidth)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(2000), pos)
+	require.NoError(t, idx.Write(3, 3000))
+	_, pos, err = idx.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3000), pos)
+}
+
+func TestIndexInvalidWidths(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_invalid_widths_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Index.OffWidth = 8
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+}
+
+func TestIndexChecksum(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Index.Checksum = true
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, entWidth+crcWidth, idx.entWidth)
+	for off := uint32(0); off < 3; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*100))
+	}
+	require.NoError(t, idx.Close())
+
+	// flip a byte of the second entry's position
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	b[indexHeaderWidth+idx.entWidth+offWidth] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(f.Name(), b, 0600))
+
+	// reopening without the option still checks the entries, it's recorded in the index
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	c.Index.Checksum = false
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	_, pos, err := idx.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), pos)
+	_, _, err = idx.Read(1)
+	require.ErrorIs(t, err, ErrCorruptIndex)
+	_, pos, err = idx.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), pos)
+}
+
+func TestIndexReadRange(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_read_range_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Index.Checksum = true
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	_, err = idx.ReadRange(0, 10)
+	require.Equal(t, io.EOF, err)
+	for off := uint32(0); off < 10; off++ {
+		require.NoError(t, idx.Write(off, uint64(off)*100))
+	}
+
+	// the batch matches the entries read one at a time, stopping at the last
+	entries, err := idx.ReadRange(3, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 7)
+	for j, e := range entries {
+		off, pos, err := idx.Read(int64(3 + j))
+		require.NoError(t, err)
+		require.Equal(t, entry{Off: off, Pos: pos}, e)
+	}
+	entries, err = idx.ReadRange(0, 2)
+	require.NoError(t, err)
+	require.Equal(t, []entry{{Off: 0, Pos: 0}, {Off: 1, Pos: 100}}, entries)
+	_, err = idx.ReadRange(10, 1)
+	require.Equal(t, io.EOF, err)
+	_, err = idx.ReadRange(-1, 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,42 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockName is the file in a log's directory its writer holds an exclusive flock on
+const lockName = "LOCK"
+
+// ErrLocked is returned by NewLog when another process has the log's directory open for writing
+var ErrLocked = fmt.Errorf("log is locked by another writer")
+
+// lockDir takes an exclusive advisory lock on dir's lock file without waiting for it, and
+// returns the file holding it. The lock goes with the open file, so it's released when the file
+// is closed, or the process exits
+func lockDir(dir string, c Config) (*os.File, error) {
+	f, err := c.openFile(path.Join(dir, lockName), os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlock releases the log's directory lock, if it holds it
+func (l *Log) unlock() error {
+	if l.lock == nil {
+		return nil
+	}
+	err := l.lock.Close()
+	l.lock = nil
+	return err
+}
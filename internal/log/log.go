@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,8 +11,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/magus-1/proglog/api/v1"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Log struct {
@@ -22,50 +26,147 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+
+	// cache remembers the segments recent reads found, nil unless Config.Segment.CacheSize is set
+	cache *segmentCache
+	// records keeps recently read records, nil unless Config.ReadCacheSize is set
+	records *recordCache
+	// handles closes the files of segments that haven't been read in a while, nil unless
+	// Config.MaxOpenSegments is set
+	handles *openSegments
+
+	// keys maps each record key to its newest offset, nil unless Config.Keys.Index is set
+	keys map[string]uint64
+	// producers maps each producer to its last sequence #, nil unless Config.Producers.Dedupe
+	// is set
+	producers map[string]producerState
+
+	// offsets are the consumer groups' committed offsets, guarded by offsetsMu rather than mu
+	// so commits don't hold up appends
+	offsetsMu sync.Mutex
+	offsets   map[string]uint64
+
+	// partitions are the partitions Partition has opened, guarded by partitionsMu rather than mu
+	// since each is a log with its own lock
+	partitionsMu sync.Mutex
+	partitions   map[string]*Log
+
+	// lock holds the directory's lock file, so no other process opens it for writing until
+	// Close. Read-only logs don't take it
+	lock *os.File
+
+	// breaker fails appends fast after enough fail in a row, with Config.Breaker.Failures
+	breaker breaker
+	// appends holds a token for each append in flight, nil unless Config.MaxConcurrentAppends
+	// is set
+	appends chan struct{}
+
+	// ready is set once setup has loaded the segments, closed once the log is closed
+	ready  atomic.Bool
+	closed atomic.Bool
 }
 
-// Create a log, add default configs
+// Create a log, add default configs. Only one process at a time can have a directory open for
+// writing, others get ErrLocked until it's closed
 func NewLog(dir string, c Config) (*Log, error) {
-	if c.Segment.MaxStoreBytes == 0 {
-		c.Segment.MaxStoreBytes = 1024
+	c.setDefaults()
+	l := &Log{
+		Dir:     dir,
+		Config:  c,
+		cache:   newSegmentCache(c.Segment.CacheSize),
+		records: newRecordCache(c.ReadCacheSize),
+		handles: newOpenSegments(c.MaxOpenSegments),
 	}
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = 1024
+	if c.MaxConcurrentAppends > 0 {
+		l.appends = make(chan struct{}, c.MaxConcurrentAppends)
 	}
-	l := &Log{
-		Dir:    dir,
-		Config: c,
+	if !c.readOnly {
+		// a missing directory is created with the configured mode
+		if err := c.mkdirAll(dir); err != nil {
+			return nil, err
+		}
+		var err error
+		if l.lock, err = lockDir(dir, c); err != nil {
+			return nil, err
+		}
 	}
 
-	return l, l.setup()
+	if err := l.setup(); err != nil {
+		l.unlock()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ErrReadOnly is returned by the methods that would write to a log opened with OpenReadOnly
+var ErrReadOnly = fmt.Errorf("log is read-only")
+
+// ErrClosed is returned by reads and appends once the log is closed
+var ErrClosed = fmt.Errorf("log is closed")
+
+// ErrOffsetOutOfRange matches the api.ErrOffsetOutOfRange reads return for any offset with
+// errors.Is, errors.As gets the offset
+var ErrOffsetOutOfRange = api.ErrOffsetOutOfRange{}
+
+// opens the existing log in dir for reading only: its files are opened O_RDONLY, the indexes
+// are mapped read-only and every method that writes returns ErrReadOnly. Several processes can
+// share a directory this way, though a read-only log only sees the records that were in its
+// segments when it was opened
+func OpenReadOnly(dir string, c Config) (*Log, error) {
+	c.readOnly = true
+	return NewLog(dir, c)
 }
 
 // bootstrap initial segment or set up with existing segments on disk
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	l.closed.Store(false)
+	// the segments may not be the ones the cached records were read from
+	l.records.reset()
+	if !l.Config.readOnly {
+		if err := finishCompaction(l.Dir, l.Config.Tier.ColdDir); err != nil {
+			return err
+		}
+		if err := finishTiering(l.Dir, l.Config.Tier.ColdDir); err != nil {
+			return err
+		}
+	}
+	baseOffsets, err := segmentBases(l.Dir)
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+	dirs := make(map[uint64]string, len(baseOffsets))
+	for _, baseOffset := range baseOffsets {
+		dirs[baseOffset] = l.Dir
+	}
+	if cold := l.Config.Tier.ColdDir; cold != "" {
+		coldOffsets, err := segmentBases(cold)
+		if err != nil {
+			return err
+		}
+		for _, baseOffset := range coldOffsets {
+			if _, ok := dirs[baseOffset]; !ok {
+				// a segment in both directories is still being moved, so the log's copy is used
+				dirs[baseOffset] = cold
+				baseOffsets = append(baseOffsets, baseOffset)
+			}
+		}
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
+	if err = l.openSegments(dirs, baseOffsets); err != nil {
+		return err
+	}
+	if n := len(l.segments); n > 0 {
+		// keep writing, restoring and appending from in the order the log was written with
+		if order := l.segments[n-1].config.byteOrder(); order != l.Config.byteOrder() {
+			l.Config.Store.ByteOrder = order
 		}
-		// baseOffset contains dup for index and store so we skip the dup
-		i++
 	}
 	if l.segments == nil {
+		if l.Config.readOnly {
+			return fmt.Errorf("%w: %s has none to read", ErrSegmentNotFound, l.Dir)
+		}
 		// bootstrap first segment
 		if err = l.newSegment(
 			l.Config.Segment.InitialOffset,
@@ -73,58 +174,730 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	if l.Config.Keys.Index {
+		if err = l.indexKeys(); err != nil {
+			return err
+		}
+	}
+	if l.Config.Producers.Dedupe {
+		if err = l.indexProducers(); err != nil {
+			return err
+		}
+	}
+	if err = l.loadOffsets(); err != nil {
+		return err
+	}
+	l.reportSize()
+	l.ready.Store(true)
 	return nil
 }
 
+// ErrKeyNotFound is returned by ReadLatestByKey when no record in the log has the key
+var ErrKeyNotFound = fmt.Errorf("key not found")
+
+// rebuilds the key index by reading every record in the log
+func (l *Log) indexKeys() error {
+	l.keys = make(map[string]uint64)
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.peek(off)
+			if err != nil {
+				return err
+			}
+			l.indexKey(record)
+		}
+	}
+	return nil
+}
+
+// records the appended record as its key's newest, the caller must hold the write lock
+func (l *Log) indexKey(record *api.Record) {
+	if l.keys != nil && len(record.Key) > 0 {
+		l.keys[string(record.Key)] = record.Offset
+	}
+}
+
+// reads the newest record appended with the given key, which requires Config.Keys.Index
+func (l *Log) ReadLatestByKey(key []byte) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.keys == nil {
+		return nil, fmt.Errorf("key index isn't enabled")
+	}
+	off, ok := l.keys[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return l.read(noopSpan, off)
+}
+
+// returns an error unless the log is open and its directory accepts writes, which it checks
+// by creating and removing a file there
+func (l *Log) Writable() error {
+	if l.closed.Load() {
+		return ErrClosed
+	}
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	f, err := os.CreateTemp(l.Dir, "writable-*"+tmpExt)
+	if err == nil {
+		f.Close()
+		err = os.Remove(f.Name())
+	}
+	if err != nil {
+		return fmt.Errorf("log directory %s isn't writable: %w", l.Dir, err)
+	}
+	return nil
+}
+
+// returns an error until the log has loaded its segments, or once it isn't writable.
+// A read-only log only needs to be open
+func (l *Log) Ready() error {
+	if !l.ready.Load() {
+		return fmt.Errorf("log isn't set up")
+	}
+	if l.Config.readOnly {
+		if l.closed.Load() {
+			return ErrClosed
+		}
+		return nil
+	}
+	return l.Writable()
+}
+
 // append record to the log
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	_, span := l.startSpan(context.Background(), "Log.Append")
+	release, err := l.admitAppend(context.Background())
+	if err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	defer release()
 	// Notice we are using locks per log, not segment - for learning
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.append(span, record)
+}
+
+// appends like Append, but gives up with ctx.Err() if ctx is done before the log's lock is
+// acquired, or while it waits for Config.MaxConcurrentAppends to let it in. Once the record is
+// being written the append runs to completion
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	ctx, span := l.startSpan(ctx, "Log.Append")
+	release, err := l.admitAppend(ctx)
+	if err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	defer release()
+	if err := lockContext(ctx, l.mu.TryLock); err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	defer l.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	return l.append(span, record)
+}
+
+// appends record to the active segment and ends span, the caller must hold the write lock
+func (l *Log) append(span trace.Span, record *api.Record) (uint64, error) {
+	if err := l.Config.validate(record); err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	record.Timestamp = l.Config.clock().Now().UnixNano()
+	base := l.activeSegment.baseOffset
+	off, err := l.write(record)
+	endSpan(span, record, base, err)
+	return off, err
+}
+
+// appends a record keeping its timestamp, for records replicated from another node's log
+func (l *Log) appendReplicated(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.write(record)
+}
+
+// ErrOffsetMismatch is returned by AppendAt when a record's offset isn't the log's next offset
+var ErrOffsetMismatch = fmt.Errorf("offset mismatch")
+
+// appends a record at the offset it carries, keeping its timestamp, for applying records
+// replicated from another log with the offsets they were given there. The offset must be the
+// log's next offset, otherwise it returns ErrOffsetMismatch and leaves the log as it was, so
+// applying a record twice or out of order can't duplicate or reorder it
+func (l *Log) AppendAt(record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if next := l.activeSegment.nextOffset; record.Offset != next {
+		return fmt.Errorf("%w: the record's offset is %d, the log's next offset is %d",
+			ErrOffsetMismatch, record.Offset, next)
+	}
+	_, err := l.write(record)
+	return err
+}
+
+// writes record to the active segment as is, rolling over once it's full.
+// The caller must hold the write lock
+func (l *Log) write(record *api.Record) (uint64, error) {
+	return l.writeSegment(func(s *segment) (uint64, error) {
+		off, err := s.write(record)
+		if err == nil {
+			l.indexKey(record)
+			l.trackProducer(record)
+		}
+		return off, err
+	})
+}
+
+// appends b at the next offset as is, without wrapping it in a Record, for producers with their
+// own serialization. Offsets and indexing work as they do for records, but a log should be
+// written with AppendRaw or the Record appends, not both: Read only reads records, while
+// ReadRaw reads either, a record as its marshaled bytes. The features that read records
+// rather than bytes, Config.Validator, Config.Keys, Config.Retention.MaxAge,
+// Config.Tier.ColdAge, ReadSince, Compact and the like, don't work over raw appends
+func (l *Log) AppendRaw(b []byte) (uint64, error) {
+	release, err := l.admitAppend(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writeSegment(func(s *segment) (uint64, error) {
+		return s.appendRaw(b)
+	})
+}
+
+// writes to the active segment with write, rolling over once it's full.
+// The caller must hold the write lock
+func (l *Log) writeSegment(write func(*segment) (uint64, error)) (uint64, error) {
+	if l.closed.Load() {
+		return 0, ErrClosed
+	}
+	if l.Config.readOnly {
+		return 0, ErrReadOnly
+	}
+	if err := l.allowWrite(); err != nil {
+		return 0, err
+	}
+	defer l.reportSize()
 
 	// append record to active segment
-	off, err := l.activeSegment.Append(record)
+	start := time.Now()
+	off, err := write(l.activeSegment)
 	if err != nil {
+		l.recordWrite(err)
 		return 0, err
 	}
+	l.Config.metrics().ObserveAppend(time.Since(start))
 	if l.activeSegment.IsMaxed() {
 		// if maxed, go to next segment
-		err = l.newSegment(off + 1)
+		if err = l.newSegment(off + 1); err != nil {
+			return off, err
+		}
+		if err = l.enforceRetention(); err != nil {
+			return off, err
+		}
+		l.expireProducers()
+		err = l.enforceTiering()
 	}
+	l.recordWrite(err)
 	return off, err
 }
 
+// append records to the log in order, rolling over segments as they fill. A record
+// Config.Validator rejects ends the batch: the records before it are appended and their
+// offsets returned with its error
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	release, err := l.admitAppend(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+	if l.Config.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := l.allowWrite(); err != nil {
+		return nil, err
+	}
+	defer l.reportSize()
+
+	var invalid error
+	for i, record := range records {
+		if invalid = l.Config.validate(record); invalid != nil {
+			records = records[:i]
+			break
+		}
+	}
+
+	offsets := make([]uint64, 0, len(records))
+	for len(records) > 0 {
+		start := time.Now()
+		offs, err := l.activeSegment.AppendBatch(records)
+		offsets = append(offsets, offs...)
+		for _, record := range records[:len(offs)] {
+			l.indexKey(record)
+			l.trackProducer(record)
+		}
+		if len(offs) > 0 {
+			// spread the batch's latency over its records
+			per := time.Since(start) / time.Duration(len(offs))
+			m := l.Config.metrics()
+			for range offs {
+				m.ObserveAppend(per)
+			}
+		}
+		if err != nil {
+			l.recordWrite(err)
+			return offsets, err
+		}
+		records = records[len(offs):]
+		if l.activeSegment.IsMaxed() {
+			// continue the rest of the batch on the next segment
+			if err = l.newSegment(l.activeSegment.nextOffset); err != nil {
+				l.recordWrite(err)
+				return offsets, err
+			}
+			if err = l.enforceRetention(); err != nil {
+				return offsets, err
+			}
+			l.expireProducers()
+			if err = l.enforceTiering(); err != nil {
+				return offsets, err
+			}
+		}
+	}
+	l.recordWrite(nil)
+	return offsets, invalid
+}
+
 // reads the record stored at the given offset
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	_, span := l.startSpan(context.Background(), "Log.Read")
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		// find the segment for this absolute offset
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+	return l.read(span, off)
+}
+
+// returns the bytes stored at off as AppendRaw appended them, or a record's marshaled bytes
+func (l *Log) ReadRaw(off uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	b, err := s.ReadRaw(off)
+	if err != nil {
+		return nil, err
+	}
+	l.Config.metrics().ObserveRead(time.Since(start))
+	return b, nil
+}
+
+// reads like Read, but gives up with ctx.Err() if ctx is done before the log's lock is acquired
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	ctx, span := l.startSpan(ctx, "Log.Read")
+	if err := lockContext(ctx, l.mu.TryRLock); err != nil {
+		endSpan(span, nil, 0, err)
+		return nil, err
+	}
+	defer l.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		endSpan(span, nil, 0, err)
+		return nil, err
+	}
+	return l.read(span, off)
+}
+
+// how long lockContext waits between attempts to take a contended lock
+var lockRetryInterval = 100 * time.Microsecond
+
+// takes a lock with tryLock, retrying until it succeeds or ctx is done
+func lockContext(ctx context.Context, tryLock func() bool) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if tryLock() {
+			return nil
 		}
+		t := time.NewTimer(lockRetryInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// waits until fewer than Config.MaxConcurrentAppends appends are in flight and lets this one
+// in, or gives up with ctx.Err() if ctx is done first. The returned func lets the next one in
+func (l *Log) admitAppend(ctx context.Context) (func(), error) {
+	release := func() {}
+	if l.appends != nil {
+		select {
+		case l.appends <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release = func() { <-l.appends }
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range: %d", off)
+	if hook := l.Config.appendHook; hook != nil {
+		hook()
 	}
-	return s.Read(off)
+	return release, nil
 }
 
+// reads the record at off and ends span, the caller must hold the lock
+func (l *Log) read(span trace.Span, off uint64) (*api.Record, error) {
+	if l.closed.Load() {
+		endSpan(span, nil, 0, ErrClosed)
+		return nil, ErrClosed
+	}
+	s, err := l.segmentFor(off)
+	if err != nil {
+		endSpan(span, nil, 0, err)
+		return nil, err
+	}
+	start := time.Now()
+	if record := l.records.get(off); record != nil {
+		s.touch()
+		endSpan(span, record, s.baseOffset, nil)
+		l.Config.metrics().ObserveRead(time.Since(start))
+		return record, nil
+	}
+	record, err := s.Read(off)
+	endSpan(span, record, s.baseOffset, err)
+	if err != nil {
+		return nil, err
+	}
+	l.records.add(record)
+	l.Config.metrics().ObserveRead(time.Since(start))
+	return record, nil
+}
+
+// returns the base offset of the segment holding off and the record's position in its store,
+// without reading the record
+func (l *Log) Position(off uint64) (segmentBase uint64, storePos uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return 0, 0, err
+	}
+	pos, err := s.Position(off)
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.baseOffset, pos, nil
+}
+
+// returns the offset of the record at storePos in the store of the segment based at
+// segmentBase, or of the nearest record before it if storePos is inside a frame, the inverse of
+// Position: e.g. to find the record a position seen in a hexdump of a store file belongs to
+func (l *Log) OffsetAtPosition(segmentBase, storePos uint64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset >= segmentBase
+	})
+	if i == len(l.segments) || l.segments[i].baseOffset != segmentBase {
+		return 0, fmt.Errorf("%w: none is based at %d", ErrSegmentNotFound, segmentBase)
+	}
+	return l.segments[i].OffsetAt(storePos)
+}
+
+// finds the segment holding off, the caller must hold the lock
+func (l *Log) segmentFor(off uint64) (*segment, error) {
+	if s := l.cache.get(off); s != nil {
+		return s, nil
+	}
+	// segments are sorted by base offset, so binary search for the first
+	// segment that ends after off
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return off < l.segments[i].nextOffset
+	})
+	if i == len(l.segments) || off < l.segments[i].baseOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	l.cache.add(l.segments[i])
+	return l.segments[i], nil
+}
+
+// returns the newest n records, or every record if the log has fewer, oldest first. The
+// indexes only point forwards, so it walks each segment's offsets backwards from its newest,
+// the newest segment first, until it has n
+func (l *Log) Tail(n int) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if n <= 0 {
+		return nil, nil
+	}
+	var records []*api.Record
+	for i := len(l.segments) - 1; i >= 0 && len(records) < n; i-- {
+		s := l.segments[i]
+		for off := s.nextOffset; off > s.baseOffset && len(records) < n; off-- {
+			record, err := s.peek(off - 1)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	// newest first so far
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// replayBatch is the # of records Replay reads from a segment at a time
+const replayBatch = 256
+
+// calls fn with each record from the from offset, or the lowest if it's gone, to the newest,
+// stopping at the first error fn returns and returning it. The read lock is held throughout,
+// so fn sees exactly the records the log held when it was called and mustn't call the log
+func (l *Log) Replay(from uint64, fn func(*api.Record) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		off := s.baseOffset
+		if from > off {
+			off = from
+		}
+		for off < s.nextOffset {
+			records, err := s.ReadRange(off, replayBatch)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if err = fn(record); err != nil {
+					return err
+				}
+			}
+			off += uint64(len(records))
+		}
+	}
+	return nil
+}
+
+// returns the first offset whose record was appended at or after t.
+// The search assumes append times only move forward, so a clock stepping backwards
+// while appending can make it skip records
+func (l *Log) ReadSince(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	since := t.UnixNano()
+	var err error
+	after := func(s *segment, off uint64) bool {
+		record, rerr := s.peek(off)
+		if rerr != nil {
+			err = rerr
+			return true
+		}
+		return record.Timestamp >= since
+	}
+
+	// find the first segment whose newest record is recent enough...
+	i := sort.Search(len(l.segments), func(i int) bool {
+		s := l.segments[i]
+		if s.nextOffset == s.baseOffset {
+			// an empty segment can only be the active one, past every record
+			return true
+		}
+		return after(s, s.nextOffset-1)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if i == len(l.segments) || l.segments[i].nextOffset == l.segments[i].baseOffset {
+		return 0, api.ErrOffsetOutOfRange{Offset: l.activeSegment.nextOffset}
+	}
+
+	// ...then the first record in it that is
+	s := l.segments[i]
+	j := sort.Search(int(s.nextOffset-s.baseOffset), func(j int) bool {
+		return after(s, s.baseOffset+uint64(j))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.baseOffset + uint64(j), nil
+}
+
+// returns the base offsets of the segments in dir, which may not exist
+func segmentBases(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		// every segment has exactly one store file, so it names the segment
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offStr := strings.TrimSuffix(
+			file.Name(),
+			path.Ext(file.Name()),
+		)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	return baseOffsets, nil
+}
+
+// opens the existing segments at baseOffsets, in order, in the directories dirs maps them to,
+// making the last the active one. They're opened, and all but the last sealed, by
+// Config.StartupConcurrency workers at once. If any fails to open the ones that did are closed
+// and the first error returned, the caller must hold the write lock
+func (l *Log) openSegments(dirs map[uint64]string, baseOffsets []uint64) error {
+	segments := make([]*segment, len(baseOffsets))
+	errs := make([]error, len(baseOffsets))
+	workers := l.Config.StartupConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				segments[i], errs[i] = newSegment(dirs[baseOffsets[i]], baseOffsets[i], l.Config)
+				if errs[i] == nil && i < len(baseOffsets)-1 {
+					errs[i] = segments[i].Seal()
+				}
+			}
+		}()
+	}
+	for i := range baseOffsets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			for _, s := range segments {
+				if s != nil {
+					s.Close()
+				}
+			}
+			return err
+		}
+	}
+	for i, s := range segments {
+		if i < len(segments)-1 {
+			if err := l.handles.add(s); err != nil {
+				return err
+			}
+		}
+		l.segments = append(l.segments, s)
+		l.activeSegment = s
+	}
+	l.cache.reset()
+	return nil
+}
+
+// creates a segment at off and makes it the active one, sealing the previous active segment
 func (l *Log) newSegment(off uint64) error {
-	s, err := newSegment(l.Dir, off, l.Config)
+	return l.openSegment(l.Dir, off)
+}
+
+// opens the segment at off in dir and makes it the active one, sealing the previous active segment
+func (l *Log) openSegment(dir string, off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.Seal(); err != nil {
+			return err
+		}
+		if err := l.handles.add(l.activeSegment); err != nil {
+			return err
+		}
+	}
+	s, err := newSegment(dir, off, l.Config)
 	if err != nil {
 		return err
 	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.cache.reset()
+	return nil
+}
+
+// flushes and fsyncs every segment's store and index, regardless of Config.Store.Sync, so
+// everything appended before it returns survives a crash. It holds the write lock, so no
+// append is half done when it syncs
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// writes the records buffered in memory to the segments' files, so they're visible to anything
+// reading the files, e.g. a copy of the directory, without fsyncing them. Unlike Sync it doesn't
+// make them durable: they survive the process crashing, but not the machine. Only segments
+// with buffered appends are flushed, and it holds the read lock, so reads carry on meanwhile
+func (l *Log) Flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	for _, s := range l.segments {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closes every segment and releases the directory for other processes to write
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	err := l.close()
+	if perr := l.closePartitions(); err == nil {
+		err = perr
+	}
+	if uerr := l.unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// closes every segment, the caller must hold the write lock
+func (l *Log) close() error {
+	l.ready.Store(false)
+	l.closed.Store(true)
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -134,41 +907,233 @@ func (l *Log) Close() error {
 }
 
 func (l *Log) Remove() error {
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
+	// the partitions' cold directories too
+	if cold := l.Config.Tier.ColdDir; cold != "" {
+		if err := os.RemoveAll(cold); err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(l.Dir)
 }
 
+// removes every segment and starts the log afresh in the same directory, as NewLog would an
+// empty one, ready to be repopulated, e.g. from a snapshot. It holds the write lock
+// throughout, so concurrent calls wait for the empty log rather than seeing it half reset.
+// Consumer groups' committed offsets are kept
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	if err := l.close(); err != nil {
 		return err
 	}
+	// the cold segments go first, a crash then leaves the newest records rather than the oldest
+	if err := l.removeColdDir(); err != nil {
+		return err
+	}
+	// everything but the lock file, which the log still holds, the partitions, which are logs
+	// of their own, and the consumer groups' committed offsets, which outlive the records
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Name() == lockName || file.Name() == partitionsDir || file.Name() == offsetsName {
+			continue
+		}
+		if err = os.RemoveAll(path.Join(l.Dir, file.Name())); err != nil {
+			return err
+		}
+	}
+	l.segments, l.activeSegment, l.keys, l.producers = nil, nil, nil, nil
 	return l.setup()
 }
 
+// Stats describes the log and each of its segments, oldest first
+type Stats struct {
+	Segments []SegmentStats
+	// Records, StoreBytes, BufferedBytes and IndexBytes total the segments' stats
+	Records       uint64
+	StoreBytes    uint64
+	BufferedBytes uint64
+	IndexBytes    uint64
+}
+
+// SegmentStats describes a segment and its store and index
+type SegmentStats struct {
+	BaseOffset uint64
+	NextOffset uint64
+	Store      StoreStats
+	Index      IndexStats
+}
+
+// returns the sizes and record counts of the log and its segments, for embedders that would
+// otherwise have to collect them from its metrics
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// the index file sizes change as their files are closed and reopened
+	defer l.handles.lock()()
+	st := Stats{Segments: make([]SegmentStats, 0, len(l.segments))}
+	for _, s := range l.segments {
+		ss := SegmentStats{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			Store:      s.store.Stats(),
+			Index:      s.index.Stats(),
+		}
+		st.Segments = append(st.Segments, ss)
+		st.Records += ss.Index.Entries
+		st.StoreBytes += ss.Store.Size
+		st.BufferedBytes += ss.Store.Buffered
+		st.IndexBytes += ss.Index.FileSize
+	}
+	return st
+}
+
+// SegmentInfo describes a segment as it was when Segments was called
+type SegmentInfo struct {
+	BaseOffset uint64
+	// NextOffset is the offset the segment's next record would take, so it holds the records
+	// from BaseOffset up to it
+	NextOffset   uint64
+	StoreBytes   uint64
+	IndexEntries uint64
+	// Sealed is set for every segment but the active one, whose records no longer change
+	Sealed bool
+	// LastRead is when the segment's records were last read, the zero time if they haven't
+	// been since the log was opened. The log's own scans, e.g. by Compact, Merge and Tail,
+	// don't count
+	LastRead time.Time
+}
+
+// returns a descriptor of each segment, oldest first, for tools that work through the log a
+// segment at a time. They're copies, so they don't change as the log does
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	infos := make([]SegmentInfo, 0, len(l.segments))
+	_ = l.forEachSegment(false, func(s *segment) error {
+		infos = append(infos, SegmentInfo{
+			BaseOffset:   s.baseOffset,
+			NextOffset:   s.nextOffset,
+			StoreBytes:   s.store.Size(),
+			IndexEntries: s.index.entries(),
+			Sealed:       s != l.activeSegment,
+			LastRead:     s.LastRead(),
+		})
+		return nil
+	})
+	return infos
+}
+
+// errStopSegments ends forEachSegment early, without an error
+var errStopSegments = fmt.Errorf("stop iterating segments")
+
+// calls fn with each segment, or only the sealed ones if sealedOnly, oldest first, until fn
+// returns an error. It returns that error, unless it's errStopSegments.
+// The caller must hold the lock
+func (l *Log) forEachSegment(sealedOnly bool, fn func(*segment) error) error {
+	segments := l.segments
+	if sealedOnly {
+		segments = segments[:len(segments)-1]
+	}
+	for _, s := range segments {
+		if err := fn(s); err != nil {
+			if err == errStopSegments {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the base offset of the oldest segment
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	return l.segments[0].baseOffset, nil
 }
 
+// returns the offset of the newest record, or 0 if the log is empty, whatever offset it starts
+// at. That's the same as for a log whose only record is at 0, so use Empty to tell them apart
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	off := l.segments[len(l.segments)-1].nextOffset
-	if off == 0 {
+	active := l.segments[len(l.segments)-1]
+	if len(l.segments) == 1 && active.nextOffset == active.baseOffset {
+		// no records, whatever offset the log starts at
 		return 0, nil
 	}
-	return off - 1, nil
+	return active.nextOffset - 1, nil
 }
 
+// reports whether the log holds no records, e.g. it's new or every record has been truncated
+func (l *Log) Empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.nextOffset > s.baseOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// removes the sealed segments that hold no records, e.g. left behind by a crash, and returns
+// how many it removed. The active segment is never removed, even if it's empty
+func (l *Log) Prune() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return 0, ErrReadOnly
+	}
+	defer l.reportSize()
+	defer l.cache.reset()
+	var pruned int
+	segments := l.segments[:0]
+	for i, s := range l.segments {
+		if i == len(l.segments)-1 || s.nextOffset > s.baseOffset {
+			segments = append(segments, s)
+			continue
+		}
+		if err := s.Remove(); err != nil {
+			// keep the segments from the one that failed on
+			l.segments = append(segments, l.segments[i:]...)
+			return pruned, err
+		}
+		pruned++
+	}
+	l.segments = segments
+	return pruned, nil
+}
+
+// removes every segment whose records are all below lowest
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	return l.truncate(lowest)
+}
+
+func (l *Log) truncate(lowest uint64) error {
+	nextOffset := l.activeSegment.nextOffset
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		// an empty active segment already starts where a fresh one would
+		empty := s == l.activeSegment && s.nextOffset == s.baseOffset
+		if s.nextOffset <= lowest && !empty {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -177,26 +1142,116 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.cache.reset()
+	if l.segments != nil {
+		l.records.evictBelow(l.segments[0].baseOffset)
+	} else {
+		l.records.reset()
+	}
+	defer l.reportSize()
+	if l.segments == nil {
+		// everything was truncated, so start a fresh segment where the old one ended. The old
+		// one's been removed, so it mustn't be sealed and tracked like one being rolled over
+		l.activeSegment = nil
+		if err := l.newSegment(nextOffset); err != nil {
+			return err
+		}
+	}
+	// forget keys whose newest record was removed
+	for key, off := range l.keys {
+		if off < l.segments[0].baseOffset {
+			delete(l.keys, key)
+		}
+	}
 	return nil
 }
 
+// reports the segment count and total store size to the metrics, the caller must hold the lock
+func (l *Log) reportSize() {
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.Size()
+	}
+	m := l.Config.metrics()
+	m.SetSegments(len(l.segments))
+	m.SetStoreBytes(total)
+}
+
+// removes the oldest sealed segments past the configured retention limits,
+// run on rollover while holding the write lock. The active segment is never removed
+func (l *Log) enforceRetention() error {
+	maxBytes, maxAge := l.Config.Retention.MaxBytes, l.Config.Retention.MaxAge
+	if maxBytes == 0 && maxAge == 0 {
+		return nil
+	}
+	var total uint64
+	_ = l.forEachSegment(false, func(s *segment) error {
+		total += s.store.Size()
+		return nil
+	})
+	var lowest uint64
+	if err := l.forEachSegment(true, func(s *segment) error {
+		expired := false
+		if maxBytes > 0 && total > maxBytes {
+			expired = true
+		} else if maxAge > 0 && s.nextOffset > s.baseOffset {
+			newest, err := s.peek(s.nextOffset - 1)
+			if err != nil {
+				return err
+			}
+			expired = l.Config.clock().Now().Sub(time.Unix(0, newest.Timestamp)) > maxAge
+		}
+		if !expired {
+			// segments are ordered oldest first, so the rest are kept too
+			return errStopSegments
+		}
+		lowest = s.nextOffset
+		total -= s.store.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if lowest == 0 {
+		return nil
+	}
+	return l.truncate(lowest)
+}
+
+// returns a reader over the raw framed bytes of every segment's store, oldest first,
+// as they were when it was called: records appended later aren't read, so it's a snapshot
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{segment, 0, int64(segment.store.Size())}
 	}
 	return io.MultiReader(readers...)
 }
 
+// originReader reads a segment's store from the start up to size, flushing buffered appends
+// as it goes
 type originReader struct {
-	*store
-	off int64
+	segment *segment
+	off     int64
+	size    int64
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > o.size-o.off {
+		p = p[:o.size-o.off]
+	}
+	if err := o.segment.handles.acquire(o.segment); err != nil {
+		return 0, err
+	}
+	defer o.segment.handles.release(o.segment)
+	n, err := o.segment.store.ReadAt(p, o.off)
 	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
 	return n, err
 }
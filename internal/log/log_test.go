@@ -1,12 +1,33 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	api "github.com/magus-1/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -16,23 +37,66 @@ func TestLog(t *testing.T) {
 	){
 		"append and read a record succeeds": testAppendRead,
 		"offset out of range error":         testOutOfRangeErr,
+		"append across segment rollovers":   testRollover,
+		"append a batch across segments":    testAppendBatch,
 		"init with existing segments":       testInitExisting,
+		"offsets of an empty log":           testEmptyOffsets,
+		"offsets across segments":           testOffsetsAcrossSegments,
 		"reader":                            testReader,
+		"position of a record":              testPosition,
+		"reader across segments":            testReaderAcrossSegments,
+		"read since a time":                 testReadSince,
 		"truncate":                          testTruncate,
+		"truncate below lowest offset":      testTruncateBelowLowest,
+		"truncate everything":               testTruncateAll,
+		"export as json":                    testExportJSON,
+		"import from json":                  testImportJSON,
+		"import stops at a malformed line":  testImportMalformedJSON,
+		"export and import typed payloads":  testExportPayload,
+		"append and read with a context":    testContext,
 	} {
-		t.Run(scenario, func(t *testing.T) {
-			dir, err := ioutil.TempDir("", "store-test")
-			require.NoError(t, err)
-			defer os.RemoveAll(dir)
-			c := Config{}
-			c.Segment.MaxStoreBytes = 32
-			log, err := NewLog(dir, c)
-			require.NoError(t, err)
-			fn(t, log)
-		})
+		// every scenario passes with reads going through the segment cache too
+		for name, cacheSize := range map[string]int{"": 0, " with a segment cache": 2} {
+			cacheSize := cacheSize
+			t.Run(scenario+name, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "store-test")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+				c := Config{Clock: &fakeClock{now: time.Now()}}
+				c.Segment.MaxStoreBytes = 32
+				c.Segment.CacheSize = cacheSize
+				log, err := NewLog(dir, c)
+				require.NoError(t, err)
+				fn(t, log)
+			})
+		}
 	}
 }
 
+// fakeClock is a Clock tests set and advance by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -45,6 +109,53 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testRollover(t *testing.T, log *Log) {
+	// each segment fits two records, so six records roll over twice
+	for i := uint64(0); i < 6; i++ {
+		off, err := log.Append(&api.Record{
+			Value: []byte("hello world"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.GreaterOrEqual(t, len(log.segments), 3)
+	// every segment but the active one was sealed as the log rolled over
+	for _, s := range log.segments {
+		require.Equal(t, s != log.activeSegment, s.store.(*store).sealed.Load())
+	}
+	for i := uint64(0); i < 6; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	_, err := log.Read(6)
+	require.Error(t, err)
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	var records []*api.Record
+	for i := 0; i < 7; i++ {
+		records = append(records, &api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+	}
+	offsets, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6}, offsets)
+	require.Greater(t, len(log.segments), 2)
+	for i, off := range offsets {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, read.Value)
+	}
+
+	// batches continue from where the previous append left off
+	offsets, err = log.AppendBatch(records[:1])
+	require.NoError(t, err)
+	require.Equal(t, []uint64{7}, offsets)
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -76,6 +187,97 @@ func testInitExisting(t *testing.T, o *Log) {
 	require.Equal(t, uint64(2), off)
 }
 
+func testEmptyOffsets(t *testing.T, log *Log) {
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.True(t, log.Empty())
+
+	// which is also the highest offset of a log holding one record, but that isn't empty
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.False(t, log.Empty())
+	// until it's truncated away
+	require.NoError(t, log.Truncate(1))
+	require.True(t, log.Empty())
+
+	// an empty log that starts past 0 has no highest offset either
+	dir, err := ioutil.TempDir("", "empty-offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.InitialOffset = 5
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err = n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.True(t, n.Empty())
+}
+
+func testOffsetsAcrossSegments(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func testReadSince(t *testing.T, log *Log) {
+	// append a record per second across several segments
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := log.Config.Clock.(*fakeClock)
+	clock.Set(start)
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		clock.Advance(time.Second)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, start.Add(3*time.Second).UnixNano(), read.Timestamp)
+
+	for _, tc := range []struct {
+		since time.Time
+		want  uint64
+	}{
+		{since: start.Add(-time.Hour), want: 0},
+		{since: start, want: 0},
+		{since: start.Add(2 * time.Second), want: 2},
+		{since: start.Add(2500 * time.Millisecond), want: 3},
+		{since: start.Add(6 * time.Second), want: 6},
+	} {
+		off, err := log.ReadSince(tc.since)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, off)
+	}
+
+	// nothing was appended after the last record
+	_, err = log.ReadSince(start.Add(time.Minute))
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 7}, err)
+}
+
 func testReader(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -87,11 +289,57 @@ func testReader(t *testing.T, log *Log) {
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth+codecWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testReaderAcrossSegments(t *testing.T, log *Log) {
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+	var size uint64
+	for _, s := range log.segments {
+		size += s.store.Size()
+	}
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, size, uint64(len(b)))
+}
+
+func testPosition(t *testing.T, log *Log) {
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(0); off < 4; off++ {
+		base, pos, err := log.Position(off)
+		require.NoError(t, err)
+		s := log.segments[sort.Search(len(log.segments), func(i int) bool {
+			return log.segments[i].baseOffset > off
+		})-1]
+		require.Equal(t, s.baseOffset, base)
+
+		// the frame at that position in the store holds the record
+		header := make([]byte, lenWidth+crcWidth+codecWidth)
+		_, err = s.store.ReadAt(header, int64(pos))
+		require.NoError(t, err)
+		b := make([]byte, enc.Uint64(header[:lenWidth]))
+		_, err = s.store.ReadAt(b, int64(pos)+int64(len(header)))
+		require.NoError(t, err)
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b, read))
+		require.Equal(t, off, read.Offset)
+	}
+
+	// truncated offsets aren't found
+	require.NoError(t, log.Truncate(2))
+	_, _, err := log.Position(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -100,8 +348,2913 @@ func testTruncate(t *testing.T, log *Log) {
 		_, err := log.Append(append)
 		require.NoError(t, err)
 	}
-	err := log.Truncate(1)
+	removed := log.segments[0]
+	err := log.Truncate(2)
 	require.NoError(t, err)
 	_, err = log.Read(0)
 	require.Error(t, err)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+	_, err = os.Stat(removed.store.Name())
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(removed.index.Name())
+	require.True(t, os.IsNotExist(err))
+}
+
+func testTruncateBelowLowest(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	segments := len(log.segments)
+	require.NoError(t, log.Truncate(0))
+	require.Equal(t, segments, len(log.segments))
+	_, err := log.Read(0)
+	require.NoError(t, err)
+}
+
+func testTruncateAll(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(10))
+	_, err := log.Read(2)
+	require.Error(t, err)
+	files, err := ioutil.ReadDir(log.Dir)
+	require.NoError(t, err)
+	// only the fresh segment's store and index remain, and the lock file
+	require.Equal(t, 3, len(files))
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func testExportJSON(t *testing.T, log *Log) {
+	// an empty log exports nothing
+	var buf bytes.Buffer
+	require.NoError(t, log.ExportJSON(&buf, 0, 10))
+	require.Equal(t, 0, buf.Len())
+
+	values := [][]byte{[]byte("hello"), {0x00, 0xff, '\n'}, []byte("world")}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: v})
+		require.NoError(t, err)
+	}
+
+	// to is clamped to the highest offset
+	require.NoError(t, log.ExportJSON(&buf, 1, 100))
+	scanner := bufio.NewScanner(&buf)
+	off := uint64(1)
+	for scanner.Scan() {
+		var got struct {
+			Offset    uint64 `json:"offset"`
+			Timestamp int64  `json:"timestamp"`
+			Value     string `json:"value"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &got))
+		require.Equal(t, off, got.Offset)
+		require.NotZero(t, got.Timestamp)
+		require.Equal(t, base64.StdEncoding.EncodeToString(values[off]), got.Value)
+		off++
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, uint64(3), off)
+
+	require.Error(t, log.ExportJSON(&buf, 2, 1))
+}
+
+func testImportJSON(t *testing.T, log *Log) {
+	values := [][]byte{[]byte("hello"), {0x00, 0xff, '\n'}, []byte("world")}
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: v})
+		require.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, log.ExportJSON(&buf, 0, 2))
+
+	// importing onto the same log appends copies after the originals
+	n, err := log.ImportJSON(&buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n)
+	for i, v := range values {
+		read, err := log.Read(uint64(3 + i))
+		require.NoError(t, err)
+		require.Equal(t, v, read.Value)
+	}
+}
+
+func testExportPayload(t *testing.T, log *Log) {
+	want := &api.ConsumeRequest{Offset: 42}
+	record, err := api.PackRecord(want)
+	require.NoError(t, err)
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, log.ExportJSON(&buf, 0, 0))
+	_, err = log.ImportJSON(&buf)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 2; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		got := &api.ConsumeRequest{}
+		require.NoError(t, api.UnpackRecord(read, got))
+		require.True(t, proto.Equal(want, got))
+	}
+}
+
+func testImportMalformedJSON(t *testing.T, log *Log) {
+	input := `{"offset":7,"value":"aGVsbG8="}
+
+{"offset":8,"value":"d29ybGQ="}
+{"offset":9,"value":
+{"offset":10,"value":"aGVsbG8="}
+`
+	n, err := log.ImportJSON(strings.NewReader(input))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 4")
+	require.Equal(t, uint64(2), n)
+
+	// the offsets in the input are ignored
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), read.Value)
+	_, err = log.Read(2)
+	require.Error(t, err)
+
+	for _, line := range []string{
+		`{"value":"aGVsbG8=","extra":true}`,
+		`{"value":"not base64"}`,
+		`{"value":"aGVsbG8="} {}`,
+	} {
+		_, err = log.ImportJSON(strings.NewReader(line))
+		require.Error(t, err, line)
+	}
+}
+
+func testContext(t *testing.T, log *Log) {
+	record := &api.Record{Value: []byte("hello world")}
+	off, err := log.AppendContext(context.Background(), record)
+	require.NoError(t, err)
+	read, err := log.ReadContext(context.Background(), off)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+
+	// an already cancelled context doesn't touch the log
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = log.AppendContext(ctx, record)
+	require.Equal(t, context.Canceled, err)
+	_, err = log.ReadContext(ctx, off)
+	require.Equal(t, context.Canceled, err)
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	// a slow append holds the lock past the deadline
+	log.mu.Lock()
+	release := time.AfterFunc(100*time.Millisecond, log.mu.Unlock)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = log.AppendContext(ctx, record)
+	require.Equal(t, context.DeadlineExceeded, err)
+	_, err = log.ReadContext(ctx, off)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// once the lock is released appends go through again
+	off, err = log.AppendContext(context.Background(), record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.False(t, release.Stop())
+}
+
+func TestRetention(t *testing.T) {
+	t.Run("max bytes", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "retention-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		c.Retention.MaxBytes = 256
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		for i := 0; i < 50; i++ {
+			_, err := log.Append(&api.Record{Value: make([]byte, 40)})
+			require.NoError(t, err)
+		}
+		var total uint64
+		for _, s := range log.segments {
+			total += s.store.Size()
+		}
+		require.LessOrEqual(t, total, c.Retention.MaxBytes)
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Greater(t, lowest, uint64(0))
+		_, err = log.Read(0)
+		require.Error(t, err)
+		_, err = log.Read(49)
+		require.NoError(t, err)
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "retention-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		clock := &fakeClock{now: time.Now()}
+		c := Config{Clock: clock}
+		c.Segment.MaxStoreBytes = 32
+		c.Retention.MaxAge = 24 * time.Hour
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+
+		// two days old, then recent
+		for i := 0; i < 3; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		clock.Advance(48 * time.Hour)
+		for i := 0; i < 3; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), lowest)
+		for off := uint64(3); off < 6; off++ {
+			_, err = log.Read(off)
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Keys.Index = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// three records per key, spread over several segments
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			_, err = log.Append(&api.Record{
+				Key:   []byte(key),
+				Value: []byte(fmt.Sprintf("%s%d", key, i)),
+			})
+			require.NoError(t, err)
+		}
+	}
+	_, err = log.AppendBatch([]*api.Record{
+		{Key: []byte("c"), Value: []byte("c0")},
+		{Key: []byte("b"), Value: []byte("b3")},
+		{Value: []byte("unkeyed")},
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(log.segments), 2)
+
+	latest := func(l *Log, key string) string {
+		read, err := l.ReadLatestByKey([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, key, string(read.Key))
+		return string(read.Value)
+	}
+	require.Equal(t, "a2", latest(log, "a"))
+	require.Equal(t, "b3", latest(log, "b"))
+	require.Equal(t, "c0", latest(log, "c"))
+	_, err = log.ReadLatestByKey([]byte("d"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// reopening rebuilds the index from the segments
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, "a2", latest(log, "a"))
+	require.Equal(t, "b3", latest(log, "b"))
+
+	// truncating past a key's newest record forgets it
+	require.NoError(t, log.Truncate(6))
+	_, err = log.ReadLatestByKey([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, "b3", latest(log, "b"))
+	require.NoError(t, log.Close())
+
+	// the index is opt-in
+	c.Keys.Index = false
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.ReadLatestByKey([]byte("b"))
+	require.Error(t, err)
+	require.NotEqual(t, ErrKeyNotFound, err)
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Keys.Index = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// a and b are rewritten over several segments and c written once
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"a", "b"} {
+			_, err = log.Append(&api.Record{
+				Key:   []byte(key),
+				Value: []byte(fmt.Sprintf("%s%d", key, i)),
+			})
+			require.NoError(t, err)
+		}
+	}
+	_, err = log.Append(&api.Record{Key: []byte("c"), Value: []byte("c0")})
+	require.NoError(t, err)
+	// fill the active segment with unkeyed records so the last a starts a new one
+	want := []string{"b3", "c0"}
+	for len(want) == 2 || log.activeSegment.nextOffset > log.activeSegment.baseOffset {
+		_, err = log.Append(&api.Record{Value: []byte("unkeyed")})
+		require.NoError(t, err)
+		want = append(want, "unkeyed")
+	}
+	_, err = log.Append(&api.Record{Key: []byte("a"), Value: []byte("a4")})
+	require.NoError(t, err)
+	require.Greater(t, len(log.segments), 3)
+	active := log.activeSegment
+	before := log.segments[0].baseOffset
+	activeRead, err := log.Read(active.baseOffset)
+	require.NoError(t, err)
+
+	require.NoError(t, log.Compact())
+	require.Equal(t, active, log.activeSegment)
+	_, err = os.Stat(path.Join(dir, compactDir))
+	require.True(t, os.IsNotExist(err))
+
+	// the sealed segments now hold one record per key, in append order
+	var values []string
+	for _, s := range log.segments[:len(log.segments)-1] {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+			require.NotZero(t, read.Timestamp)
+			values = append(values, string(read.Value))
+		}
+	}
+	require.Equal(t, want, values)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, before, off)
+
+	// the active segment and key lookups are unaffected
+	read, err := log.Read(active.baseOffset)
+	require.NoError(t, err)
+	require.Equal(t, activeRead.Value, read.Value)
+	for key, want := range map[string]string{"a": "a4", "b": "b3", "c": "c0"} {
+		read, err := log.ReadLatestByKey([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, want, string(read.Value))
+	}
+
+	// appends continue after the active segment, and the compacted log reopens
+	off, err = log.Append(&api.Record{Key: []byte("b"), Value: []byte("b4")})
+	require.NoError(t, err)
+	require.Equal(t, active.nextOffset-1, off)
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	read, err = log.ReadLatestByKey([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, "b4", string(read.Value))
+	read, err = log.Read(before)
+	require.NoError(t, err)
+	require.Equal(t, "b3", string(read.Value))
+	require.NoError(t, log.Close())
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-interrupted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Key: []byte("a"), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// a compaction that crashed before its done marker is discarded on setup
+	tmp := path.Join(dir, compactDir)
+	require.NoError(t, os.Mkdir(tmp, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(tmp, "0.store"), []byte("partial"), 0644))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+	for off := uint64(0); off < 3; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+	active := log.activeSegment.baseOffset
+	require.Equal(t, uint64(3), active)
+	require.NoError(t, log.Close())
+
+	// one that crashed after it would be finished: write its single compacted segment
+	// in another directory and move it into place with the done marker
+	other, err := ioutil.TempDir("", "compact-interrupted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+	compacted, err := NewLog(other, c)
+	require.NoError(t, err)
+	_, err = compacted.Append(&api.Record{Key: []byte("a"), Value: []byte("compacted")})
+	require.NoError(t, err)
+	require.NoError(t, compacted.Close())
+	require.NoError(t, os.Mkdir(tmp, 0755))
+	for _, name := range []string{"0.store", "0.index"} {
+		require.NoError(t, os.Rename(path.Join(other, name), path.Join(tmp, name)))
+	}
+	require.NoError(t, ioutil.WriteFile(path.Join(tmp, compactDone), []byte("3\n0"), 0644))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "compacted", string(read.Value))
+	_, err = log.Read(1)
+	require.Error(t, err)
+	require.Equal(t, active, log.activeSegment.baseOffset)
+	_, err = os.Stat(path.Join(dir, "1.store"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	bad, err := log.Verify()
+	require.NoError(t, err)
+	require.Empty(t, bad)
+
+	// flip a payload byte of two records in different segments
+	for _, off := range []uint64{1, 3} {
+		base, pos, err := log.Position(off)
+		require.NoError(t, err)
+		f, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d.store", base)), os.O_RDWR, 0)
+		require.NoError(t, err)
+		b := make([]byte, 1)
+		at := int64(pos + lenWidth + crcWidth + codecWidth)
+		_, err = f.ReadAt(b, at)
+		require.NoError(t, err)
+		b[0] ^= 0xff
+		_, err = f.WriteAt(b, at)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	bad, err = log.Verify()
+	require.NoError(t, err)
+	require.Len(t, bad, 2)
+	for i, off := range []uint64{1, 3} {
+		require.Equal(t, off, bad[i].Offset)
+		base, pos, err := log.Position(off)
+		require.NoError(t, err)
+		require.Equal(t, base, bad[i].Segment)
+		require.Equal(t, pos, bad[i].Pos)
+		require.ErrorIs(t, bad[i], ErrCorruptRecord)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	_, err = OpenReadOnly(dir, c)
+	require.Error(t, err)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	ro, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, ro.Ready())
+	require.Equal(t, ErrReadOnly, ro.Writable())
+	for off := uint64(0); off < 3; off++ {
+		read, err := ro.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	_, err = ro.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	_, err = ro.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.Truncate(2))
+	require.Equal(t, ErrReadOnly, ro.Compact())
+	require.Equal(t, ErrReadOnly, ro.Remove())
+	require.NoError(t, ro.Close())
+
+	// nothing on disk changed
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// a read-only log can share the directory with the writer, seeing the records
+	// it had written to its files
+	_, err = log.Read(2)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("flushed")})
+	require.NoError(t, err)
+	_, err = log.Read(3)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("buffered")})
+	require.NoError(t, err)
+	ro, err = OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	off, err = ro.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := ro.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("flushed"), read.Value)
+	require.NoError(t, ro.Close())
+	require.NoError(t, log.Close())
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// two records fill a segment, so the third is alone in the active segment's buffer
+	ro, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	_, err = ro.Read(2)
+	require.Error(t, err)
+	require.NoError(t, ro.Close())
+
+	// once synced, opening the files afresh finds every record
+	require.NoError(t, log.Sync())
+	ro, err = OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		read, err := ro.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	require.Equal(t, ErrReadOnly, ro.Sync())
+	require.NoError(t, ro.Close())
+}
+
+func TestReset(t *testing.T) {
+	fresh, err := ioutil.TempDir("", "reset-fresh-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(fresh)
+	dir, err := ioutil.TempDir("", "reset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Keys.Index = true
+	freshLog, err := NewLog(fresh, c)
+	require.NoError(t, err)
+	require.NoError(t, freshLog.Close())
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Key: []byte("k"), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var export bytes.Buffer
+	require.NoError(t, log.ExportJSON(&export, 0, 2))
+	require.NoError(t, log.Reset())
+
+	// the log is empty, its directory just like a new log's
+	require.NoError(t, log.Ready())
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	_, err = log.Read(0)
+	require.Error(t, err)
+	_, err = log.ReadLatestByKey([]byte("k"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, dirNames(t, fresh), dirNames(t, dir))
+
+	// and it can be repopulated
+	n, err := log.ImportJSON(&export)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n)
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+	read, err := log.ReadLatestByKey([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), read.Offset)
+}
+
+// dirNames lists the names of the files in dir, other than a log's lock file
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		if f.Name() == lockName {
+			continue
+		}
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestTier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	coldDir, err := ioutil.TempDir("", "tier-cold-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(coldDir)
+	clock := &fakeClock{now: time.Now()}
+	c := Config{Clock: clock}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.ColdDir = coldDir
+	c.Tier.ColdAge = 24 * time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// two days old, then recent: each record rolls over to a new segment
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	clock.Advance(48 * time.Hour)
+	for i := 2; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"0.index", "0.store", "1.index", "1.store"}, dirNames(t, coldDir))
+	require.NotContains(t, dirNames(t, dir), "0.store")
+	require.Contains(t, dirNames(t, dir), "2.store")
+
+	// reads find the records in either directory, before and after reopening
+	readAll := func() {
+		for off := uint64(0); off < 4; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+		}
+	}
+	readAll()
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	readAll()
+	require.NoError(t, log.Close())
+
+	// a move a crash interrupted is undone: a partial copy and a copy whose original is
+	// still in the log's directory are thrown away
+	require.NoError(t, ioutil.WriteFile(path.Join(coldDir, "2.store"+tmpExt), []byte("partial"), 0644))
+	for _, name := range []string{"3.store", "3.index"} {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(coldDir, name), b, 0644))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	readAll()
+	require.Equal(t, []string{"0.index", "0.store", "1.index", "1.store"}, dirNames(t, coldDir))
+	require.NoError(t, log.Remove())
+	_, err = os.Stat(coldDir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	fi, err := os.Stat(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	valid := fi.Size()
+
+	// a crash mid-append left the header of a frame with only part of its payload
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	partial := make([]byte, lenWidth+crcWidth+codecWidth+5)
+	enc.PutUint64(partial, 100)
+	_, err = f.Write(partial)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(valid), log.activeSegment.store.Size())
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	off, err = log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), read.Value)
+
+	// a crash without closing leaves the index padded with zeros, and an entry
+	// for a record that was still in the store's buffer
+	_, err = log.Append(&api.Record{Value: []byte("lost")})
+	require.NoError(t, err)
+	// the crashed process's lock goes with it
+	require.NoError(t, log.unlock())
+	crashed, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	off, err = crashed.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = crashed.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for off, want := range []string{"hello world", "after", "again"} {
+		read, err := crashed.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(read.Value))
+	}
+	require.NoError(t, crashed.Close())
+	fi, err = os.Stat(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	valid = fi.Size()
+
+	// whole frames the index lost track of are indexed again rather than truncated away,
+	// whether it's lost its last entry or the whole file
+	index := path.Join(dir, "0.index")
+	fi, err = os.Stat(index)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(index, fi.Size()-int64(entWidth)))
+	for i := 0; i < 2; i++ {
+		log, err = NewLog(dir, Config{})
+		require.NoError(t, err)
+		require.Equal(t, uint64(valid), log.activeSegment.store.Size())
+		off, err = log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+		for off, want := range []string{"hello world", "after", "again"} {
+			read, err := log.Read(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, want, string(read.Value))
+		}
+		require.NoError(t, log.Close())
+		require.NoError(t, os.Remove(index))
+	}
+}
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ready-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// not ready until the directory has been scanned
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	log := &Log{Dir: dir, Config: c}
+	require.Error(t, log.Ready())
+	require.NoError(t, log.Writable())
+	require.NoError(t, log.setup())
+	require.NoError(t, log.Ready())
+	// checking leaves nothing behind
+	names := dirNames(t, dir)
+	require.NoError(t, log.Writable())
+	require.Equal(t, names, dirNames(t, dir))
+
+	// a missing directory can't be written to
+	moved := dir + "-moved"
+	require.NoError(t, os.Rename(dir, moved))
+	require.Error(t, log.Ready())
+	require.Error(t, log.Writable())
+	require.NoError(t, os.Rename(moved, dir))
+	require.NoError(t, log.Ready())
+
+	require.NoError(t, log.Close())
+	require.Error(t, log.Ready())
+	require.Error(t, log.Writable())
+}
+
+func benchmarkLog(b *testing.B) *Log {
+	b.Helper()
+	dir, err := ioutil.TempDir("", "log-bench")
+	require.NoError(b, err)
+	b.Cleanup(func() { os.RemoveAll(dir) })
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	return log
+}
+
+func BenchmarkAppend(b *testing.B) {
+	log := benchmarkLog(b)
+	records := make([]*api.Record, 100)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte("hello world")}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, record := range records {
+			if _, err := log.Append(record); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	log := benchmarkLog(b)
+	records := make([]*api.Record, 100)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte("hello world")}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := log.AppendBatch(records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSegmentForHot(b *testing.B) {
+	for name, cacheSize := range map[string]int{"search": 0, "cached": 4} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			// one record per segment
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1
+			c.Segment.CacheSize = cacheSize
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			for i := 0; i < 5000; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(b, err)
+			}
+			// reads keep to a few segments in the middle of the log
+			hot := []uint64{2500, 2501, 2502, 2503}
+			// time finding the segment, which is all the cache saves. Nothing's appending,
+			// so the lock isn't needed
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := log.segmentFor(hot[n%len(hot)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// leave closing and removing the segments out of the timing
+			b.StopTimer()
+		})
+	}
+}
+
+func BenchmarkReadHot(b *testing.B) {
+	for name, cacheSize := range map[string]int{"uncached": 0, "cached": 16} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			c := Config{ReadCacheSize: cacheSize}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = 1 << 20
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			value := bytes.Repeat([]byte("hello world "), 20)
+			for i := 0; i < 5000; i++ {
+				_, err := log.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+			// a few config-like records read over and over
+			hot := []uint64{10, 1000, 2500, 4000}
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := log.Read(hot[n%len(hot)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	recorder := tracetest.NewSpanRecorder()
+	c := Config{TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 16
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// two records fill a segment, so the third starts a new one
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	require.Equal(t, "Log.Append", spans[2].Name())
+	require.ElementsMatch(t, []attribute.KeyValue{
+		attribute.Int64("proglog.offset", 18),
+		attribute.Int("proglog.record_bytes", len("hello world")),
+		attribute.Int64("proglog.segment_base", 18),
+	}, spans[2].Attributes())
+
+	// appends and reads are children of the span in their context
+	ctx, parent := c.TracerProvider.Tracer("test").Start(context.Background(), "parent")
+	_, err = log.ReadContext(ctx, 16)
+	require.NoError(t, err)
+	_, err = log.ReadContext(ctx, 19)
+	require.Error(t, err)
+	parent.End()
+	spans = recorder.Ended()[3:]
+	require.Len(t, spans, 3)
+	require.Equal(t, "Log.Read", spans[0].Name())
+	require.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	require.Contains(t, spans[0].Attributes(), attribute.Int64("proglog.segment_base", 16))
+	require.Equal(t, codes.Error, spans[1].Status().Code)
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 8
+	require.NoError(t, os.Mkdir(path.Join(dir, "src"), 0755))
+	require.NoError(t, os.Mkdir(path.Join(dir, "dst"), 0755))
+	src, err := NewLog(path.Join(dir, "src"), c)
+	require.NoError(t, err)
+	defer src.Close()
+	// two records fill a segment, so five span three segments
+	for i := 0; i < 5; i++ {
+		_, err = src.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var snapshot bytes.Buffer
+	require.NoError(t, src.Snapshot(&snapshot))
+
+	dst, err := NewLog(path.Join(dir, "dst"), Config{})
+	require.NoError(t, err)
+	defer dst.Close()
+	_, err = dst.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+
+	// a truncated or tampered snapshot leaves the log as it was
+	err = dst.RestoreSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()/2]))
+	require.Error(t, err)
+	tampered := bytes.Replace(snapshot.Bytes(), []byte(`"next_offset":10`), []byte(`"next_offset":11`), 1)
+	require.NotEqual(t, snapshot.Bytes(), tampered)
+	err = dst.RestoreSnapshot(bytes.NewReader(tampered))
+	require.Error(t, err)
+	read, err := dst.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replaced"), read.Value)
+
+	// the restored log has the snapshot's segments, records and offsets
+	require.NoError(t, dst.RestoreSnapshot(bytes.NewReader(snapshot.Bytes())))
+	require.Equal(t, []string{"10.index", "10.store", "12.index", "12.store", "8.index", "8.store"},
+		dirNames(t, dst.Dir))
+	lowest, err := dst.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), lowest)
+	highest, err := dst.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), highest)
+	for i := 0; i < 5; i++ {
+		want, err := src.Read(uint64(8 + i))
+		require.NoError(t, err)
+		got, err := dst.Read(uint64(8 + i))
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+	off, err := dst.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), off)
+}
+
+func TestPermissions(t *testing.T) {
+	parent, err := ioutil.TempDir("", "permissions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+	// the modes are kept even where the umask would clear their group bits
+	defer syscall.Umask(syscall.Umask(0077))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Permissions.File = 0660
+	c.Permissions.Dir = 0750
+	dir := path.Join(parent, "log")
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// two records fill a segment, so the third is in a new one
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+	names := dirNames(t, dir)
+	require.Len(t, names, 4)
+	for _, name := range append(names, lockName) {
+		fi, err = os.Stat(path.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0660), fi.Mode().Perm(), name)
+	}
+}
+
+func TestAppendAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append-at-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// the record keeps its offset and timestamp, across a rollover too
+	for off := uint64(4); off < 7; off++ {
+		require.NoError(t, log.AppendAt(&api.Record{
+			Value:     []byte("hello world"),
+			Offset:    off,
+			Timestamp: int64(off),
+		}))
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, int64(off), read.Timestamp)
+	}
+
+	// applying an entry again, or one from the future, changes nothing
+	err = log.AppendAt(&api.Record{Value: []byte("duplicate"), Offset: 6})
+	require.True(t, errors.Is(err, ErrOffsetMismatch))
+	err = log.AppendAt(&api.Record{Value: []byte("out of order"), Offset: 8})
+	require.True(t, errors.Is(err, ErrOffsetMismatch))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+	read, err := log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// Append carries on from the replicated records
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// an empty log has no records to tail
+	records, err := log.Tail(10)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// two records fill a segment, so five span three segments
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	offsets := func(records []*api.Record) []uint64 {
+		var offs []uint64
+		for _, record := range records {
+			offs = append(offs, record.Offset)
+		}
+		return offs
+	}
+
+	// the newest record is alone in its segment, so three span two
+	records, err = log.Tail(3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5, 6}, offsets(records))
+	require.Equal(t, []byte("record 2"), records[0].Value)
+
+	// asking for more than the log holds returns everything
+	records, err = log.Tail(100)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3, 4, 5, 6}, offsets(records))
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// two records fill a segment, so five span three segments
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	st := log.Stats()
+	require.Equal(t, uint64(5), st.Records)
+	require.Len(t, st.Segments, 3)
+	var storeBytes uint64
+	for i, want := range []uint64{2, 2, 1} {
+		s := st.Segments[i]
+		require.Equal(t, uint64(2*i), s.BaseOffset)
+		require.Equal(t, uint64(2*i)+want, s.NextOffset)
+		require.Equal(t, want, s.Index.Entries)
+		require.Equal(t, want*entWidth, s.Index.Size)
+		storeBytes += s.Store.Size
+	}
+	require.Equal(t, storeBytes, st.StoreBytes)
+	// sealing flushed the full segments, only the newest record is buffered
+	require.Zero(t, st.Segments[0].Store.Buffered)
+	require.Equal(t, st.Segments[2].Store.Size, st.BufferedBytes)
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// two records fill a segment, so five span three segments
+	for i := 1; i <= 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(strconv.Itoa(i))})
+		require.NoError(t, err)
+	}
+	sum := func(from uint64) int {
+		var total int
+		require.NoError(t, log.Replay(from, func(record *api.Record) error {
+			v, err := strconv.Atoi(string(record.Value))
+			total += v
+			return err
+		}))
+		return total
+	}
+	require.Equal(t, 15, sum(0))
+	require.Equal(t, 9, sum(3))
+	require.Equal(t, 0, sum(5))
+
+	// an error from fn stops the replay at its record
+	stop := fmt.Errorf("stop")
+	var seen []uint64
+	err = log.Replay(1, func(record *api.Record) error {
+		seen = append(seen, record.Offset)
+		if record.Offset == 3 {
+			return stop
+		}
+		return nil
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, []uint64{1, 2, 3}, seen)
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 5
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// two records fill a segment, so four leave an empty active segment after two full ones
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// an empty segment ahead of the others, as a crash might leave
+	for _, name := range []string{"3.store", "3.index"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	pruned, err := log.Prune()
+	require.NoError(t, err)
+	require.Equal(t, 1, pruned)
+	require.Equal(t, []string{"5.index", "5.store", "7.index", "7.store", "9.index", "9.store"},
+		dirNames(t, dir))
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lowest)
+	for off := uint64(5); off < 9; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// the empty active segment stays
+	pruned, err = log.Prune()
+	require.NoError(t, err)
+	require.Zero(t, pruned)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+}
+
+func TestMaxOpenSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max-open-segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{MaxOpenSegments: 3}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// openFiles counts the segments whose store files the process has open
+	openFiles := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		var n int
+		for _, fd := range fds {
+			target, err := os.Readlink(path.Join("/proc/self/fd", fd.Name()))
+			if err == nil && strings.HasPrefix(target, dir) && path.Ext(target) == ".store" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// two records fill a segment, so twenty span ten sealed segments and an active one
+	for i := 0; i < 20; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(strconv.Itoa(i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, openFiles())
+
+	// concurrent reads across every segment reopen them as they go
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				off := uint64((i*7 + r) % 20)
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, []byte(strconv.Itoa(int(off))), read.Value)
+			}
+		}(r)
+	}
+	wg.Wait()
+	require.Equal(t, 3, openFiles())
+
+	// as do the other ways of reading the segments
+	bad, err := log.Verify()
+	require.NoError(t, err)
+	require.Empty(t, bad)
+	var snapshot bytes.Buffer
+	require.NoError(t, log.Snapshot(&snapshot))
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, log.Stats().StoreBytes, uint64(len(b)))
+	require.NoError(t, log.Sync())
+	require.Equal(t, 3, openFiles())
+
+	// closed segments are dropped without closing their files twice
+	require.NoError(t, log.Truncate(10))
+	require.NoError(t, log.Close())
+	require.Zero(t, openFiles())
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letter-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dlq, err := NewLog(path.Join(dir, "dlq"), Config{})
+	require.NoError(t, err)
+	defer dlq.Close()
+
+	errEmpty := fmt.Errorf("value is empty")
+	c := Config{}
+	c.Validator = func(record *api.Record) error {
+		if len(record.Value) == 0 {
+			return errEmpty
+		}
+		return nil
+	}
+	c.DeadLetter = dlq
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	off, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// a rejected record goes to the dead-letter log, not the log
+	rejected := &api.Record{Value: []byte{}, Key: []byte("k")}
+	_, err = log.Append(rejected)
+	require.True(t, errors.Is(err, ErrInvalidRecord))
+	require.True(t, errors.Is(err, errEmpty))
+	require.True(t, errors.Is(err, ErrDeadLettered))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	dead, err := dlq.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("k"), dead.Key)
+
+	// a batch stops at its first rejected record
+	offs, err := log.AppendBatch([]*api.Record{
+		{Value: []byte("second")},
+		{Value: nil},
+		{Value: []byte("third")},
+	})
+	require.True(t, errors.Is(err, ErrInvalidRecord))
+	require.Equal(t, []uint64{1}, offs)
+	_, err = dlq.Read(1)
+	require.NoError(t, err)
+	_, err = dlq.Read(2)
+	require.Error(t, err)
+
+	// without a dead-letter log rejected records are only rejected
+	c.DeadLetter = nil
+	strict, err := NewLog(path.Join(dir, "strict"), c)
+	require.NoError(t, err)
+	defer strict.Close()
+	_, err = strict.Append(&api.Record{})
+	require.True(t, errors.Is(err, ErrInvalidRecord))
+	require.False(t, errors.Is(err, ErrDeadLettered))
+}
+
+func TestAppendRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append-raw-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// raw appends take offsets in turn with record appends, across segments
+	raw := [][]byte{[]byte("first"), {}, []byte("third bytes of twenty")}
+	for i, b := range raw {
+		off, err := log.AppendRaw(b)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2*i), off)
+		off, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2*i+1), off)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	check := func() {
+		for i, b := range raw {
+			read, err := log.ReadRaw(uint64(2 * i))
+			require.NoError(t, err)
+			require.Equal(t, b, read)
+
+			// a record reads raw as its marshaled bytes
+			p, err := log.ReadRaw(uint64(2*i + 1))
+			require.NoError(t, err)
+			record := &api.Record{}
+			require.NoError(t, proto.Unmarshal(p, record))
+			require.Equal(t, []byte("hello world"), record.Value)
+			record, err = log.Read(uint64(2*i + 1))
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+		}
+		_, err := log.ReadRaw(uint64(2 * len(raw)))
+		require.Error(t, err)
+	}
+	check()
+
+	// and survive a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check()
+}
+
+func TestSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// two records fill a segment, so five span two sealed segments and an active one
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	infos := log.Segments()
+	require.Len(t, infos, 3)
+	for i, info := range infos {
+		require.Equal(t, uint64(2*i), info.BaseOffset)
+		require.Equal(t, i < 2, info.Sealed)
+		require.Equal(t, log.segments[i].store.Size(), info.StoreBytes)
+	}
+	require.Equal(t, uint64(2), infos[0].NextOffset)
+	require.Equal(t, uint64(2), infos[0].IndexEntries)
+	require.Equal(t, uint64(5), infos[2].NextOffset)
+	require.Equal(t, uint64(1), infos[2].IndexEntries)
+
+	// the descriptors are copies, later appends don't change them
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), infos[2].NextOffset)
+	require.Equal(t, uint64(6), log.Segments()[2].NextOffset)
+}
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// five records span segments, the active one's still buffered
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(strconv.Itoa(i))})
+		require.NoError(t, err)
+	}
+	copied, err := log.Copy(path.Join(dir, "copy"))
+	require.NoError(t, err)
+	defer copied.Close()
+	require.Greater(t, len(log.segments), 1)
+	require.Equal(t, log.Segments(), copied.Segments())
+	for off := uint64(0); off < 5; off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := copied.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+
+	// the two logs go their own ways
+	off, err := log.Append(&api.Record{Value: []byte("original")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	off, err = copied.Append(&api.Record{Value: []byte("copy")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("original"), read.Value)
+	read, err = copied.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("copy"), read.Value)
+
+	// a copy won't overwrite a directory that's in use
+	_, err = log.Copy(path.Join(dir, "copy"))
+	require.Error(t, err)
+}
+
+func TestSegmentNameWidth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-name-width-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+
+	// segments from before the names were padded
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	require.Equal(t, []string{"0.index", "0.store", "2.index", "2.store", "4.index", "4.store"},
+		dirNames(t, dir))
+
+	// keep their names, while new segments' names are padded
+	c.Segment.NameWidth = 20
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 4; i < 24; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(0); off < 24; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+	require.Contains(t, dirNames(t, dir), "4.store")
+	require.Contains(t, dirNames(t, dir), "00000000000000000020.store")
+
+	// a compaction rewrites the sealed segments with padded names
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(0); off < 24; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// so listing the files lists the segments in order
+	names := dirNames(t, dir)
+	require.True(t, sort.StringsAreSorted(names))
+	var bases []uint64
+	for _, name := range names {
+		require.Len(t, name, 20+len(".store"))
+		if path.Ext(name) == ".store" {
+			base, err := strconv.ParseUint(strings.TrimSuffix(name, ".store"), 10, 64)
+			require.NoError(t, err)
+			bases = append(bases, base)
+		}
+	}
+	require.Len(t, bases, 13)
+	require.True(t, sort.SliceIsSorted(bases, func(i, j int) bool { return bases[i] < bases[j] }))
+	require.Equal(t, uint64(24), bases[12])
+}
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Sync())
+
+	// flock locks belong to the open file, so a second open in the same process is refused just
+	// as another process's would be
+	_, err = NewLog(dir, Config{})
+	require.True(t, errors.Is(err, ErrLocked))
+
+	// readers don't need the lock
+	reader, err := OpenReadOnly(dir, Config{})
+	require.NoError(t, err)
+	read, err := reader.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.NoError(t, reader.Close())
+
+	// a reset keeps it
+	require.NoError(t, log.Reset())
+	_, err = NewLog(dir, Config{})
+	require.True(t, errors.Is(err, ErrLocked))
+
+	// closing releases it
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestBackpressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backpressure-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Store.Sync = SyncPeriodic
+	// a sync that's far behind the appends
+	c.Store.SyncInterval = time.Hour
+	c.Store.MaxUnsyncedBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendUntilRejected := func() int {
+		for n := 0; n < 1000; n++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			if err != nil {
+				require.True(t, errors.Is(err, ErrBackpressure))
+				return n
+			}
+		}
+		t.Fatal("appends were never rejected")
+		return 0
+	}
+	n := appendUntilRejected()
+	require.Greater(t, n, 0)
+	// the rejected appends didn't take offsets
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(n-1), highest)
+
+	// a sync catches up, and appends resume
+	require.NoError(t, log.Sync())
+	require.Equal(t, n, appendUntilRejected())
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*n-1), off)
+
+	// as they do after a periodic sync
+	require.NoError(t, log.Close())
+	c.Store.SyncInterval = 20 * time.Millisecond
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	appendUntilRejected()
+	require.Eventually(t, func() bool {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, log.Close())
+}
+
+func TestErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errors-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxRecordBytes = 64
+	c.Keys.Index = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// any offset matches, and errors.As gets it back
+	_, err = log.Read(5)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	var oor api.ErrOffsetOutOfRange
+	require.True(t, errors.As(err, &oor))
+	require.Equal(t, uint64(5), oor.Offset)
+
+	_, err = log.Append(&api.Record{Value: make([]byte, 100)})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+	_, err = log.Append(nil)
+	require.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = log.AppendContext(context.Background(), nil)
+	require.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = log.AppendBatch([]*api.Record{nil})
+	require.ErrorIs(t, err, ErrInvalidRecord)
+	_, err = log.ReadLatestByKey([]byte("missing"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	err = log.RestoreSnapshot(strings.NewReader("not a snapshot"))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+
+	require.NoError(t, log.Close())
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.ErrorIs(t, err, ErrClosed)
+
+	ro, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	_, err = ro.Append(&api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.NoError(t, ro.Close())
+
+	// a record whose bytes changed on disk
+	stores, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var storeName string
+	for _, f := range stores {
+		if path.Ext(f.Name()) == ".store" {
+			storeName = path.Join(dir, f.Name())
+		}
+	}
+	b, err := os.ReadFile(storeName)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(storeName, b, 0644))
+	// rebuilding the key index would read it on open
+	c.Keys.Index = false
+	ro, err = OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	_, err = ro.Read(0)
+	require.ErrorIs(t, err, ErrCorruptRecord)
+	require.NoError(t, ro.Close())
+
+	// a read-only log needs segments to read
+	empty, err := ioutil.TempDir("", "errors-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(empty)
+	_, err = OpenReadOnly(empty, c)
+	require.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "merge-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 11; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	readAll := func() []string {
+		var values []string
+		for off := uint64(0); off < 11; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+			values = append(values, string(read.Value))
+		}
+		return values
+	}
+	want := readAll()
+	before := log.Segments()
+	require.Equal(t, 6, len(before))
+	active := log.activeSegment
+
+	// too small a limit leaves every segment as it is
+	require.NoError(t, log.Merge(before[0].StoreBytes))
+	require.Equal(t, before, log.Segments())
+
+	// runs of three sealed segments fit
+	require.NoError(t, log.Merge(
+		before[0].StoreBytes+before[1].StoreBytes+before[2].StoreBytes))
+	after := log.Segments()
+	require.Equal(t, 3, len(after))
+	require.Equal(t, before[0].BaseOffset, after[0].BaseOffset)
+	require.Equal(t, before[3].BaseOffset, after[1].BaseOffset)
+	require.Equal(t, uint64(6), after[0].IndexEntries)
+	require.Equal(t, active, log.activeSegment)
+	require.Equal(t, want, readAll())
+	require.Equal(t, 2*len(after), len(dirNames(t, dir)))
+	_, err = os.Stat(path.Join(dir, compactDir))
+	require.True(t, os.IsNotExist(err))
+
+	// appends continue in the active segment, and the merged log reopens
+	off, err := log.Append(&api.Record{Value: []byte("hello world 11")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), off)
+	segments := log.Segments()
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, want, readAll())
+	require.Equal(t, len(segments), len(log.Segments()))
+}
+
+func TestOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = log.FetchOffset("a")
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+	require.NoError(t, log.CommitOffset("a", 3))
+	require.NoError(t, log.CommitOffset("b", 7))
+	// a later commit replaces the group's offset
+	require.NoError(t, log.CommitOffset("a", 5))
+	require.Error(t, log.CommitOffset("", 1))
+
+	// the offsets survive a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	for group, want := range map[string]uint64{"a": 5, "b": 7} {
+		off, err := log.FetchOffset(group)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	_, err = log.FetchOffset("c")
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+	_, err = os.Stat(path.Join(dir, offsetsName+tmpExt))
+	require.True(t, os.IsNotExist(err))
+
+	// read-only logs can fetch but not commit
+	ro, err := OpenReadOnly(dir, Config{})
+	require.NoError(t, err)
+	defer ro.Close()
+	off, err := ro.FetchOffset("b")
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.ErrorIs(t, ro.CommitOffset("b", 8), ErrReadOnly)
+}
+
+func TestClockRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	c := Config{Clock: clock}
+	// a segment per record
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxAge = 24 * time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	append := func() {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	lowest := func() uint64 {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		return off
+	}
+
+	// records are stamped with the clock's time
+	append()
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, start.UnixNano(), read.Timestamp)
+
+	// a segment exactly MaxAge old is kept, a nanosecond older it's removed
+	clock.Advance(24 * time.Hour)
+	append()
+	require.Equal(t, uint64(0), lowest())
+	clock.Advance(time.Nanosecond)
+	append()
+	require.Equal(t, uint64(1), lowest())
+}
+
+func TestReadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-cache-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{ReadCacheSize: 2}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	read := func(off uint64) string {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		return string(record.Value)
+	}
+	cached := func(off uint64) bool {
+		return log.records.get(off) != nil
+	}
+
+	// reads are cached, as copies the caller can't change
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	record.Value[0] = 'X'
+	require.True(t, cached(0))
+	require.Equal(t, "record 0", read(0))
+
+	// the least recently read record is evicted
+	require.Equal(t, "record 2", read(2))
+	require.Equal(t, "record 0", read(0))
+	require.Equal(t, "record 4", read(4))
+	require.False(t, cached(2))
+	require.True(t, cached(0))
+
+	// truncating the segment a cached record is in evicts it
+	require.NoError(t, log.Truncate(2))
+	require.False(t, cached(0))
+	require.True(t, cached(4))
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	// as does a reset, which reuses the offsets
+	require.NoError(t, log.Reset())
+	require.False(t, cached(4))
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("new %d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, "new 4", read(4))
+}
+
+func TestBloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bloom-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Keys.Bloom = true
+	c.Segment.MaxStoreBytes = 1 << 20
+	// 100 records per segment
+	c.Segment.MaxIndexBytes = 100 * entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 250; i++ {
+		_, err = log.Append(&api.Record{
+			Key:   []byte(fmt.Sprintf("key-%d", i)),
+			Value: []byte("hello world"),
+		})
+		require.NoError(t, err)
+	}
+	check := func() {
+		// no false negatives, in sealed segments or the active one
+		for i := 0; i < 250; i++ {
+			require.True(t, log.MightContain([]byte(fmt.Sprintf("key-%d", i))))
+		}
+		// and few false positives, each of the 3 segments is sized for 1%
+		positives := 0
+		for i := 0; i < 1000; i++ {
+			if log.MightContain([]byte(fmt.Sprintf("absent-%d", i))) {
+				positives++
+			}
+		}
+		require.Less(t, positives, 60)
+	}
+	check()
+
+	// sealed segments save their filters, which are loaded on open
+	for _, base := range []string{"0", "100"} {
+		_, err = os.Stat(path.Join(dir, base+bloomExt))
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.True(t, log.segments[0].bloomSaved)
+	check()
+	require.NoError(t, log.Close())
+
+	// segments without a filter file have theirs rebuilt
+	require.NoError(t, os.Remove(path.Join(dir, "0"+bloomExt)))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	check()
+	_, err = os.Stat(path.Join(dir, "0"+bloomExt))
+	require.NoError(t, err)
+
+	// removing a segment removes its filter
+	require.NoError(t, log.Truncate(100))
+	_, err = os.Stat(path.Join(dir, "0"+bloomExt))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+
+	// without filters no key can be ruled out
+	c.Keys.Bloom = false
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.True(t, log.MightContain([]byte("absent")))
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flush-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// the append is buffered, the file doesn't have it yet
+	name := path.Join(dir, "0.store")
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Empty(t, b)
+
+	// a flush writes it to the file, without fsyncing it
+	require.NoError(t, log.Flush())
+	st := log.activeSegment.store.(*store)
+	require.False(t, st.dirty.Load())
+	require.Zero(t, st.synced)
+	b, err = os.ReadFile(name)
+	require.NoError(t, err)
+	p, err := log.ReadRaw(off)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(b, p))
+
+	// with nothing buffered there's nothing to flush
+	require.NoError(t, log.Flush())
+}
+
+func TestAppendIdempotent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clock := &fakeClock{now: time.Now()}
+	c := Config{Clock: clock}
+	c.Producers.Dedupe = true
+	c.Producers.TTL = time.Hour
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	append := func(producer string, seq uint64) (uint64, error) {
+		return log.AppendIdempotent(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: producer,
+			Sequence:   seq,
+		})
+	}
+
+	// a repeat of the producer's last sequence # gets the same offset, without being appended
+	off, err := append("a", 1)
+	require.NoError(t, err)
+	again, err := append("a", 1)
+	require.NoError(t, err)
+	require.Equal(t, off, again)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, off, highest)
+
+	// producers are deduplicated separately
+	other, err := append("b", 1)
+	require.NoError(t, err)
+	require.Equal(t, off+1, other)
+	next, err := append("a", 5)
+	require.NoError(t, err)
+	require.Equal(t, off+2, next)
+	_, err = append("a", 4)
+	require.ErrorIs(t, err, ErrStaleSequence)
+	_, err = log.AppendIdempotent(nil)
+	require.ErrorIs(t, err, ErrInvalidRecord)
+
+	// records without a producer are always appended
+	plain, err := append("", 0)
+	require.NoError(t, err)
+	require.Equal(t, next+1, plain)
+
+	// the producers are rebuilt from the records on open
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	again, err = append("a", 5)
+	require.NoError(t, err)
+	require.Equal(t, next, again)
+	again, err = append("b", 1)
+	require.NoError(t, err)
+	require.Equal(t, other, again)
+
+	// and forgotten once their last record is older than the TTL
+	clock.Advance(2 * time.Hour)
+	again, err = append("a", 5)
+	require.NoError(t, err)
+	require.Equal(t, plain+1, again)
+	require.NoError(t, log.Close())
+
+	// deduplication has to be enabled
+	c.Producers.Dedupe = false
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = append("a", 6)
+	require.ErrorIs(t, err, ErrDedupeDisabled)
+}
+
+func TestAppendIdempotentAfterCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotent-compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Producers.Dedupe = true
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// older values of the key ahead of the producer's record are compacted away
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Key: []byte("k"), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	produce := &api.Record{Value: []byte("hello world"), ProducerId: "a", Sequence: 1}
+	off, err := log.AppendIdempotent(produce)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+
+	// a retry gets the record's offset after compaction, which still reads it
+	again, err := log.AppendIdempotent(produce)
+	require.NoError(t, err)
+	require.Less(t, again, off)
+	read, err := log.Read(again)
+	require.NoError(t, err)
+	require.Equal(t, "a", read.ProducerId)
+	require.Equal(t, uint64(1), read.Sequence)
+	after, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest, after)
+}
+
+func TestOffsetAtPosition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-at-position-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for off := uint64(0); off < 5; off++ {
+		base, pos, err := log.Position(off)
+		require.NoError(t, err)
+		got, err := log.OffsetAtPosition(base, pos)
+		require.NoError(t, err)
+		require.Equal(t, off, got)
+	}
+	_, err = log.OffsetAtPosition(1, 0)
+	require.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestStartupConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "startup-concurrency-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// one record per segment
+	c := Config{StartupConcurrency: 8}
+	c.Segment.MaxStoreBytes = 1
+	c.Index.Checksum = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the segments opened concurrently are still in order, the empty one last and active
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 101)
+	for i, s := range log.segments {
+		require.Equal(t, uint64(i), s.baseOffset)
+	}
+	require.Equal(t, uint64(100), log.activeSegment.baseOffset)
+	for i := uint64(0); i < 100; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	off, err := log.Append(&api.Record{Value: []byte("record 100")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), off)
+	require.NoError(t, log.Close())
+
+	// a segment that fails to open fails the open
+	index := path.Join(dir, "50.index")
+	b, err := os.ReadFile(index)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(index, b, 0644))
+	_, err = NewLog(dir, c)
+	require.ErrorIs(t, err, ErrCorruptIndex)
+}
+
+func BenchmarkStartup(b *testing.B) {
+	dir, err := ioutil.TempDir("", "startup-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	// one record per segment
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	for i := 0; i < 1000; i++ {
+		if _, err = log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	require.NoError(b, log.Close())
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			c.StartupConcurrency = workers
+			for n := 0; n < b.N; n++ {
+				log, err := NewLog(dir, c)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				if err = log.Close(); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestAppendBatchTracksProducers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch-producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Producers.Dedupe = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	offs, err := log.AppendBatch([]*api.Record{
+		{Value: []byte("a"), ProducerId: "p", Sequence: 1},
+		{Value: []byte("b"), ProducerId: "p", Sequence: 2},
+	})
+	require.NoError(t, err)
+	off, err := log.AppendIdempotent(&api.Record{Value: []byte("b"), ProducerId: "p", Sequence: 2})
+	require.NoError(t, err)
+	require.Equal(t, offs[1], off)
+}
+
+func TestAppendBatchExpiresProducers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch-expire-producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clock := &fakeClock{now: time.Now()}
+	c := Config{Clock: clock}
+	c.Producers.Dedupe = true
+	c.Producers.TTL = time.Hour
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.AppendIdempotent(&api.Record{Value: []byte("hello world"), ProducerId: "a", Sequence: 1})
+	require.NoError(t, err)
+
+	// a batch rolling over a segment forgets the producers that have gone away
+	clock.Advance(2 * time.Hour)
+	_, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(log.segments), 1)
+	require.NotContains(t, log.producers, "a")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breaker-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clock := &fakeClock{now: time.Now()}
+	c := Config{Clock: clock}
+	c.Breaker.Failures = 3
+	c.Breaker.Cooldown = time.Minute
+	c.Segment.MaxRecordBytes = 64
+	// a store whose appends fail while the disk is failing
+	var failing atomic.Bool
+	c.openStore = func(dir string, baseOffset uint64, c Config) (segmentStore, error) {
+		s, err := openMemStore(dir, baseOffset, c)
+		return &failingStore{segmentStore: s, failing: &failing}, err
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	append := func() error {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		return err
+	}
+	require.NoError(t, append())
+
+	// the breaker trips after 3 failures in a row, then fails appends without writing
+	failing.Store(true)
+	for i := 0; i < 3; i++ {
+		require.ErrorIs(t, append(), errWriteFailed)
+	}
+	err = append()
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.NotErrorIs(t, err, errWriteFailed)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// after the cooldown a failed probe opens it again
+	clock.Advance(time.Minute)
+	require.ErrorIs(t, append(), errWriteFailed)
+	require.ErrorIs(t, append(), ErrCircuitOpen)
+
+	// and a successful one closes it
+	failing.Store(false)
+	require.ErrorIs(t, append(), ErrCircuitOpen)
+	clock.Advance(time.Minute)
+	require.NoError(t, append())
+	require.NoError(t, append())
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	// errors with the record rather than the disk don't count
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: make([]byte, 100)})
+		require.ErrorIs(t, err, ErrRecordTooLarge)
+	}
+	require.NoError(t, append())
+}
+
+func TestAppendFrom(t *testing.T) {
+	open := func() *Log {
+		dir, err := ioutil.TempDir("", "append-from-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		c := Config{}
+		c.Segment.MaxStoreBytes = 64
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { log.Close() })
+		return log
+	}
+	src := open()
+	for i := 0; i < 5; i++ {
+		_, err := src.Append(&api.Record{Key: []byte(strconv.Itoa(i)), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(src.Reader())
+	require.NoError(t, err)
+	raw := buf.Bytes()
+
+	// copying into a fresh log reproduces every record, timestamps and all
+	dst := open()
+	n, err := dst.AppendFrom(bytes.NewReader(raw))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), n)
+	for off := uint64(0); off < 5; off++ {
+		want, err := src.Read(off)
+		require.NoError(t, err)
+		got, err := dst.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got), "offset %d", off)
+	}
+
+	// a truncated final frame keeps the records before it and says how far it got
+	dst = open()
+	for _, cut := range []int{3, 20} {
+		dst = open()
+		truncated := append(append([]byte{}, raw...), raw[:cut]...)
+		n, err = dst.AppendFrom(bytes.NewReader(truncated))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Contains(t, err.Error(), fmt.Sprintf("after %d bytes", len(raw)))
+		require.Equal(t, uint64(5), n)
+		highest, err := dst.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), highest)
+	}
+}
+
+func TestSegmentLastRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "last-read-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clock := &fakeClock{now: time.Now()}
+	c := Config{Clock: clock}
+	c.Segment.MaxStoreBytes = 64
+	c.Retention.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// aging the segments on rollover doesn't count as reading them
+	for _, info := range log.Segments() {
+		require.True(t, info.LastRead.IsZero())
+	}
+
+	// reading the oldest segment later records when it was read, and only for it
+	clock.Advance(time.Minute)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	infos := log.Segments()
+	require.Equal(t, clock.Now().UnixNano(), infos[0].LastRead.UnixNano())
+	require.True(t, infos[1].LastRead.IsZero())
+
+	// as do later reads, raw ones and replays included
+	clock.Advance(time.Minute)
+	_, err = log.ReadRaw(1)
+	require.NoError(t, err)
+	require.Equal(t, clock.Now().UnixNano(), log.Segments()[0].LastRead.UnixNano())
+	clock.Advance(time.Minute)
+	require.NoError(t, log.Replay(2, func(*api.Record) error { return nil }))
+	infos = log.Segments()
+	require.Equal(t, clock.Now().UnixNano(), infos[1].LastRead.UnixNano())
+	require.Equal(t, clock.Now().UnixNano(), infos[2].LastRead.UnixNano())
+
+	// the log's own scans don't count as reads
+	replayed := clock.Now()
+	clock.Advance(time.Minute)
+	_, err = log.Tail(5)
+	require.NoError(t, err)
+	_, err = log.ReadSince(time.Unix(0, 0))
+	require.NoError(t, err)
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Merge(1024))
+	infos = log.Segments()
+	for _, info := range infos[:len(infos)-1] {
+		require.True(t, info.LastRead.IsZero())
+	}
+	require.Equal(t, replayed.UnixNano(), infos[len(infos)-1].LastRead.UnixNano())
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Keys.Index = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Key: []byte(strconv.Itoa(i)), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	readAll := func(log *Log) {
+		for off := uint64(0); off < 5; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, []byte(strconv.Itoa(int(off))), record.Key)
+		}
+	}
+
+	// an open log rebuilds a sealed segment's index, and the active one's, in place
+	require.NoError(t, log.RebuildIndex(0))
+	require.NoError(t, log.RebuildIndex(4))
+	readAll(log)
+	off, err := log.Append(&api.Record{Key: []byte("5"), Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	latest, err := log.ReadLatestByKey([]byte("5"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), latest.Offset)
+	require.ErrorIs(t, log.RebuildIndex(1), ErrSegmentNotFound)
+	require.NoError(t, log.Close())
+
+	// a closed log's lost index and a partial frame at the end of its last store are
+	// found and rebuilt before it's opened
+	stores, indexes := segmentFiles(t, dir)
+	require.NoError(t, os.Remove(indexes[1]))
+	st, err := os.OpenFile(stores[2], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = st.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+	rebuilt, err := RebuildIndexes(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 4}, rebuilt)
+	rebuilt, err = RebuildIndexes(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, rebuilt)
+
+	// a log that's yet to be created has nothing to rebuild, and isn't created
+	missing := path.Join(dir, "missing")
+	rebuilt, err = RebuildIndexes(missing, c)
+	require.NoError(t, err)
+	require.Empty(t, rebuilt)
+	require.NoDirExists(t, missing)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	readAll(log)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+}
+
+func TestRebuildIndexesCorruptLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-corrupt-length-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, pos, err := log.Position(1)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// the second frame's length is garbage, far larger than the store
+	stores, _ := segmentFiles(t, dir)
+	f, err := os.OpenFile(stores[0], os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, int64(pos))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// it's taken as the end of the store rather than allocated
+	rebuilt, err := RebuildIndexes(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, rebuilt)
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	// as it is by AppendFrom
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(log.Reader())
+	require.NoError(t, err)
+	n, err := log.AppendFrom(bytes.NewReader(append(buf.Bytes(), 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0, 0, 0, 0, 0)))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, uint64(1), n)
+}
+
+// segmentFiles returns the paths of the store and index files in dir, in order
+func segmentFiles(t *testing.T, dir string) (stores, indexes []string) {
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		switch path.Ext(file.Name()) {
+		case ".store":
+			stores = append(stores, path.Join(dir, file.Name()))
+		case ".index":
+			indexes = append(indexes, path.Join(dir, file.Name()))
+		}
+	}
+	return stores, indexes
+}
+
+func TestMaxConcurrentAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max-concurrent-appends-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{MaxConcurrentAppends: 3}
+	var inFlight, most atomic.Int32
+	c.appendHook = func() {
+		n := inFlight.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// hold the slot a while, so the other appends pile up behind it
+		time.Sleep(time.Millisecond)
+		inFlight.Add(-1)
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 3 {
+			case 0:
+				_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			case 1:
+				_, err = log.AppendContext(context.Background(), &api.Record{Value: []byte("hello world")})
+			case 2:
+				_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+			}
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, most.Load(), int32(3))
+	require.Greater(t, most.Load(), int32(1))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(49), highest)
+}
+
+func TestMaxConcurrentAppendsContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max-concurrent-appends-context-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{MaxConcurrentAppends: 1}
+	admitted, block := make(chan struct{}, 1), make(chan struct{})
+	c.appendHook = func() {
+		admitted <- struct{}{}
+		<-block
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// one append holds the only slot, so another queues until its context is done
+	errc := make(chan error)
+	go func() {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		errc <- err
+	}()
+	<-admitted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(block)
+	require.NoError(t, <-errc)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("root")})
+	require.NoError(t, err)
+
+	// each partition has offsets of its own, from 0
+	orders, err := log.Partition("orders")
+	require.NoError(t, err)
+	payments, err := log.Partition("payments")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		off, err := orders.Append(&api.Record{Value: []byte("order " + strconv.Itoa(i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	off, err := payments.Append(&api.Record{Value: []byte("payment 0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	same, err := log.Partition("orders")
+	require.NoError(t, err)
+	require.Same(t, orders, same)
+
+	// and reads don't cross partitions, or into the log's own records
+	record, err := payments.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payment 0"), record.Value)
+	_, err = payments.Read(1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	record, err = orders.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 0"), record.Value)
+	record, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("root"), record.Value)
+	_, err = log.Read(1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	for _, name := range []string{"", ".", "..", "a/b", "../orders"} {
+		_, err = log.Partition(name)
+		require.ErrorIs(t, err, ErrInvalidPartition, name)
+	}
+
+	// resetting the log leaves its partitions alone
+	require.NoError(t, log.Reset())
+	highest, err := orders.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	// closing the log closes them, and they're there when it's reopened
+	require.NoError(t, log.Close())
+	_, err = orders.Append(&api.Record{Value: []byte("order 3")})
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.Partition("orders")
+	require.ErrorIs(t, err, ErrClosed)
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	orders, err = log.LookupPartition("orders")
+	require.NoError(t, err)
+	record, err = orders.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 2"), record.Value)
+
+	// looking a partition up doesn't create it
+	_, err = log.LookupPartition("refunds")
+	require.ErrorIs(t, err, ErrPartitionNotFound)
+	require.NoDirExists(t, path.Join(dir, partitionsDir, "refunds"))
+	_, err = log.LookupPartition("../orders")
+	require.ErrorIs(t, err, ErrInvalidPartition)
+}
+
+// sizeMetrics keeps the gauges it's last set to and counts appends
+type sizeMetrics struct {
+	nopMetrics
+	appends  int
+	segments int
+}
+
+func (m *sizeMetrics) ObserveAppend(time.Duration) { m.appends++ }
+func (m *sizeMetrics) SetSegments(n int)           { m.segments = n }
+
+func TestPartitionMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partition-metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m := &sizeMetrics{}
+	c := Config{Metrics: m}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, m.segments)
+
+	// a partition's appends are observed, but its size doesn't overwrite the log's
+	orders, err := log.Partition("orders")
+	require.NoError(t, err)
+	_, err = orders.Append(&api.Record{Value: []byte("order 0")})
+	require.NoError(t, err)
+	require.Equal(t, 6, m.appends)
+	require.Equal(t, 3, m.segments)
+}
+
+func TestPartitionsMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitions-max-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Partitions.Max = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, name := range []string{"orders", "payments"} {
+		_, err = log.Partition(name)
+		require.NoError(t, err)
+	}
+	_, err = log.Partition("refunds")
+	require.ErrorIs(t, err, ErrTooManyPartitions)
+	require.NoDirExists(t, path.Join(dir, partitionsDir, "refunds"))
+	require.NoError(t, log.Close())
+
+	// the partitions on disk count once the log's reopened, and they can still be opened
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Partition("refunds")
+	require.ErrorIs(t, err, ErrTooManyPartitions)
+	_, err = log.Partition("orders")
+	require.NoError(t, err)
+}
+
+func TestTruncateAllKeepsAppending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "truncate-all-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{MaxOpenSegments: 2}
+	c.Segment.MaxStoreBytes = 64
+	c.Keys.Bloom = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	append := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := log.Append(&api.Record{Key: []byte("key"), Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	// the active segment holds a record, so it's removed with the rest
+	append(5)
+	require.NoError(t, log.Truncate(100))
+	require.Len(t, log.segments, 1)
+	require.Equal(t, uint64(5), log.activeSegment.baseOffset)
+	for _, name := range dirNames(t, dir) {
+		require.NotEqual(t, bloomExt, path.Ext(name), name)
+	}
+
+	// the removed segment isn't left among the open ones, to be closed under later appends
+	append(10)
+	require.NoError(t, log.Sync())
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), highest)
+	for _, name := range dirNames(t, dir) {
+		if path.Ext(name) == bloomExt {
+			_, err = os.Stat(path.Join(dir, strings.TrimSuffix(name, bloomExt)+".store"))
+			require.NoError(t, err, name)
+		}
+	}
+}
+
+func TestReopenByteOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reopen-byte-order-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Store.ByteOrder = binary.LittleEndian
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// reopened with the default config, the log's still read and appended to little endian
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	for i := uint64(0); i <= off; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	require.NoError(t, log.Close())
+
+	rebuilt, err := RebuildIndexes(dir, Config{})
+	require.NoError(t, err)
+	require.Empty(t, rebuilt)
+}
+
+// failingStore fails appends with errWriteFailed while failing is set
+type failingStore struct {
+	segmentStore
+	failing *atomic.Bool
+}
+
+func (s *failingStore) Append(p []byte) (uint64, uint64, error) {
+	if s.failing.Load() {
+		return 0, 0, errWriteFailed
+	}
+	return s.segmentStore.Append(p)
 }
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStoreMatchesFileStore(t *testing.T) {
+	gzip := Config{}
+	gzip.Store.Compression = CompressionGzip
+	legacy := Config{}
+	legacy.Store.DisableChecksum = true
+	for name, c := range map[string]Config{
+		"default": {},
+		"gzip":    gzip,
+		"legacy":  legacy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "memstore_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			fs, err := newStore(f, c)
+			require.NoError(t, err)
+			ms, err := newMemStore("mem", c)
+			require.NoError(t, err)
+
+			// the same appends land at the same positions...
+			var positions []uint64
+			for i := 1; i < 5; i++ {
+				p := bytes.Repeat([]byte("hello world"), i)
+				fn, fpos, ferr := fs.Append(p)
+				mn, mpos, merr := ms.Append(p)
+				require.NoError(t, ferr)
+				require.NoError(t, merr)
+				require.Equal(t, fn, mn)
+				require.Equal(t, fpos, mpos)
+				positions = append(positions, fpos)
+			}
+			require.Equal(t, fs.Size(), ms.Size())
+
+			// ...read back the same...
+			for _, pos := range positions {
+				fp, ferr := fs.Read(pos)
+				mp, merr := ms.Read(pos)
+				require.NoError(t, ferr)
+				require.NoError(t, merr)
+				require.Equal(t, fp, mp)
+			}
+
+			// ...and are framed byte for byte the same, up to the end of the store
+			fb := make([]byte, fs.Size()+1)
+			mb := make([]byte, ms.Size()+1)
+			fn, ferr := fs.ReadAt(fb, 0)
+			mn, merr := ms.ReadAt(mb, 0)
+			require.Equal(t, io.EOF, ferr)
+			require.Equal(t, io.EOF, merr)
+			require.Equal(t, fn, mn)
+			require.Equal(t, fb, mb)
+
+			fr, err := fs.Reader(positions[1])
+			require.NoError(t, err)
+			mr, err := ms.Reader(positions[1])
+			require.NoError(t, err)
+			for {
+				fp, fpos, ferr := fr.Next()
+				mp, mpos, merr := mr.Next()
+				require.Equal(t, ferr, merr)
+				if ferr == io.EOF {
+					break
+				}
+				require.Equal(t, fp, mp)
+				require.Equal(t, fpos, mpos)
+			}
+			require.NoError(t, fs.Close())
+			require.NoError(t, ms.Close())
+		})
+	}
+}
+
+func TestSegmentMemStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-memstore-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.openStore = openMemStore
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	want := &api.Record{Value: []byte("hello world")}
+	for i := uint64(0); i < 3; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// only the index touched the disk
+	_, err = os.Stat(s.store.Name())
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, s.Remove())
+}
@@ -0,0 +1,121 @@
+package log
+
+import (
+	"fmt"
+	"os"
+)
+
+// combines runs of adjacent sealed segments whose stores total at most maxMergedBytes, and
+// whose records fit one index, into single segments, the inverse of rollover, so a log left
+// with many small segments by retention or compaction keeps fewer files open and reads
+// further in each. Records keep their offsets. The active segment is never merged.
+// Like Compact it rewrites every sealed segment alongside the log before swapping them in,
+// so a crash part way through leaves either the old segments or the merged ones, and merged
+// segments in Config.Tier.ColdDir move back to Dir until they're old enough again
+func (l *Log) Merge(maxMergedBytes uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	defer l.reportSize()
+	sealed := l.segments[:len(l.segments)-1]
+	if err := l.forEachSegment(true, func(s *segment) error {
+		if _, ok := s.store.(*store); !ok {
+			return fmt.Errorf("merging needs file-backed stores")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	runs, err := l.mergeRuns(sealed, maxMergedBytes)
+	if err != nil {
+		return err
+	}
+	if len(runs) == len(sealed) {
+		// nothing to merge
+		return nil
+	}
+
+	tmp, err := l.newCompactDir()
+	if err != nil {
+		return err
+	}
+	merged, err := l.writeMerged(tmp, runs)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err = l.swapCompacted(tmp, sealed, merged); err != nil {
+		return err
+	}
+	l.cache.reset()
+	return nil
+}
+
+// mergeRuns splits the sealed segments into the runs Merge combines, each as long as it can be
+// with its stores totalling at most maxBytes and its records fitting a new segment's index.
+// A segment that's too big to merge with its neighbours is a run by itself
+func (l *Log) mergeRuns(sealed []*segment, maxBytes uint64) ([][]*segment, error) {
+	// the layout the merged segments' indexes have
+	idx := &index{}
+	if err := idx.layout(l.Config); err != nil {
+		return nil, err
+	}
+	maxEntries := (l.Config.Segment.MaxIndexBytes - idx.header) / idx.entWidth
+	var runs [][]*segment
+	var bytes, entries uint64
+	for i, s := range sealed {
+		size, n := s.store.Size(), s.nextOffset-s.baseOffset
+		// the merged segment's offsets have to be contiguous
+		if i > 0 && sealed[i-1].nextOffset == s.baseOffset &&
+			bytes+size <= maxBytes && entries+n <= maxEntries {
+			runs[len(runs)-1] = append(runs[len(runs)-1], s)
+			bytes, entries = bytes+size, entries+n
+			continue
+		}
+		runs = append(runs, []*segment{s})
+		bytes, entries = size, n
+	}
+	return runs, nil
+}
+
+// writes each run's records to a new segment in dir at the run's base offset, returning them
+// closed
+func (l *Log) writeMerged(dir string, runs [][]*segment) ([]*segment, error) {
+	var merged []*segment
+	closeAll := func() {
+		for _, m := range merged {
+			m.Close()
+		}
+	}
+	for _, run := range runs {
+		m, err := newSegment(dir, run[0].baseOffset, l.Config)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		merged = append(merged, m)
+		for _, s := range run {
+			for off := s.baseOffset; off < s.nextOffset; off++ {
+				record, err := s.peek(off)
+				if err == nil {
+					_, err = m.write(record)
+				}
+				if err != nil {
+					closeAll()
+					return nil, err
+				}
+			}
+		}
+	}
+	for i, m := range merged {
+		if err := m.Close(); err != nil {
+			for _, m := range merged[i+1:] {
+				m.Close()
+			}
+			return nil, err
+		}
+	}
+	return merged, nil
+}
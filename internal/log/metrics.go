@@ -0,0 +1,29 @@
+package log
+
+import "time"
+
+// Metrics receives measurements of the log's activity. internal/metrics implements it with
+// Prometheus; the default discards everything so tests pay nothing for it
+type Metrics interface {
+	ObserveAppend(d time.Duration)
+	ObserveRead(d time.Duration)
+	SetSegments(n int)
+	SetStoreBytes(n uint64)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveAppend(time.Duration) {}
+func (nopMetrics) ObserveRead(time.Duration)   {}
+func (nopMetrics) SetSegments(int)             {}
+func (nopMetrics) SetStoreBytes(uint64)        {}
+
+// partitionMetrics passes a partition's append and read latencies on to its log's Metrics,
+// but not its size, so the gauges report the log's own segments rather than whichever
+// partition last changed size
+type partitionMetrics struct {
+	Metrics
+}
+
+func (partitionMetrics) SetSegments(int)      {}
+func (partitionMetrics) SetStoreBytes(uint64) {}
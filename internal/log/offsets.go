@@ -0,0 +1,82 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// offsetsName is the file in the log's directory consumer groups' committed offsets are kept in,
+// as a JSON object from group to offset
+const offsetsName = "offsets.json"
+
+// ErrNoCommittedOffset is returned by FetchOffset for a group that hasn't committed an offset
+var ErrNoCommittedOffset = fmt.Errorf("no committed offset")
+
+// records offset as the consumer group's committed offset, conventionally the next it will
+// consume, replacing any it committed before, so its consumers can resume from it after a
+// restart. The offsets are rewritten to a temporary file and renamed over the old ones, so a
+// crash leaves either the old offsets or the new. They're kept by this log, not replicated
+func (l *Log) CommitOffset(group string, offset uint64) error {
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	if group == "" {
+		return fmt.Errorf("empty consumer group")
+	}
+	l.offsetsMu.Lock()
+	defer l.offsetsMu.Unlock()
+	offsets := make(map[string]uint64, len(l.offsets)+1)
+	for g, off := range l.offsets {
+		offsets[g] = off
+	}
+	offsets[group] = offset
+	b, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+	name := path.Join(l.Dir, offsetsName)
+	if err = writeFile(name+tmpExt, bytes.NewReader(b), uint64(len(b)), l.Config); err != nil {
+		return err
+	}
+	if err = os.Rename(name+tmpExt, name); err != nil {
+		return err
+	}
+	if err = syncPath(l.Dir); err != nil {
+		return err
+	}
+	l.offsets = offsets
+	return nil
+}
+
+// returns the consumer group's committed offset, or ErrNoCommittedOffset if it hasn't
+// committed one
+func (l *Log) FetchOffset(group string) (uint64, error) {
+	l.offsetsMu.Lock()
+	defer l.offsetsMu.Unlock()
+	off, ok := l.offsets[group]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrNoCommittedOffset, group)
+	}
+	return off, nil
+}
+
+// loads the committed offsets from the log's directory, a missing file is no offsets
+func (l *Log) loadOffsets() error {
+	l.offsetsMu.Lock()
+	defer l.offsetsMu.Unlock()
+	l.offsets = make(map[string]uint64)
+	b, err := os.ReadFile(path.Join(l.Dir, offsetsName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, &l.offsets); err != nil {
+		return fmt.Errorf("%s: %w", offsetsName, err)
+	}
+	return nil
+}
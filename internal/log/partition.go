@@ -0,0 +1,133 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// partitionsDir is the subdirectory of a log's directory, and its cold directory, that holds
+// its partitions, one directory each
+const partitionsDir = "partitions"
+
+// ErrInvalidPartition is returned by Partition for a name that isn't a plain directory name
+var ErrInvalidPartition = fmt.Errorf("invalid partition name")
+
+// ErrPartitionNotFound is returned by LookupPartition for a partition that hasn't been created
+var ErrPartitionNotFound = fmt.Errorf("partition not found")
+
+// ErrTooManyPartitions is returned by Partition for a new partition once the log has
+// Config.Partitions.Max of them
+var ErrTooManyPartitions = fmt.Errorf("too many partitions")
+
+// returns the partition called name, opening it, or creating it, on first use. A partition
+// is an independent log hosted in a subdirectory of this one's, with its own segments and
+// offsets, and the log's config, so several streams can share a directory and a server. The
+// partition's Tier.ColdDir is likewise a subdirectory of the log's, and its appends and
+// reads are reported to the log's Config.Metrics, but not its size. Partitions are closed and
+// removed with the log, but they're left alone by Reset, RestoreSnapshot and the rest of the
+// methods on the log's own records, and they aren't replicated by a DistributedLog. Names
+// are made of letters, digits, '.', '-' and '_'
+func (l *Log) Partition(name string) (*Log, error) {
+	return l.partition(name, true)
+}
+
+// returns the partition called name like Partition, but only if it's been created, failing
+// with ErrPartitionNotFound rather than creating it. Reads use it, so they can't create
+// partitions
+func (l *Log) LookupPartition(name string) (*Log, error) {
+	return l.partition(name, false)
+}
+
+// opens the partition called name, creating it if create is set and it doesn't exist
+func (l *Log) partition(name string, create bool) (*Log, error) {
+	if !validPartition(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPartition, name)
+	}
+	l.partitionsMu.Lock()
+	defer l.partitionsMu.Unlock()
+	if l.closed.Load() {
+		return nil, ErrClosed
+	}
+	if p, ok := l.partitions[name]; ok {
+		return p, nil
+	}
+	dir := path.Join(l.Dir, partitionsDir, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if !create {
+			return nil, fmt.Errorf("%w: %q", ErrPartitionNotFound, name)
+		}
+		if max := l.Config.Partitions.Max; max > 0 {
+			n, err := l.countPartitions()
+			if err != nil {
+				return nil, err
+			}
+			if n >= max {
+				return nil, fmt.Errorf("%w: the log has %d", ErrTooManyPartitions, n)
+			}
+		}
+	}
+	c := l.Config
+	c.Segment.InitialOffset = 0
+	c.Metrics = partitionMetrics{c.metrics()}
+	if c.Tier.ColdDir != "" {
+		c.Tier.ColdDir = path.Join(c.Tier.ColdDir, partitionsDir, name)
+	}
+	p, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	if l.partitions == nil {
+		l.partitions = make(map[string]*Log)
+	}
+	l.partitions[name] = p
+	return p, nil
+}
+
+// countPartitions returns the # of partitions in the log's directory, opened or not
+func (l *Log) countPartitions() (int, error) {
+	entries, err := os.ReadDir(path.Join(l.Dir, partitionsDir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		if e.IsDir() && validPartition(e.Name()) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// closes the partitions opened so far, returning the first error
+func (l *Log) closePartitions() error {
+	l.partitionsMu.Lock()
+	defer l.partitionsMu.Unlock()
+	var err error
+	for name, p := range l.partitions {
+		if cerr := p.Close(); err == nil {
+			err = cerr
+		}
+		delete(l.partitions, name)
+	}
+	return err
+}
+
+// validPartition reports whether name can name a partition's directory
+func validPartition(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 255 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
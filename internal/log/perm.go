@@ -0,0 +1,55 @@
+package log
+
+import "os"
+
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
+// fileMode returns the configured mode for the log's files or the default
+func (c Config) fileMode() os.FileMode {
+	if c.Permissions.File == 0 {
+		return defaultFileMode
+	}
+	return c.Permissions.File
+}
+
+// dirMode returns the configured mode for the log's directories or the default
+func (c Config) dirMode() os.FileMode {
+	if c.Permissions.Dir == 0 {
+		return defaultDirMode
+	}
+	return c.Permissions.Dir
+}
+
+// openFile opens name with flag, creating it with the file mode if it doesn't exist. The mode's
+// set again once the file's created, since the process's umask may have narrowed it
+func (c Config) openFile(name string, flag int) (*os.File, error) {
+	_, err := os.Stat(name)
+	created := os.IsNotExist(err) && flag&os.O_CREATE != 0
+	f, err := os.OpenFile(name, flag, c.fileMode())
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if err = f.Chmod(c.fileMode()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// mkdirAll creates dir and any missing parents with the directory mode, setting dir's mode
+// again once it's created, since the process's umask may have narrowed it. An existing dir
+// keeps its mode
+func (c Config) mkdirAll(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, c.dirMode()); err != nil {
+		return err
+	}
+	return os.Chmod(dir, c.dirMode())
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package log
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which reserves the blocks without changing the size
+const fallocKeepSize = 0x1
+
+// preallocate reserves the disk blocks for the first n bytes of f with fallocate, leaving its
+// size as it is. On filesystems without fallocate f is left sparse
+func preallocate(f *os.File, n uint64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, int64(n))
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreallocate(t *testing.T) {
+	// the bytes of disk allocated to a file
+	allocated := func(name string) int64 {
+		var st syscall.Stat_t
+		require.NoError(t, syscall.Stat(name, &st))
+		return st.Blocks * 512
+	}
+	for _, preallocate := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "preallocate-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		c := Config{Preallocate: preallocate}
+		c.Segment.MaxStoreBytes = 1 << 20
+		c.Segment.MaxIndexBytes = 1 << 20
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		storeFile, indexFile := path.Join(dir, "0.store"), path.Join(dir, "0.index")
+		if !preallocate {
+			// sparse until written
+			require.Less(t, allocated(indexFile), int64(c.Segment.MaxIndexBytes))
+			require.Zero(t, allocated(storeFile))
+			require.NoError(t, log.Close())
+			continue
+		}
+		require.GreaterOrEqual(t, allocated(indexFile), int64(c.Segment.MaxIndexBytes))
+		require.GreaterOrEqual(t, allocated(storeFile), int64(c.Segment.MaxStoreBytes))
+		// without changing the store's size
+		fi, err := os.Stat(storeFile)
+		require.NoError(t, err)
+		require.Zero(t, fi.Size())
+
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		// closing hands back the blocks the records didn't use
+		require.NoError(t, log.Close())
+		require.Less(t, allocated(storeFile), int64(c.Segment.MaxStoreBytes))
+		require.Less(t, allocated(indexFile), int64(c.Segment.MaxIndexBytes))
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		record, err := log.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+		require.NoError(t, log.Close())
+	}
+}
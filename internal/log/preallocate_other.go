@@ -0,0 +1,10 @@
+//go:build !linux
+
+package log
+
+import "os"
+
+// preallocate is a no-op where there's no fallocate, the files are left sparse
+func preallocate(f *os.File, n uint64) error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+)
+
+// ErrDedupeDisabled is returned by AppendIdempotent unless Config.Producers.Dedupe is set
+var ErrDedupeDisabled = fmt.Errorf("producer deduplication isn't enabled")
+
+// ErrStaleSequence is returned by AppendIdempotent for a record whose sequence # is older than
+// its producer's last, whose offset the log no longer knows
+var ErrStaleSequence = fmt.Errorf("stale producer sequence")
+
+// producerState is a producer's last sequence # and the record it was appended with
+type producerState struct {
+	sequence  uint64
+	offset    uint64
+	timestamp int64
+}
+
+// appends the record like Append, unless it's a retry: a record with the same ProducerId and
+// Sequence as the producer's last returns the offset that one was given without appending it
+// again, so a producer can safely retry a produce whose response it lost. Each producer's
+// sequence #s must increase, ErrStaleSequence is returned for older ones. A record without a
+// ProducerId is simply appended. It requires Config.Producers.Dedupe
+func (l *Log) AppendIdempotent(record *api.Record) (uint64, error) {
+	_, span := l.startSpan(context.Background(), "Log.Append")
+	release, err := l.admitAppend(context.Background())
+	if err != nil {
+		endSpan(span, record, 0, err)
+		return 0, err
+	}
+	defer release()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.producers == nil {
+		endSpan(span, record, 0, ErrDedupeDisabled)
+		return 0, ErrDedupeDisabled
+	}
+	if record != nil && record.ProducerId != "" {
+		if last, ok := l.producer(record.ProducerId); ok {
+			switch {
+			case record.Sequence == last.sequence:
+				endSpan(span, record, 0, nil)
+				return last.offset, nil
+			case record.Sequence < last.sequence:
+				err := fmt.Errorf("%w: %d, producer %q is at %d",
+					ErrStaleSequence, record.Sequence, record.ProducerId, last.sequence)
+				endSpan(span, record, 0, err)
+				return 0, err
+			}
+		}
+	}
+	return l.append(span, record)
+}
+
+// returns the producer's state unless it's expired, the caller must hold the lock
+func (l *Log) producer(id string) (producerState, bool) {
+	last, ok := l.producers[id]
+	if ok && l.producerExpired(last) {
+		delete(l.producers, id)
+		return producerState{}, false
+	}
+	return last, ok
+}
+
+// reports whether the producer's last record is older than Config.Producers.TTL
+func (l *Log) producerExpired(p producerState) bool {
+	ttl := l.Config.Producers.TTL
+	return ttl > 0 && l.Config.clock().Now().Sub(time.Unix(0, p.timestamp)) > ttl
+}
+
+// records the appended record as its producer's last, the caller must hold the write lock
+func (l *Log) trackProducer(record *api.Record) {
+	if l.producers != nil && record.ProducerId != "" {
+		l.producers[record.ProducerId] = producerState{
+			sequence:  record.Sequence,
+			offset:    record.Offset,
+			timestamp: record.Timestamp,
+		}
+	}
+}
+
+// forgets expired producers, so the state doesn't grow with producers that have gone away.
+// The caller must hold the write lock
+func (l *Log) expireProducers() {
+	if l.Config.Producers.TTL == 0 {
+		return
+	}
+	for id, p := range l.producers {
+		if l.producerExpired(p) {
+			delete(l.producers, id)
+		}
+	}
+}
+
+// rebuilds the producers' state by reading the records of the segments appended to within
+// Config.Producers.TTL, or every segment without one
+func (l *Log) indexProducers() error {
+	l.producers = make(map[string]producerState)
+	for _, s := range l.segments {
+		if s.nextOffset == s.baseOffset {
+			continue
+		}
+		if l.Config.Producers.TTL > 0 {
+			newest, err := s.peek(s.nextOffset - 1)
+			if err != nil {
+				return err
+			}
+			if l.producerExpired(producerState{timestamp: newest.Timestamp}) {
+				continue
+			}
+		}
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.peek(off)
+			if err != nil {
+				return err
+			}
+			l.trackProducer(record)
+		}
+	}
+	l.expireProducers()
+	return nil
+}
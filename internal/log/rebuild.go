@@ -0,0 +1,220 @@
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// rebuilds the index of the segment based at baseOffset from its store, for an index that's
+// been lost or damaged while the store is intact. The store is scanned frame by frame and each
+// whole frame indexed, in order, and a partial frame at its end, from an append cut short, is
+// truncated away. The segment is reopened with the new index, so reads, and appends to the
+// active segment, carry on from the records found
+func (l *Log) RebuildIndex(baseOffset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	for i, s := range l.segments {
+		if s.baseOffset != baseOffset {
+			continue
+		}
+		if err := s.Close(); err != nil {
+			return err
+		}
+		if err := rebuildIndex(s.dir, baseOffset, l.Config); err != nil {
+			return err
+		}
+		rebuilt, err := newSegment(s.dir, baseOffset, l.Config)
+		if err != nil {
+			return err
+		}
+		l.segments[i] = rebuilt
+		// the rebuilt segment may hold different records than the old index pointed at
+		l.cache.reset()
+		l.records.reset()
+		if s == l.activeSegment {
+			l.activeSegment = rebuilt
+		} else {
+			if err = rebuilt.Seal(); err != nil {
+				return err
+			}
+			if err = l.handles.add(rebuilt); err != nil {
+				return err
+			}
+		}
+		if l.keys != nil {
+			if err = l.indexKeys(); err != nil {
+				return err
+			}
+		}
+		if l.producers != nil {
+			return l.indexProducers()
+		}
+		return nil
+	}
+	return segmentNotFound(baseOffset, os.ErrNotExist)
+}
+
+// RebuildIndexes rebuilds the indexes of the segments in the log at dir, and its
+// Config.Tier.ColdDir, that are missing or damaged, before the log is opened, and returns the
+// base offsets of those it rebuilt. An index is damaged if an entry is corrupt or out of order,
+// or the entries don't point at exactly the store's whole frames. Opening a log indexes the
+// frames past the last entry by itself, but fails on a corrupt entry and can't tell entries
+// that point at the wrong frames, so this is run before NewLog, e.g. by the server's -recover
+// mode. It takes the directory's lock, so it fails with ErrLocked while the log's open
+func RebuildIndexes(dir string, c Config) ([]uint64, error) {
+	c.setDefaults()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// a log that's yet to be created has nothing to rebuild
+		return nil, nil
+	}
+	lock, err := lockDir(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	var rebuilt []uint64
+	for _, d := range []string{dir, c.Tier.ColdDir} {
+		if d == "" {
+			continue
+		}
+		baseOffsets, err := segmentBases(d)
+		if err != nil {
+			return rebuilt, err
+		}
+		for _, baseOffset := range baseOffsets {
+			ok, err := indexIntact(d, baseOffset, c)
+			if err != nil {
+				return rebuilt, err
+			}
+			if ok {
+				continue
+			}
+			if err = rebuildIndex(d, baseOffset, c); err != nil {
+				return rebuilt, err
+			}
+			rebuilt = append(rebuilt, baseOffset)
+		}
+	}
+	return rebuilt, nil
+}
+
+// rebuildIndex writes a new index file for the store of the segment at baseOffset in dir,
+// replacing any it has, and truncates a partial frame off the store's end
+func rebuildIndex(dir string, baseOffset uint64, c Config) error {
+	// a damaged index may still record the order its store was written with
+	if recorded, err := c.recordedOrder(dir, baseOffset); err == nil {
+		c = recorded
+	}
+	st, err := c.storeFactory()(dir, baseOffset, c)
+	if err != nil {
+		return segmentNotFound(baseOffset, err)
+	}
+	defer st.Close()
+	positions, end, err := scanFrames(st, 0)
+	if err != nil {
+		return err
+	}
+	if end < st.Size() {
+		if err = st.Truncate(end); err != nil {
+			return err
+		}
+	}
+	name := c.segmentPath(dir, baseOffset, ".index")
+	f, err := c.openFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	idx, err := newIndex(f, c)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for i, pos := range positions {
+		if err = idx.Write(uint32(i), pos); err != nil {
+			idx.Close()
+			return err
+		}
+	}
+	// closing syncs the entries and shrinks the file to them
+	return idx.Close()
+}
+
+// indexIntact reports whether the index of the segment at baseOffset in dir has an entry for
+// each whole frame of its store, in order, and no others
+func indexIntact(dir string, baseOffset uint64, c Config) (bool, error) {
+	c.readOnly = true
+	c, err := c.recordedOrder(dir, baseOffset)
+	if err != nil {
+		// a bad header
+		return false, nil
+	}
+	st, err := c.storeFactory()(dir, baseOffset, c)
+	if err != nil {
+		return false, segmentNotFound(baseOffset, err)
+	}
+	defer st.Close()
+	positions, end, err := scanFrames(st, 0)
+	if err != nil {
+		return false, err
+	}
+	if end < st.Size() {
+		// a partial frame, which rebuilding truncates away
+		return false, nil
+	}
+	f, err := os.Open(c.segmentPath(dir, baseOffset, ".index"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	idx, err := newIndex(f, c)
+	if err != nil {
+		// an index too damaged to map, e.g. an empty file or a bad header
+		f.Close()
+		return false, nil
+	}
+	defer idx.Close()
+	if idx.entries() != uint64(len(positions)) {
+		return false, nil
+	}
+	if len(positions) == 0 {
+		return true, nil
+	}
+	entries, err := idx.ReadRange(0, int64(len(positions)))
+	if err != nil {
+		return false, nil
+	}
+	for i, e := range entries {
+		if uint64(e.Off) != uint64(i) || e.Pos != positions[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// scanFrames reads the store's frames from the from position on, returning the positions of the whole
+// ones and the end of the last. Whole frames are counted even if they don't decode, the
+// store holds them, and a read of the record reports what's wrong with it
+func scanFrames(st segmentStore, from uint64) ([]uint64, uint64, error) {
+	frames, err := st.Reader(from)
+	if err != nil {
+		return nil, 0, err
+	}
+	var positions []uint64
+	for {
+		pos := frames.pos
+		_, _, err := frames.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return positions, pos, nil
+		}
+		if err != nil && frames.pos == pos {
+			// the frame couldn't be read at all
+			return nil, 0, err
+		}
+		positions = append(positions, pos)
+	}
+}
@@ -1,9 +1,19 @@
 package log
 
 import (
+	"bytes"
+	"container/list"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	api "github.com/magus-1/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -11,45 +21,62 @@ import (
 
 // Segment wraps the index and store types to coordinate operations
 type segment struct {
-	store                  *store
+	// dir is the directory the segment's files are in, the log's or its cold directory
+	dir                    string
+	store                  segmentStore
 	index                  *index
 	baseOffset, nextOffset uint64
 	config                 Config
+	// bloom filters the keys of the segment's records with Config.Keys.Bloom, nil if it has none.
+	// bloomSaved is set once it's in the segment's filter file
+	bloom      *bloomFilter
+	bloomSaved bool
+	// lastRead is when the segment was last read, in unix nanos, zero if it hasn't been since
+	// it was opened. The log's own reads, e.g. of segments' newest records to age them, don't count
+	lastRead atomic.Int64
+
+	// handles closes the files of sealed segments that haven't been read in a while, nil if
+	// they're kept open. It guards the rest of the fields
+	handles *openSegments
+	tracked bool
+	// elem is the segment's place in handles' LRU list, nil while its files are closed
+	elem *list.Element
+	// refs is the # of reads holding the files open
+	refs int
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	// The log calls for a new segment (i.e. when the active segment hits max size)
+	c, err := c.recordedOrder(dir, baseOffset)
+	if err != nil {
+		return nil, err
+	}
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	var err error
 
-	// Open/Create the store file
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
-	if err != nil {
-		return nil, err
-	}
-	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+	// Open/Create the store
+	if s.store, err = c.storeFactory()(dir, baseOffset, c); err != nil {
+		return nil, segmentNotFound(baseOffset, err)
 	}
 
 	// Open/Create the index file
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0644,
-	)
+	flag := os.O_RDWR | os.O_CREATE
+	if c.readOnly {
+		flag = os.O_RDONLY
+	}
+	indexFile, err := c.openFile(c.segmentPath(dir, baseOffset, ".index"), flag)
 	if err != nil {
-		return nil, err
+		return nil, segmentNotFound(baseOffset, err)
 	}
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		// New index: the next record is the base offset
 		s.nextOffset = baseOffset
@@ -57,17 +84,158 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		// Existing index: the next record is current offset++
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	s.loadBloom()
 	return s, nil
 }
 
+// segmentName returns the name of the segment file with ext a new segment at baseOffset is
+// created with, its base offset padded to Config.Segment.NameWidth digits
+func (c Config) segmentName(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%0*d%s", c.Segment.NameWidth, baseOffset, ext)
+}
+
+// segmentPath returns the path of the segment file with ext at baseOffset in dir. That's the
+// existing file, whatever width its name was padded to, or segmentName for a new segment
+func (c Config) segmentPath(dir string, baseOffset uint64, ext string) string {
+	name := path.Join(dir, c.segmentName(baseOffset, ext))
+	if _, err := os.Stat(name); err == nil {
+		return name
+	}
+	// look for a name with a different width, e.g. one from before NameWidth was set
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return name
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) != ext {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err == nil && base == baseOffset {
+			return path.Join(dir, file.Name())
+		}
+	}
+	return name
+}
+
+// recover makes the index and store agree after a crash mid-append, or the loss of the index.
+// Index entries whose records didn't wholly reach the store are dropped, then the whole frames
+// past the last indexed record, whose appends crashed before indexing them or whose entries were
+// lost, are indexed again, and only a partial frame at the end of the store is truncated away.
+// Read-only segments only drop the entries, since a writer sharing the directory may be
+// buffering their records
+func (s *segment) recover() error {
+	end := uint64(0)
+	for {
+		_, pos, err := s.index.Read(-1)
+		if errors.Is(err, ErrCorruptIndex) {
+			// there's no telling where the last record ends, so don't truncate the store
+			return err
+		}
+		if err != nil {
+			break
+		}
+		_, err = s.store.Read(pos)
+		if err == nil || (err != io.EOF && err != io.ErrUnexpectedEOF) {
+			// the record is all there, even if it's corrupt
+			if end, err = s.frameEnd(pos); err != nil {
+				return err
+			}
+			break
+		}
+		s.index.size -= s.index.entWidth
+	}
+	if s.config.readOnly {
+		return nil
+	}
+	positions, end, err := scanFrames(s.store, end)
+	if err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		if err = s.index.Write(uint32(s.index.entries()), pos); err == io.EOF {
+			// the index is full, so the frames from here on can't be read
+			end = pos
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.store.Size() <= end {
+		return nil
+	}
+	return s.store.Truncate(end)
+}
+
+// frameEnd returns the store position just past the frame at pos
+func (s *segment) frameEnd(pos uint64) (uint64, error) {
+	f, err := newFraming(s.config)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, f.headerWidth())
+	if _, err = s.store.ReadAt(header, int64(pos)); err != nil {
+		return 0, err
+	}
+	return pos + f.headerWidth() + f.enc.Uint64(header[:lenWidth]), nil
+}
+
+// ErrRecordTooLarge is returned by appends of a record larger than Config.Segment.MaxRecordBytes
+var ErrRecordTooLarge = fmt.Errorf("record too large")
+
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	// Writes the record to the segment, returns the offset (the log will return offset through API)
-	cur := s.nextOffset
-	record.Offset = cur
+	record.Timestamp = s.config.clock().Now().UnixNano()
+	return s.write(record)
+}
+
+// write appends the record at the next offset, keeping its timestamp
+func (s *segment) write(record *api.Record) (offset uint64, err error) {
+	record.Offset = s.nextOffset
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	if offset, err = s.appendRaw(p); err != nil {
+		return 0, err
+	}
+	s.addKey(record.Key)
+	return offset, nil
+}
+
+// ErrOutOfOrder is returned with Config.Debug.VerifyOrdering for an append whose offset doesn't
+// follow the segment's last indexed one, or a read of a record indexed or stored with an
+// offset other than the one read
+var ErrOutOfOrder = fmt.Errorf("record out of order")
+
+// verifyNext checks that the next offset follows the offset of the last index entry
+func (s *segment) verifyNext() error {
+	want := s.baseOffset
+	off, _, err := s.index.Read(-1)
+	if err == nil {
+		want = s.baseOffset + uint64(off) + 1
+	} else if err != io.EOF {
+		return err
+	}
+	if s.nextOffset != want {
+		return fmt.Errorf("%w: appending at %d, the last indexed record is at %d", ErrOutOfOrder,
+			s.nextOffset, want-1)
+	}
+	return nil
+}
+
+// appendRaw appends p at the next offset as is, whether it's a marshaled record or not
+func (s *segment) appendRaw(p []byte) (offset uint64, err error) {
+	cur := s.nextOffset
+	if max := s.config.Segment.MaxRecordBytes; max > 0 && uint64(len(p)) > max {
+		return 0, fmt.Errorf("%w: %d bytes, the limit is %d", ErrRecordTooLarge, len(p), max)
+	}
+	if s.config.Debug.VerifyOrdering {
+		if err = s.verifyNext(); err != nil {
+			return 0, err
+		}
+	}
 
 	// Append data to the store
 	_, pos, err := s.store.Append(p)
@@ -87,34 +255,230 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	return cur, nil
 }
 
-func (s *segment) Read(off uint64) (*api.Record, error) {
-	// Return the record for the given offset
-	// Get the relative offset from the given absolute index
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
-	if err != nil {
-		return nil, err
+// AppendBatch appends records until the segment is maxed, returning the offsets of those it
+// appended so the log can continue the rest of the batch on a new segment
+func (s *segment) AppendBatch(records []*api.Record) ([]uint64, error) {
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		if s.IsMaxed() {
+			break
+		}
+		off, err := s.Append(record)
+		if err != nil {
+			return offsets, err
+		}
+		offsets = append(offsets, off)
 	}
+	return offsets, nil
+}
+
+func (s *segment) Read(off uint64) (*api.Record, error) {
+	s.touch()
+	return s.peek(off)
+}
 
+// peek reads the record at the given offset like Read, without recording it as the segment's
+// last read, for the log's bookkeeping
+func (s *segment) peek(off uint64) (*api.Record, error) {
 	// Read the record from the store
-	p, err := s.store.Read(pos)
+	p, err := s.readRaw(off)
 	if err != nil {
 		return nil, err
 	}
 
 	// Return as protobuf
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return record, err
+	}
+	return record, s.verifyRecord(off, record)
+}
+
+// touch records that the segment was read now
+func (s *segment) touch() {
+	s.lastRead.Store(s.config.clock().Now().UnixNano())
+}
+
+// LastRead returns when the segment was last read, the zero time if it hasn't been since it
+// was opened
+func (s *segment) LastRead() time.Time {
+	if n := s.lastRead.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// verifyRecord checks with Config.Debug.VerifyOrdering that the record read at off holds off
+func (s *segment) verifyRecord(off uint64, record *api.Record) error {
+	if s.config.Debug.VerifyOrdering && record.Offset != off {
+		return fmt.Errorf("%w: read %d, the record has offset %d", ErrOutOfOrder, off,
+			record.Offset)
+	}
+	return nil
+}
+
+// ReadRange returns up to n records from off on, fewer if the segment ends first. Their index
+// entries are looked up in one pass, then their frames, which are contiguous in the store, are
+// read with one read rather than one per record
+func (s *segment) ReadRange(off uint64, n int) ([]*api.Record, error) {
+	s.touch()
+	if err := s.handles.acquire(s); err != nil {
+		return nil, err
+	}
+	defer s.handles.release(s)
+	entries, err := s.index.ReadRange(int64(off-s.baseOffset), int64(n))
+	if err != nil {
+		return nil, err
+	}
+	first := entries[0].Pos
+	end, err := s.frameEnd(entries[len(entries)-1].Pos)
+	if err != nil {
+		return nil, err
+	}
+	if end < first || end > s.store.Size() {
+		// a corrupt length or position
+		return nil, io.ErrUnexpectedEOF
+	}
+	// store.ReadAt flushes any buffered appends
+	buf := make([]byte, end-first)
+	if _, err = s.store.ReadAt(buf, int64(first)); err != nil {
+		return nil, err
+	}
+	f, err := newFraming(s.config)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(buf)
+	records := make([]*api.Record, len(entries))
+	for j, e := range entries {
+		p, err := f.readFrame(r, e.Pos-first, uint64(len(buf)))
+		if err != nil {
+			return nil, err
+		}
+		records[j] = &api.Record{}
+		if err = proto.Unmarshal(p, records[j]); err != nil {
+			return nil, err
+		}
+		if s.config.Debug.VerifyOrdering && uint64(e.Off) != off-s.baseOffset+uint64(j) {
+			return nil, fmt.Errorf("%w: read %d, the index has it at %d", ErrOutOfOrder,
+				off+uint64(j), s.baseOffset+uint64(e.Off))
+		}
+		if err = s.verifyRecord(off+uint64(j), records[j]); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// ReadRaw returns the bytes stored at the given offset without unmarshaling them
+func (s *segment) ReadRaw(off uint64) ([]byte, error) {
+	s.touch()
+	return s.readRaw(off)
+}
+
+func (s *segment) readRaw(off uint64) ([]byte, error) {
+	if err := s.handles.acquire(s); err != nil {
+		return nil, err
+	}
+	defer s.handles.release(s)
+	// Get the relative offset from the given absolute index
+	rel, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Debug.VerifyOrdering && uint64(rel) != off-s.baseOffset {
+		return nil, fmt.Errorf("%w: read %d, the index has it at %d", ErrOutOfOrder, off,
+			s.baseOffset+uint64(rel))
+	}
+	return s.store.Read(pos)
+}
+
+// Position returns the store position of the record at the given offset
+func (s *segment) Position(off uint64) (uint64, error) {
+	if err := s.handles.acquire(s); err != nil {
+		return 0, err
+	}
+	defer s.handles.release(s)
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	return pos, err
+}
+
+// ErrPositionOutOfRange is returned by OffsetAt for a position past the end of the store
+var ErrPositionOutOfRange = fmt.Errorf("position out of range")
+
+// OffsetAt returns the offset of the record whose frame holds the store position pos, the
+// nearest whose position is at or before it, the inverse of Position. The index entries'
+// positions increase with their offsets, so it binary searches them
+func (s *segment) OffsetAt(pos uint64) (uint64, error) {
+	if err := s.handles.acquire(s); err != nil {
+		return 0, err
+	}
+	defer s.handles.release(s)
+	if size := s.store.Size(); pos >= size {
+		return 0, fmt.Errorf("%w: %d, the store is %d bytes", ErrPositionOutOfRange, pos, size)
+	}
+	var err error
+	// the first entry past pos
+	i := sort.Search(int(s.index.entries()), func(i int) bool {
+		e, rerr := s.index.ReadRange(int64(i), 1)
+		if rerr != nil {
+			err = rerr
+			return true
+		}
+		return e[0].Pos > pos
+	})
+	if err != nil {
+		return 0, err
+	}
+	if i == 0 {
+		// an empty index, or records the index lost
+		return 0, fmt.Errorf("%w: %d isn't indexed", ErrPositionOutOfRange, pos)
+	}
+	return s.baseOffset + uint64(i-1), nil
+}
+
+// Seal marks the segment as no longer taking appends, switching its store to unbuffered,
+// lock-free reads, and saves its key filter. The log seals each segment as it rolls over to
+// the next
+func (s *segment) Seal() error {
+	if err := s.store.Seal(); err != nil {
+		return err
+	}
+	return s.saveBloom()
+}
+
+// Flush writes the segment's buffered appends to its store file. It doesn't touch the files of
+// a segment with nothing buffered, such as a sealed one, so they're left closed if they are.
+// The index needs no flush, its entries are written to the file's mapping
+func (s *segment) Flush() error {
+	return s.store.Flush()
+}
+
+// Sync makes the segment's records durable, the store's before the index entries pointing at them
+func (s *segment) Sync() error {
+	if err := s.handles.acquire(s); err != nil {
+		return err
+	}
+	defer s.handles.release(s)
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
 }
 
 func (s *segment) IsMaxed() bool {
 	// Return true if either store or index are maxed out
 	// Notice that either can be filled first, depending on Config and logs
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	// the index is maxed once the next entry wouldn't fit
+	return s.store.Size() >= s.config.Segment.MaxStoreBytes ||
+		s.index.size+s.index.entWidth > s.config.Segment.MaxIndexBytes
 }
 
 func (s *segment) Close() error {
+	if s.handles.remove(s) {
+		// its files were closed when it was last evicted
+		return nil
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
@@ -131,10 +495,41 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.store.Remove(); err != nil {
 		return err
 	}
-	return nil
+	return s.removeBloom()
+}
+
+// releaseFiles closes a sealed segment's files, syncing them first so they can be left closed
+// indefinitely, the caller must hold handles.mu
+func (s *segment) releaseFiles() error {
+	if err := s.store.(*store).release(); err != nil {
+		return err
+	}
+	return s.index.release()
+}
+
+// reopenFiles opens the files releaseFiles closed again, the caller must hold handles.mu
+func (s *segment) reopenFiles() error {
+	if err := s.store.(*store).reopen(); err != nil {
+		return segmentNotFound(s.baseOffset, err)
+	}
+	return segmentNotFound(s.baseOffset, s.index.reopen())
+}
+
+// ErrSegmentNotFound is returned when a segment's files are missing, e.g. removed from under a
+// read-only log, a read-only log's directory has no segments to open, or the log has no
+// segment with the base offset asked for
+var ErrSegmentNotFound = fmt.Errorf("segment not found")
+
+// segmentNotFound wraps the error opening a file of the segment at baseOffset with
+// ErrSegmentNotFound if the file doesn't exist
+func segmentNotFound(baseOffset uint64, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %d: %w", ErrSegmentNotFound, baseOffset, err)
+	}
+	return err
 }
 
 func nearestMultiple(j, k uint64) uint64 {
@@ -1,13 +1,17 @@
 package log
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	api "github.com/magus-1/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -45,3 +49,258 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentMaxRecordBytes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-max-record-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// limit records to the size of the next one, whose offset takes 2 more bytes than the first's
+	got, err := s.Read(0)
+	require.NoError(t, err)
+	p, err := proto.Marshal(got)
+	require.NoError(t, err)
+	s.config.Segment.MaxRecordBytes = uint64(len(p)) + 2
+
+	// a record at the limit is appended
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	size := s.store.Size()
+
+	// one a byte over it isn't, and nothing reaches the store or index
+	_, err = s.Append(&api.Record{Value: []byte("hello world!")})
+	require.True(t, errors.Is(err, ErrRecordTooLarge))
+	require.Equal(t, size, s.store.Size())
+	require.Equal(t, uint64(2), s.nextOffset)
+	_, _, err = s.index.Read(2)
+	require.Error(t, err)
+}
+
+func TestSegmentReadRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-read-range-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Store.Compression = CompressionGzip
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		_, err = s.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	// the records, still buffered, match those read one at a time
+	records, err := s.ReadRange(18, 100)
+	require.NoError(t, err)
+	require.Len(t, records, 8)
+	for j, record := range records {
+		want, err := s.Read(uint64(18 + j))
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, record))
+	}
+	_, err = s.ReadRange(26, 1)
+	require.Equal(t, io.EOF, err)
+}
+
+func BenchmarkSegmentRange(b *testing.B) {
+	dir, err := ioutil.TempDir("", "segment-range-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	s, err := newSegment(dir, 0, c)
+	require.NoError(b, err)
+	defer s.Close()
+	const n = 1000
+	for i := 0; i < n; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	// a sealed segment whose files can be closed, so each read takes the handles' lock
+	require.NoError(b, s.Seal())
+	require.NoError(b, newOpenSegments(2).add(s))
+
+	b.Run("Read", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for off := uint64(0); off < n; off++ {
+				if _, err := s.Read(off); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("ReadRange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.ReadRange(0, n); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSegmentOffsetAt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-offset-at-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.OffsetAt(0)
+	require.ErrorIs(t, err, ErrPositionOutOfRange)
+
+	var positions []uint64
+	for i := 0; i < 5; i++ {
+		// records of different sizes
+		off, err := s.Append(&api.Record{Value: bytes.Repeat([]byte("a"), i*10)})
+		require.NoError(t, err)
+		pos, err := s.Position(off)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	for i, pos := range positions {
+		// a record's position maps back to its offset, as does any inside its frame
+		off, err := s.OffsetAt(pos)
+		require.NoError(t, err)
+		require.Equal(t, uint64(16+i), off)
+		if i > 0 {
+			off, err = s.OffsetAt(pos - 1)
+			require.NoError(t, err)
+			require.Equal(t, uint64(16+i-1), off)
+		}
+	}
+	off, err := s.OffsetAt(s.store.Size() - 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), off)
+	_, err = s.OffsetAt(s.store.Size())
+	require.ErrorIs(t, err, ErrPositionOutOfRange)
+}
+
+func TestSegmentRecordVersions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-record-versions-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// version 9 stands in for a schema older builds wrote, with the key and value as "key=value"
+	RegisterRecordDecoder(9, func(p []byte) (*api.Record, error) {
+		kv := bytes.SplitN(p, []byte("="), 2)
+		if len(kv) != 2 {
+			return nil, errors.New("no key")
+		}
+		return &api.Record{Key: kv[0], Value: kv[1]}, nil
+	})
+	defer delete(recordDecoders, 9)
+
+	// hand-written frames: one from before versions were recorded, one of version 9 and one of a
+	// version without a decoder
+	current, err := proto.Marshal(&api.Record{Value: []byte("unversioned")})
+	require.NoError(t, err)
+	var store []byte
+	var positions []uint64
+	for _, frame := range []struct {
+		version uint8
+		p       []byte
+	}{{0, current}, {9, []byte("k=old")}, {12, []byte("newer")}} {
+		positions = append(positions, uint64(len(store)))
+		tag := frame.version << versionShift
+		store = enc.AppendUint64(store, uint64(len(frame.p)))
+		store = enc.AppendUint32(store, checksum(tag, frame.p))
+		store = append(append(store, tag), frame.p...)
+	}
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.store"), store, 0644))
+	f, err := os.OpenFile(path.Join(dir, "0.index"), os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i, pos := range positions {
+		require.NoError(t, idx.Write(uint32(i), pos))
+	}
+	require.NoError(t, idx.Close())
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	record, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "unversioned", string(record.Value))
+	// the old record is migrated to the current schema
+	record, err = s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "k", string(record.Key))
+	require.Equal(t, "old", string(record.Value))
+	_, err = s.Read(2)
+	require.ErrorIs(t, err, ErrUnknownRecordVersion)
+
+	// new records are written with the current version
+	off, err := s.Append(&api.Record{Value: []byte("new")})
+	require.NoError(t, err)
+	pos, err := s.Position(off)
+	require.NoError(t, err)
+	record, err = s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(record.Value))
+	b, err := os.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, RecordVersion, b[pos+lenWidth+crcWidth]>>versionShift)
+}
+
+func TestSegmentVerifyOrdering(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-verify-ordering-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Debug.VerifyOrdering = true
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = s.Read(17)
+	require.NoError(t, err)
+
+	// a record stored with another offset than it's indexed at
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: 99})
+	require.NoError(t, err)
+	off, err := s.appendRaw(p)
+	require.NoError(t, err)
+	_, err = s.Read(off)
+	require.ErrorIs(t, err, ErrOutOfOrder)
+	_, err = s.ReadRange(16, 3)
+	require.ErrorIs(t, err, ErrOutOfOrder)
+
+	// an index entry with another offset than its place in the index
+	pos, err := s.Position(17)
+	require.NoError(t, err)
+	s.index.put(s.index.header+s.index.entWidth, s.index.offWidth, 5)
+	_, err = s.Read(17)
+	require.ErrorIs(t, err, ErrOutOfOrder)
+	_, err = s.ReadRange(17, 1)
+	require.ErrorIs(t, err, ErrOutOfOrder)
+
+	// and a last entry the next offset doesn't follow
+	require.NoError(t, s.index.Write(7, pos))
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrOutOfOrder)
+
+	// without verification the inconsistencies go unnoticed
+	s.config.Debug.VerifyOrdering = false
+	_, err = s.Read(17)
+	require.NoError(t, err)
+}
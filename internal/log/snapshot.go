@@ -0,0 +1,311 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshotManifest is the last entry of a snapshot, describing the segment files before it
+	snapshotManifest = "MANIFEST.json"
+	// restoreDir holds a snapshot's files while RestoreSnapshot checks them against its manifest
+	restoreDir = ".restore"
+)
+
+// manifest lists a snapshot's segments, oldest first
+type manifest struct {
+	Segments []manifestSegment `json:"segments"`
+}
+
+// manifestSegment describes a segment's files, so a restore can check it got them whole
+type manifestSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes uint64 `json:"store_bytes"`
+	StoreCRC32 uint32 `json:"store_crc32"`
+	IndexBytes uint64 `json:"index_bytes"`
+	IndexCRC32 uint32 `json:"index_crc32"`
+}
+
+// ErrInvalidSnapshot is returned by RestoreSnapshot for an archive that doesn't match its
+// manifest, wrapping what's wrong with it
+var ErrInvalidSnapshot = fmt.Errorf("invalid snapshot")
+
+// writes a tar archive of every segment's store and index files to w, oldest first, followed
+// by a manifest of their base offsets, sizes and checksums. Unlike Reader it keeps the indexes
+// and segment boundaries, so RestoreSnapshot only has to copy the files back. It holds the
+// read lock throughout, so appends wait for the snapshot to be written
+func (l *Log) Snapshot(w io.Writer) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	tw := tar.NewWriter(w)
+	// every file is stamped with the time of the snapshot
+	at := l.Config.clock().Now()
+	var m manifest
+	for _, s := range l.segments {
+		if err := writeSnapshotSegment(tw, s, &m, at); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err = writeSnapshotFile(tw, snapshotManifest, bytes.NewReader(b),
+		uint64(len(b)), at); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeSnapshotSegment writes s's store and index files to tw, modified at, and adds s to m
+func writeSnapshotSegment(tw *tar.Writer, s *segment, m *manifest, at time.Time) error {
+	if err := s.handles.acquire(s); err != nil {
+		return err
+	}
+	defer s.handles.release(s)
+	ms := manifestSegment{
+		BaseOffset: s.baseOffset,
+		NextOffset: s.nextOffset,
+		StoreBytes: s.store.Size(),
+		IndexBytes: s.index.size,
+	}
+	var err error
+	// store.ReadAt flushes any buffered appends
+	if ms.StoreCRC32, err = writeSnapshotFile(tw, storeName(s.baseOffset),
+		io.NewSectionReader(s.store, 0, int64(ms.StoreBytes)), ms.StoreBytes, at); err != nil {
+		return err
+	}
+	// only the entries in use, not the file's preallocated tail
+	if ms.IndexCRC32, err = writeSnapshotFile(tw, indexName(s.baseOffset),
+		io.NewSectionReader(s.index.file, 0, int64(ms.IndexBytes)), ms.IndexBytes, at); err != nil {
+		return err
+	}
+	m.Segments = append(m.Segments, ms)
+	return nil
+}
+
+// writeSnapshotFile writes the n bytes of r to tw as the file name, modified at, and returns
+// their checksum
+func writeSnapshotFile(tw *tar.Writer, name string, r io.Reader, n uint64, at time.Time) (
+	uint32, error) {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(n),
+		ModTime: at,
+	}); err != nil {
+		return 0, err
+	}
+	h := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), r, int64(n)); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// replaces the log's segments with those of a snapshot written by Snapshot. The archive is
+// unpacked alongside the log and checked against its manifest, that every file is listed and
+// has the listed size and checksum and that every segment holds the listed offsets, before
+// any segment is removed, so a truncated or corrupt snapshot leaves the log as it was.
+// Like Reset it holds the write lock throughout and removes the cold directory, the restored
+// segments all start out in the log's directory
+func (l *Log) RestoreSnapshot(r io.Reader) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	if _, ok := l.activeSegment.store.(*store); !ok {
+		return fmt.Errorf("restoring a snapshot needs file-backed stores")
+	}
+	tmp := path.Join(l.Dir, restoreDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := l.Config.mkdirAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	m, err := l.unpackSnapshot(tmp, r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	// swap the snapshot's segments in
+	if err = l.close(); err != nil {
+		return err
+	}
+	if err = l.removeColdDir(); err != nil {
+		return err
+	}
+	if err = removeSegments(l.Dir, math.MaxUint64, nil); err != nil {
+		return err
+	}
+	for _, ms := range m.Segments {
+		for _, ext := range []string{".store", ".index"} {
+			// the snapshot's names are unpadded, the log's may not be
+			if err = os.Rename(path.Join(tmp, fmt.Sprintf("%d%s", ms.BaseOffset, ext)),
+				path.Join(l.Dir, l.Config.segmentName(ms.BaseOffset, ext))); err != nil {
+				return err
+			}
+		}
+	}
+	if err = syncPath(l.Dir); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment, l.keys, l.producers = nil, nil, nil, nil
+	return l.setup()
+}
+
+// unpackSnapshot writes the files of the snapshot read from r to dir and returns its manifest,
+// once the files are durable and match it
+func (l *Log) unpackSnapshot(dir string, r io.Reader) (*manifest, error) {
+	tr := tar.NewReader(r)
+	sums := make(map[string]uint32)
+	sizes := make(map[string]uint64)
+	var m *manifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			return nil, fmt.Errorf("%s is followed by %s", snapshotManifest, hdr.Name)
+		}
+		if hdr.Name == snapshotManifest {
+			m = &manifest{}
+			if err = json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("%s: %w", snapshotManifest, err)
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || !segmentFileName(hdr.Name) {
+			return nil, fmt.Errorf("unexpected file %s", hdr.Name)
+		}
+		if _, ok := sums[hdr.Name]; ok {
+			return nil, fmt.Errorf("%s is in the snapshot twice", hdr.Name)
+		}
+		if sums[hdr.Name], sizes[hdr.Name], err = unpackFile(path.Join(dir, hdr.Name), tr,
+			l.Config); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("%s is missing", snapshotManifest)
+	}
+	if len(m.Segments) == 0 {
+		return nil, fmt.Errorf("%s lists no segments", snapshotManifest)
+	}
+	if len(sums) != 2*len(m.Segments) {
+		return nil, fmt.Errorf("%s lists %d segments for %d files",
+			snapshotManifest, len(m.Segments), len(sums))
+	}
+	if !sort.SliceIsSorted(m.Segments, func(i, j int) bool {
+		return m.Segments[i].BaseOffset < m.Segments[j].BaseOffset
+	}) {
+		return nil, fmt.Errorf("%s lists segments out of order", snapshotManifest)
+	}
+	for _, ms := range m.Segments {
+		if err := checkSnapshotFile(storeName(ms.BaseOffset), ms.StoreBytes, ms.StoreCRC32,
+			sizes, sums); err != nil {
+			return nil, err
+		}
+		if err := checkSnapshotFile(indexName(ms.BaseOffset), ms.IndexBytes, ms.IndexCRC32,
+			sizes, sums); err != nil {
+			return nil, err
+		}
+		if ms.IndexBytes > l.Config.Segment.MaxIndexBytes {
+			return nil, fmt.Errorf("segment %d's index is %d bytes, the limit is %d",
+				ms.BaseOffset, ms.IndexBytes, l.Config.Segment.MaxIndexBytes)
+		}
+		// open the segment read-only to check it holds the offsets the manifest says
+		c := l.Config
+		c.readOnly = true
+		s, err := newSegment(dir, ms.BaseOffset, c)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", ms.BaseOffset, err)
+		}
+		next := s.nextOffset
+		if err = s.Close(); err != nil {
+			return nil, err
+		}
+		if next != ms.NextOffset {
+			return nil, fmt.Errorf("segment %d ends at offset %d, the manifest says %d",
+				ms.BaseOffset, next, ms.NextOffset)
+		}
+	}
+	if err := syncPath(dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// unpackFile copies r to a new file at name with c's file mode, fsyncs it and returns its
+// checksum and size
+func unpackFile(name string, r io.Reader, c Config) (uint32, uint64, error) {
+	f, err := c.openFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return 0, 0, err
+	}
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+	return h.Sum32(), uint64(n), f.Close()
+}
+
+// checkSnapshotFile checks the unpacked file name has the size and checksum the manifest lists
+func checkSnapshotFile(name string, size uint64, sum uint32, sizes map[string]uint64,
+	sums map[string]uint32) error {
+	got, ok := sizes[name]
+	if !ok {
+		return fmt.Errorf("%s is missing", name)
+	}
+	if got != size {
+		return fmt.Errorf("%s is %d bytes, the manifest says %d", name, got, size)
+	}
+	if sums[name] != sum {
+		return fmt.Errorf("%s doesn't match its checksum", name)
+	}
+	return nil
+}
+
+// segmentFileName reports whether name is a segment's store or index file
+func segmentFileName(name string) bool {
+	ext := path.Ext(name)
+	if ext != ".store" && ext != ".index" {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	return err == nil
+}
+
+// storeName and indexName are a segment's file names with the plain base offset, those
+// snapshots always use whatever Config.Segment.NameWidth the log's files have
+func storeName(baseOffset uint64) string {
+	return fmt.Sprintf("%d%s", baseOffset, ".store")
+}
+
+func indexName(baseOffset uint64) string {
+	return fmt.Sprintf("%d%s", baseOffset, ".index")
+}
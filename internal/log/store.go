@@ -2,28 +2,225 @@ package log
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	enc = binary.BigEndian // defines the encoding for records
+	enc = binary.BigEndian // defines the default encoding for records
 )
 
 const (
-	lenWidth = 8 // # of bytes used to store the record's length
+	lenWidth   = 8 // # of bytes used to store the record's length
+	crcWidth   = 4 // # of bytes used to store the record's CRC32 checksum
+	codecWidth = 1 // # of bytes used to tag the record's compression codec and schema version
 )
 
+// ErrCorruptRecord is returned when a record's checksum doesn't match its payload
+var ErrCorruptRecord = fmt.Errorf("corrupt record")
+
+// ErrBackpressure is returned by appends while the active segment has Config.Store.MaxUnsyncedBytes
+// or more appended since it was last fsynced. Once a sync catches up, appends are taken again
+var ErrBackpressure = fmt.Errorf("too many unsynced appends")
+
+// errSealed is returned by appends to a sealed store
+var errSealed = fmt.Errorf("store is sealed")
+
+// segmentStore is the record storage behind a segment: store keeps records in a file,
+// memStore keeps them in memory for tests
+type segmentStore interface {
+	Append(p []byte) (n uint64, pos uint64, err error)
+	Read(pos uint64) ([]byte, error)
+	ReadAt(p []byte, off int64) (int, error)
+	Reader(pos uint64) (*storeReader, error)
+	Size() uint64
+	Stats() StoreStats
+	Name() string
+	// Seal flushes the store and stops it taking appends, once its segment is full
+	Seal() error
+	// Flush writes buffered appends to the file without fsyncing it
+	Flush() error
+	// Sync flushes buffered appends and fsyncs them
+	Sync() error
+	// Truncate drops the bytes past size, the partial frame a crash left at the end
+	Truncate(size uint64) error
+	Close() error
+	// Remove deletes a closed store's data
+	Remove() error
+}
+
+// storeFactory opens the store for the segment starting at baseOffset
+type storeFactory func(dir string, baseOffset uint64, c Config) (segmentStore, error)
+
+// openFileStore opens or creates the segment's store file in dir
+func openFileStore(dir string, baseOffset uint64, c Config) (segmentStore, error) {
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := c.openFile(c.segmentPath(dir, baseOffset, ".store"), flag)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(f, c)
+}
+
+// framing encodes records as [length][crc32][tag][payload], or as [length][payload]
+// for stores without checksums. The tag byte holds the codec in its low 4 bits and the
+// record's schema version, RecordVersion, in its high 4
+type framing struct {
+	checksum bool
+	enc      binary.ByteOrder
+	codec    Compression
+}
+
+func newFraming(c Config) (framing, error) {
+	if c.Store.DisableChecksum && c.Store.Compression != CompressionNone {
+		// the legacy framing has no codec tag to record the compression in
+		return framing{}, fmt.Errorf("compression requires checksummed records")
+	}
+	return framing{
+		checksum: !c.Store.DisableChecksum,
+		enc:      c.byteOrder(),
+		codec:    c.Store.Compression,
+	}, nil
+}
+
+// headerWidth returns the # of bytes written ahead of each record's payload
+func (f framing) headerWidth() uint64 {
+	if f.checksum {
+		return lenWidth + crcWidth + codecWidth
+	}
+	return lenWidth
+}
+
+// checksum covers the tag and the payload as stored
+func checksum(tag byte, p []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE([]byte{tag}), crc32.IEEETable, p)
+}
+
+// tag returns the tag byte new records are framed with
+func (f framing) tag() byte {
+	return RecordVersion<<versionShift | byte(f.codec)
+}
+
+// encode compresses p and frames it
+func (f framing) encode(p []byte) ([]byte, error) {
+	// compress before framing so the length and checksum describe the stored bytes
+	p, err := f.compress(p)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, f.headerWidth(), f.headerWidth()+uint64(len(p)))
+	f.enc.PutUint64(frame[:lenWidth], uint64(len(p)))
+	if f.checksum {
+		f.enc.PutUint32(frame[lenWidth:lenWidth+crcWidth], checksum(f.tag(), p))
+		frame[lenWidth+crcWidth] = f.tag()
+	}
+	return append(frame, p...), nil
+}
+
+// decode verifies a stored payload against its header, decompresses it and migrates it from
+// the schema version it was written with
+func (f framing) decode(header, p []byte) ([]byte, error) {
+	if !f.checksum {
+		return p, nil
+	}
+	tag := header[lenWidth+crcWidth]
+	if f.enc.Uint32(header[lenWidth:lenWidth+crcWidth]) != checksum(tag, p) {
+		return nil, ErrCorruptRecord
+	}
+	switch Compression(tag & (1<<versionShift - 1)) {
+	case CompressionNone:
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		if p, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrCorruptRecord
+	}
+	return migrate(tag>>versionShift, p)
+}
+
+// compress encodes p with the configured codec
+func (f framing) compress(p []byte) ([]byte, error) {
+	if f.codec != CompressionGzip {
+		return p, nil
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// readFrame reads the frame at pos from r, which holds size bytes, and decodes its payload
+func (f framing) readFrame(r io.ReaderAt, pos, size uint64) ([]byte, error) {
+	// the length (and checksum and codec) of data is read and saved to header
+	header := make([]byte, f.headerWidth())
+	if _, err := r.ReadAt(header, int64(pos)); err != nil {
+		return nil, err
+	}
+
+	// fetch the record, unless it runs past the end: a frame cut short by a crash or a
+	// corrupt length mustn't allocate whatever the length says
+	n := f.enc.Uint64(header[:lenWidth])
+	if n > size || pos+f.headerWidth()+n > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, int64(pos+f.headerWidth())); err != nil {
+		return nil, err
+	}
+
+	// verify the record against its checksum before returning it
+	return f.decode(header, b)
+}
+
 type store struct {
 	// Wrapper around a file with two APIs to append and read bytes
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	framing
+	mu sync.RWMutex
+	// buf is nil once the store is sealed, which read-only stores are from the start.
+	// A sealed store's file never changes, so it's read directly without locking
+	buf    *bufio.Writer
+	sealed atomic.Bool
+	// dirty is set while buf holds appends the file doesn't, so reads only take the write lock
+	// to flush when there's something to flush
+	dirty atomic.Bool
+	size  uint64
+	// synced is the size the file was last fsynced at, appends are rejected once size is
+	// maxUnsynced past it
+	synced, maxUnsynced uint64
+	syncMode            SyncMode
+	// preallocated is set while the file has blocks reserved past its end, see Config.Preallocate
+	preallocated bool
+	// err holds a background flush or sync failure until the next append or close returns it
+	err      error
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
 }
 
-func newStore(f *os.File) (*store, error) {
+func newStore(f *os.File, c Config) (*store, error) {
 	// Create the store
 	// check the file's size first (i.e. to continue using an existing store)
 	fi, err := os.Stat(f.Name())
@@ -31,11 +228,78 @@ func newStore(f *os.File) (*store, error) {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	framing, err := newFraming(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &store{
+		File:        f,
+		framing:     framing,
+		size:        size,
+		synced:      size,
+		maxUnsynced: c.Store.MaxUnsyncedBytes,
+		syncMode:    c.Store.Sync,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	if c.readOnly {
+		// there's nothing to buffer or sync
+		s.syncMode = SyncNone
+		s.sealed.Store(true)
+	} else {
+		s.buf = bufio.NewWriterSize(f, c.Store.BufferSize)
+		if c.Preallocate && size == 0 && c.Segment.MaxStoreBytes > 0 {
+			if err = preallocate(f, c.Segment.MaxStoreBytes); err != nil {
+				return nil, err
+			}
+			s.preallocated = true
+		}
+	}
+	switch {
+	case s.syncMode == SyncPeriodic:
+		interval := c.Store.SyncInterval
+		if interval == 0 {
+			interval = time.Second
+		}
+		go s.loop(interval, s.sync)
+	case s.syncMode == SyncNone && c.Store.FlushInterval > 0:
+		go s.loop(c.Store.FlushInterval, s.flushBuf)
+	default:
+		close(s.stopped)
+	}
+	return s, nil
+}
+
+// loop calls tick under the lock every interval until the store is sealed or closed,
+// keeping the first failure for the next append or close to return
+func (s *store) loop(interval time.Duration, tick func() error) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := tick(); err != nil && s.err == nil {
+				s.err = err
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// sync flushes the buffer and fsyncs the file, the caller must hold s.mu
+func (s *store) sync() error {
+	if err := s.flushBuf(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.synced = s.size
+	return nil
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
@@ -43,61 +307,360 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	pos = s.size // Knowing length of p makes it easier to read it later
+	if s.buf == nil {
+		return 0, 0, errSealed
+	}
+	if s.err != nil {
+		return 0, 0, s.err
+	}
+	if s.maxUnsynced > 0 && s.size-s.synced >= s.maxUnsynced {
+		return 0, 0, fmt.Errorf("%w: %d bytes since the last sync", ErrBackpressure, s.size-s.synced)
+	}
 
-	// Buffer the length of p to s.buf, to reduce number of system calls and improve performance
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// Frame p with its length, checksum and codec so Read can find its end,
+	// detect corruption and decompress it
+	frame, err := s.encode(p)
+	if err != nil {
 		return 0, 0, err
 	}
 
-	// write to the file, register number of bytes written to w
-	w, err := s.buf.Write(p)
+	// Buffer the frame to s.buf, to reduce number of system calls and improve performance.
+	// A frame that doesn't fit behind the buffered appends goes in after flushing them, so
+	// only a frame written straight through to the file can fail part way, and only it needs
+	// rolling back
+	if uint64(len(frame)) > uint64(s.buf.Available()) && s.buf.Buffered() > 0 {
+		if err = s.flushBuf(); err != nil {
+			return 0, 0, err
+		}
+	}
+	w, err := s.buf.Write(frame)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, s.rollback(pos, err)
 	}
 
-	w += lenWidth
-	s.size += uint64(w)
-	return uint64(w), pos, nil
+	n = uint64(w)
+	s.size += n
+	s.dirty.Store(true)
+
+	// make the record durable before reporting success
+	if s.syncMode == SyncOnAppend {
+		if err := s.sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, pos, nil
 }
 
-func (s *store) Read(pos uint64) ([]byte, error) {
+// rollback undoes the failed write of the frame at pos, which nothing else was buffered with:
+// the part of it that reached the file is truncated and the buffer, which keeps failing once a
+// write has, is reset, so the store carries on as if the append never happened. The file is
+// opened O_APPEND, so the next write lands at the truncated end. If the truncate fails too
+// the store keeps returning the error. The caller must hold s.mu
+func (s *store) rollback(pos uint64, err error) error {
+	s.buf.Reset(s.File)
+	s.dirty.Store(false)
+	if terr := s.File.Truncate(int64(pos)); terr != nil {
+		s.err = fmt.Errorf("%w, then rolling it back: %w", err, terr)
+		return s.err
+	}
+	return err
+}
+
+// flush writes buffered appends to the file under a short write lock, so reads can then
+// proceed concurrently under the read lock. With nothing buffered it doesn't take the lock:
+// an append that returned before the caller's read set dirty, so any record the read can be
+// looking for is already in the file
+func (s *store) flush() error {
+	if !s.dirty.Load() {
+		return nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.buf == nil {
+		// sealed since the caller checked
+		return nil
+	}
+	return s.flushBuf()
+}
 
-	// flush the buffer, writing any buffered data to the file
+// flushBuf writes buffered appends to the file, the caller must hold s.mu
+func (s *store) flushBuf() error {
+	if !s.dirty.Load() {
+		return nil
+	}
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return err
 	}
+	s.dirty.Store(false)
+	return nil
+}
 
-	// the length of data is read and saved to size
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+func (s *store) Read(pos uint64) ([]byte, error) {
+	if s.sealed.Load() {
+		return s.readFrame(s.File, pos, s.size)
 	}
-
-	// fetch and return the record
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	// flush the buffer, writing any buffered data to the file.
+	// Appends that land after the flush come after pos, so they can't affect this read
+	if err := s.flush(); err != nil {
 		return nil, err
 	}
-	return b, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readFrame(s.File, pos, s.size)
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if s.sealed.Load() {
+		return s.File.ReadAt(p, off)
+	}
+	if err := s.flush(); err != nil {
 		return 0, err
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.File.ReadAt(p, off)
 }
 
-func (s *store) Close() error {
+// Reader returns a storeReader that walks the records from pos to the current end of the store
+func (s *store) Reader(pos uint64) (*storeReader, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	err := s.buf.Flush()
+
+	// flush the buffer so the reader sees every appended record
+	if s.buf != nil {
+		if err := s.flushBuf(); err != nil {
+			return nil, err
+		}
+	}
+	return newStoreReader(s.File, s.framing, pos, s.size), nil
+}
+
+// Size returns the # of bytes appended to the store
+func (s *store) Size() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// StoreStats describes a segment's store
+type StoreStats struct {
+	// Size is the # of bytes appended, including those still buffered
+	Size uint64
+	// Buffered is the # of appended bytes not yet written to the file
+	Buffered uint64
+}
+
+// Stats returns the store's size and how much of it is buffered
+func (s *store) Stats() StoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := StoreStats{Size: s.size}
+	if s.buf != nil {
+		st.Buffered = uint64(s.buf.Buffered())
+	}
+	return st
+}
+
+// storeReader streams records sequentially, reading each frame's header then its payload
+type storeReader struct {
+	framing
+	r   *bufio.Reader
+	pos uint64
+	// size is where the store's frames end, zero for a stream whose length isn't known, e.g.
+	// another log's Reader
+	size uint64
+}
+
+// newStoreReader reads the frames in r from pos up to size
+func newStoreReader(r io.ReaderAt, f framing, pos, size uint64) *storeReader {
+	section := io.NewSectionReader(r, int64(pos), int64(size-pos))
+	return &storeReader{
+		framing: f,
+		r:       bufio.NewReader(section),
+		pos:     pos,
+		size:    size,
+	}
+}
+
+// Next returns the next record and its position, or io.EOF once the store is exhausted. A
+// frame whose length runs past the end, cut short by a crash or with a corrupt length, is
+// io.ErrUnexpectedEOF, without allocating whatever the length says
+func (r *storeReader) Next() (p []byte, pos uint64, err error) {
+	header := make([]byte, r.headerWidth())
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		// a clean EOF means we're between frames; anything else is a partial frame
+		return nil, 0, err
+	}
+	n := r.enc.Uint64(header[:lenWidth])
+	if r.size > 0 {
+		if end := r.pos + r.headerWidth(); n > r.size || end+n > r.size {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		p = make([]byte, n)
+		_, err = io.ReadFull(r.r, p)
+	} else {
+		// the buffer grows with what the stream holds rather than what the length says
+		var b bytes.Buffer
+		var copied int64
+		copied, err = io.CopyN(&b, r.r, int64(n))
+		if err == nil && uint64(copied) != n {
+			err = io.ErrUnexpectedEOF
+		}
+		p = b.Bytes()
+	}
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	pos = r.pos
+	r.pos += uint64(len(header) + len(p))
+	if p, err = r.decode(header, p); err != nil {
+		return nil, 0, err
+	}
+	return p, pos, nil
+}
+
+// Truncate shrinks the store to size bytes, flushing any buffered appends first
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf == nil {
+		return errSealed
+	}
+	if err := s.flushBuf(); err != nil {
+		return err
+	}
+	if size > s.size {
+		return fmt.Errorf("can't truncate store of %d bytes to %d", s.size, size)
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	if s.synced > size {
+		s.synced = size
+	}
+	return nil
+}
+
+// Flush writes buffered appends to the file, whatever the sync mode, so they can be read from
+// it, but leaves them in the OS's page cache rather than fsyncing them the way Sync does
+func (s *store) Flush() error {
+	if !s.dirty.Load() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.buf == nil {
+		return nil
+	}
+	return s.flushBuf()
+}
+
+// Sync flushes buffered appends and fsyncs the file, whatever the sync mode
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.buf == nil {
+		// sealed, everything's in the file already
+		return s.File.Sync()
+	}
+	return s.sync()
+}
+
+// Seal flushes the store, fsyncing it unless appends aren't synced, and drops its write buffer
+func (s *store) Seal() error {
+	s.stopOnce.Do(func() { close(s.done) })
+	<-s.stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf == nil {
+		return nil
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.flushBuf(); err != nil {
+		return err
+	}
+	if s.syncMode != SyncNone {
+		if err := s.File.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := s.releasePreallocated(); err != nil {
+		return err
+	}
+	s.buf = nil
+	s.sealed.Store(true)
+	return nil
+}
+
+// releasePreallocated hands back the blocks reserved past the end of the file, which a
+// truncate to its size frees, the caller must hold the write lock
+func (s *store) releasePreallocated() error {
+	if !s.preallocated {
+		return nil
+	}
+	if err := s.File.Truncate(int64(s.size)); err != nil {
+		return err
+	}
+	s.preallocated = false
+	return nil
+}
+
+func (s *store) Close() error {
+	// stop the background loop first, it needs the lock to finish a tick
+	s.stopOnce.Do(func() { close(s.done) })
+	<-s.stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.buf != nil {
+		if err := s.flushBuf(); err != nil {
+			return err
+		}
+		s.buf = nil
+	}
+	if err := s.releasePreallocated(); err != nil {
+		return err
+	}
+	return s.File.Close()
+}
+
+// release syncs and closes the sealed store's file, keeping its size, until reopen
+func (s *store) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.File.Sync(); err != nil {
 		return err
 	}
 	return s.File.Close()
 }
+
+// reopen opens the sealed store's file again after release, read-only since it's sealed
+func (s *store) reopen() error {
+	f, err := os.Open(s.Name())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.File = f
+	return nil
+}
+
+// Remove deletes the closed store's file
+func (s *store) Remove() error {
+	return os.Remove(s.Name())
+}
@@ -1,28 +1,34 @@
 package log
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth + codecWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_append_read_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -54,6 +60,11 @@ func testReadAt(t *testing.T, s *store) {
 		require.Equal(t, lenWidth, n)
 		off += int64(n)
 		size := enc.Uint64(b)
+		b = make([]byte, crcWidth+codecWidth)
+		n, err = s.ReadAt(b, off)
+		require.NoError(t, err)
+		require.Equal(t, crcWidth+codecWidth, n)
+		off += int64(n)
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -62,11 +73,363 @@ func testReadAt(t *testing.T, s *store) {
 		off += int64(n)
 	}
 }
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// flip a byte of the payload on disk
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+lenWidth+crcWidth+codecWidth))
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, int64(pos+lenWidth+crcWidth+codecWidth))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, ErrCorruptRecord, err)
+}
+
+func TestStoreDisableChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_disable_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Store.DisableChecksum = true
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	n, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write))+lenWidth, n)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"event":"page_view","user":"alice"}`), 100)
+	sizes := map[Compression]uint64{}
+	for _, codec := range []Compression{CompressionNone, CompressionGzip} {
+		f, err := ioutil.TempFile("", "store_compression_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		c := Config{}
+		c.Store.Compression = codec
+		s, err := newStore(f, c)
+		require.NoError(t, err)
+		_, pos, err := s.Append(payload)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), pos)
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, payload, read)
+		require.NoError(t, s.Close())
+		_, size, err := openFile(f.Name())
+		require.NoError(t, err)
+		sizes[codec] = uint64(size)
+	}
+	require.Less(t, sizes[CompressionGzip], sizes[CompressionNone])
+}
+
+func TestStoreMixedCompression(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_mixed_compression_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	_, plainPos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// reopen with gzip: old records keep their codec, new ones are compressed
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	c := Config{}
+	c.Store.Compression = CompressionGzip
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	_, gzipPos, err := s.Append(write)
+	require.NoError(t, err)
+	for _, pos := range []uint64{plainPos, gzipPos} {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	// legacy framing has nowhere to record the codec
+	c.Store.DisableChecksum = true
+	_, err = newStore(f, c)
+	require.Error(t, err)
+}
+
+func TestStoreByteOrder(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_byte_order_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Store.ByteOrder = binary.LittleEndian
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// the length prefix is written little endian
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	b := make([]byte, lenWidth)
+	_, err = f.ReadAt(b, int64(pos))
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(write)), binary.LittleEndian.Uint64(b))
+
+	// and reopening with the same order reads it back
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreReader(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_reader_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(append([]byte(nil), byte('a'+i)))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	r, err := s.Reader(0)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		p, pos, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte('a' + i)}, p)
+		require.Equal(t, positions[i], pos)
+	}
+	_, _, err = r.Next()
+	require.Equal(t, io.EOF, err)
+
+	// readers can start mid-store at a record's position
+	r, err = s.Reader(positions[1])
+	require.NoError(t, err)
+	p, _, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), p)
+}
+
+func TestStoreSync(t *testing.T) {
+	for _, tc := range []struct {
+		mode SyncMode
+		want int64
+	}{
+		// without syncing the record is still buffered when the process dies
+		{mode: SyncNone, want: 0},
+		{mode: SyncOnAppend, want: int64(width)},
+	} {
+		f, err := ioutil.TempFile("", "store_sync_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+		c := Config{}
+		c.Store.Sync = tc.mode
+		s, err := newStore(f, c)
+		require.NoError(t, err)
+		_, _, err = s.Append(write)
+		require.NoError(t, err)
+
+		// inspect the file through another handle, as a restarted process would
+		_, size, err := openFile(f.Name())
+		require.NoError(t, err)
+		require.Equal(t, tc.want, size)
+	}
+}
+
+func TestStoreSyncPeriodic(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_sync_periodic_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Store.Sync = SyncPeriodic
+	c.Store.SyncInterval = 10 * time.Millisecond
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, size, err := openFile(f.Name())
+		return err == nil && size == int64(width)
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, s.Close())
+	// closing twice doesn't panic stopping the sync loop
+	require.Error(t, s.Close())
+}
+
+func TestStoreFlushInterval(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_flush_interval_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Store.FlushInterval = 10 * time.Millisecond
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	// the record reaches the file without a read or close flushing it
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(f.Name())
+		return err == nil && len(b) == int(width)
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, s.Close())
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	for name, mode := range map[string]SyncMode{
+		"none":     SyncNone,
+		"onAppend": SyncOnAppend,
+		"periodic": SyncPeriodic,
+	} {
+		b.Run(name, func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_append_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			c := Config{}
+			c.Store.Sync = mode
+			s, err := newStore(f, c)
+			require.NoError(b, err)
+			defer s.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Append(write); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreReadAfterAppend(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_after_append_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// each read flushes the append before it, and only that
+	for i := uint64(0); i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		require.True(t, s.dirty.Load())
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		require.False(t, s.dirty.Load())
+		read, err = s.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_stats_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, _, err = s.Append(write)
+		require.NoError(t, err)
+	}
+	require.Equal(t, StoreStats{Size: 3 * width, Buffered: 3 * width}, s.Stats())
+
+	// a read flushes the buffer
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, StoreStats{Size: 3 * width}, s.Stats())
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, StoreStats{Size: 4 * width, Buffered: width}, s.Stats())
+}
+
+func BenchmarkStoreRead(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_read_bench")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(b, err)
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		_, _, err = s.Append(write)
+		require.NoError(b, err)
+	}
+	b.ResetTimer()
+	// no appends between reads, so only the first has anything to flush
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Read(uint64(i%100) * width); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStoreConcurrentReadWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_concurrent_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	// run with -race: readers and writers hammer the store at once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _, err := s.Append(write)
+				require.NoError(t, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				read, err := s.Read(0)
+				require.NoError(t, err)
+				require.Equal(t, write, read)
+				b := make([]byte, lenWidth)
+				_, err = s.ReadAt(b, 0)
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, width*401, s.size)
+	r, err := s.Reader(0)
+	require.NoError(t, err)
+	for i := 0; i < 401; i++ {
+		read, _, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
@@ -93,3 +456,148 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreBufferSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_buffer_size_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Store.BufferSize = 1 << 20
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	// far more than the default buffer holds stays buffered
+	const n = 1000
+	for i := uint64(0); i < n; i++ {
+		_, _, err = s.Append(write)
+		require.NoError(t, err)
+	}
+	require.Equal(t, StoreStats{Size: n * width, Buffered: n * width}, s.Stats())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+
+	// reads flush it
+	for i := uint64(0); i < n; i++ {
+		read, err := s.Read(i * width)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	require.NoError(t, s.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	read, err := s.Read((n - 1) * width)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStorePartialWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_partial_write_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	// appending like the log's stores, so writes after the rollback land at the new end
+	require.NoError(t, f.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	c := Config{}
+	// the smallest buffer, which every frame overflows
+	c.Store.BufferSize = 16
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, _, err = s.Append(write)
+		require.NoError(t, err)
+	}
+
+	// the file takes part of the next frame's payload, then fails
+	s.buf.Reset(&failingWriter{Writer: f, n: lenWidth + crcWidth + codecWidth + 4})
+	_, _, err = s.Append(bytes.Repeat(write, 4))
+	require.ErrorIs(t, err, errWriteFailed)
+	require.Equal(t, 2*width, s.Stats().Size)
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(2*width), fi.Size())
+
+	// the store carries on where the failed append started
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, 2*width, pos)
+	require.NoError(t, s.Close())
+	f, err = os.Open(f.Name())
+	require.NoError(t, err)
+	defer f.Close()
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	r := newStoreReader(f, s.framing, 0, uint64(fi.Size()))
+	for i := 0; i < 3; i++ {
+		read, _, err := r.Next()
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	_, _, err = r.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+var errWriteFailed = fmt.Errorf("write failed")
+
+// failingWriter writes the first n bytes it's given, then fails
+type failingWriter struct {
+	io.Writer
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.n {
+		w.n -= len(p)
+		return w.Writer.Write(p)
+	}
+	n, err := w.Writer.Write(p[:w.n])
+	w.n = 0
+	if err != nil {
+		return n, err
+	}
+	return n, errWriteFailed
+}
+
+// countingWriter counts the writes the store's buffer makes to its file
+type countingWriter struct {
+	io.Writer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+func BenchmarkStoreBufferSize(b *testing.B) {
+	for name, size := range map[string]int{
+		"default": 0,
+		"64KB":    64 << 10,
+		"1MB":     1 << 20,
+	} {
+		b.Run(name, func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_buffer_size_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			c := Config{}
+			c.Store.BufferSize = size
+			s, err := newStore(f, c)
+			require.NoError(b, err)
+			defer s.Close()
+			// Reset keeps the buffer's size
+			w := &countingWriter{Writer: f}
+			s.buf.Reset(w)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Append(write); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tmpExt marks a segment file being copied to the cold directory, until the copy is complete
+const tmpExt = ".tmp"
+
+// moves the oldest sealed segments whose newest record is older than Config.Tier.ColdAge to
+// Config.Tier.ColdDir, run on rollover while holding the write lock
+func (l *Log) enforceTiering() error {
+	cold, age := l.Config.Tier.ColdDir, l.Config.Tier.ColdAge
+	if cold == "" || age == 0 {
+		return nil
+	}
+	defer l.cache.reset()
+	for i, s := range l.segments[:len(l.segments)-1] {
+		if s.dir == cold || s.nextOffset == s.baseOffset {
+			continue
+		}
+		newest, err := s.peek(s.nextOffset - 1)
+		if err != nil {
+			return err
+		}
+		if l.Config.clock().Now().Sub(time.Unix(0, newest.Timestamp)) <= age {
+			// segments are ordered oldest first, so the rest stay too
+			break
+		}
+		if l.segments[i], err = l.moveCold(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moves the sealed segment's files to the cold directory and reopens it there. The files are
+// copied under temporary names then renamed, and only then are the originals removed, the
+// store first, so a crash part way through leaves a whole segment in one directory or the other
+func (l *Log) moveCold(s *segment) (*segment, error) {
+	st, ok := s.store.(*store)
+	if !ok {
+		return nil, fmt.Errorf("tiering needs file-backed stores")
+	}
+	cold := l.Config.Tier.ColdDir
+	if err := l.Config.mkdirAll(cold); err != nil {
+		return nil, err
+	}
+	storeDst := path.Join(cold, path.Base(st.Name()))
+	indexDst := path.Join(cold, path.Base(s.index.Name()))
+	err := copyFile(storeDst+tmpExt, st.Name(), st.Size(), l.Config)
+	if err == nil {
+		// only the entries in use, not the file's preallocated tail
+		err = copyFile(indexDst+tmpExt, s.index.Name(), s.index.size, l.Config)
+	}
+	if err == nil {
+		err = os.Rename(storeDst+tmpExt, storeDst)
+	}
+	if err == nil {
+		err = os.Rename(indexDst+tmpExt, indexDst)
+	}
+	if err == nil {
+		err = syncPath(cold)
+	}
+	if err != nil {
+		os.Remove(storeDst + tmpExt)
+		os.Remove(indexDst + tmpExt)
+		os.Remove(storeDst)
+		os.Remove(indexDst)
+		return nil, err
+	}
+
+	// the copies are durable, so the originals can go
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(st.Name()); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(s.index.Name()); err != nil {
+		return nil, err
+	}
+	// the segment's filter is rebuilt in cold, when it's reopened there
+	if err = s.removeBloom(); err != nil {
+		return nil, err
+	}
+	if err = syncPath(l.Dir); err != nil {
+		return nil, err
+	}
+	moved, err := newSegment(cold, s.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err = moved.Seal(); err != nil {
+		return nil, err
+	}
+	moved.lastRead.Store(s.lastRead.Load())
+	return moved, l.handles.add(moved)
+}
+
+// copyFile copies the first n bytes of src to a new file dst with c's file mode and fsyncs it
+func copyFile(dst, src string, n uint64, c Config) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(dst, in, n, c)
+}
+
+// writeFile copies the first n bytes of r to a new file dst with c's file mode and fsyncs it
+func writeFile(dst string, r io.Reader, n uint64, c Config) error {
+	out, err := c.openFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(out, r, int64(n)); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// finishTiering cleans up after a move to coldDir that a crash interrupted: partial copies are
+// removed, as are whole copies of segments whose store is still in dir, and leftover indexes
+// and key filters in dir of segments whose store was removed once they'd moved
+func finishTiering(dir, coldDir string) error {
+	if coldDir == "" {
+		return nil
+	}
+	files, err := os.ReadDir(coldDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			if err = os.Remove(path.Join(coldDir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if path.Ext(name) != ".store" {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".store")
+		if _, err = strconv.ParseUint(base, 10, 64); err != nil {
+			continue
+		}
+		if _, err = os.Stat(path.Join(dir, name)); err == nil {
+			// the move didn't get as far as removing the original
+			if err = os.Remove(path.Join(coldDir, name)); err != nil {
+				return err
+			}
+			if err = os.Remove(path.Join(coldDir, base+".index")); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		for _, ext := range []string{".index", bloomExt} {
+			if err = os.Remove(path.Join(dir, base+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removes the segments in the cold directory, leaving the partitions' alone. The caller must
+// hold the write lock
+func (l *Log) removeColdDir() error {
+	cold := l.Config.Tier.ColdDir
+	if cold == "" {
+		return nil
+	}
+	files, err := os.ReadDir(cold)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		// the partitions' cold segments are theirs
+		if file.Name() == partitionsDir {
+			continue
+		}
+		if err = os.RemoveAll(path.Join(cold, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
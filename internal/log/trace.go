@@ -0,0 +1,43 @@
+package log
+
+import (
+	"context"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer the log's spans come from
+const tracerName = "github.com/magus-1/proglog/internal/log"
+
+// noopSpan stands in for spans when there's no tracer provider. It's shared, so untraced
+// appends and reads don't allocate spans or contexts
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// startSpan starts a span as a child of any span in ctx, if the log has a tracer provider
+func (l *Log) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if l.Config.TracerProvider == nil {
+		return ctx, noopSpan
+	}
+	return l.Config.TracerProvider.Tracer(tracerName).Start(ctx, name)
+}
+
+// endSpan records the record's offset, size and segment and any error on span, then ends it
+func endSpan(span trace.Span, record *api.Record, segmentBase uint64, err error) {
+	if !span.IsRecording() {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(
+			attribute.Int64("proglog.offset", int64(record.Offset)),
+			attribute.Int("proglog.record_bytes", len(record.Value)),
+			attribute.Int64("proglog.segment_base", int64(segmentBase)),
+		)
+	}
+	span.End()
+}
@@ -0,0 +1,61 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VerifyError describes a record that failed verification
+type VerifyError struct {
+	Offset uint64
+	// Segment is the base offset of the segment holding the record
+	Segment uint64
+	// Pos is the record's position in the segment's store
+	Pos uint64
+	Err error
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("offset %d (segment %d, position %d): %s", e.Offset, e.Segment, e.Pos, e.Err)
+}
+
+func (e VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// reads every record in the log, checking its checksum (unless checksums are disabled), its
+// index entry's checksum (if the index has them), that it decodes and that it holds the offset the index has it at. Bad records are reported
+// rather than stopping the scan, so the result covers the whole log. The returned error is for
+// failures that stop the scan, like an unreadable index.
+// Appends wait for the scan to finish, so it's best run when the log is quiet
+func (l *Log) Verify() ([]VerifyError, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var bad []VerifyError
+	for _, s := range l.segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			pos, err := s.Position(off)
+			if errors.Is(err, ErrCorruptIndex) {
+				// the record's position is unknown, but the scan can go on
+				bad = append(bad, VerifyError{Offset: off, Segment: s.baseOffset, Err: err})
+				continue
+			}
+			if err != nil {
+				return bad, err
+			}
+			record, err := s.peek(off)
+			if err == nil && record.Offset != off {
+				err = fmt.Errorf("record has offset %d", record.Offset)
+			}
+			if err != nil {
+				bad = append(bad, VerifyError{
+					Offset:  off,
+					Segment: s.baseOffset,
+					Pos:     pos,
+					Err:     err,
+				})
+			}
+		}
+	}
+	return bad, nil
+}
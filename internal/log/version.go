@@ -0,0 +1,62 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// RecordVersion is the schema version of api.Record that new records are written with. It's
+// kept in each frame's tag byte next to the codec, so records written with an older schema can
+// be told apart and decoded with the RecordDecoder registered for theirs. Bump it, and
+// register a decoder for the old version, when api.Record changes in a way the old encoding
+// can't be unmarshaled into
+const RecordVersion uint8 = 1
+
+// maxRecordVersion is the highest version the tag byte has room for
+const maxRecordVersion = 0xf
+
+// versionShift is where the version sits in a frame's tag byte, above the codec
+const versionShift = 4
+
+// ErrUnknownRecordVersion is returned for a record written with a schema version that has no
+// registered decoder, e.g. by a newer build of the log
+var ErrUnknownRecordVersion = fmt.Errorf("unknown record version")
+
+// RecordDecoder decodes the payload of a record written with an older schema version into the
+// current api.Record, migrating its fields as need be
+type RecordDecoder func(p []byte) (*api.Record, error)
+
+// recordDecoders are the decoders of the schema versions other than RecordVersion. Version 0
+// is records written before frames recorded their version, or without checksums, which have
+// no tag byte to record it in. They have the current schema, so they're read as they are
+var recordDecoders = map[uint8]RecordDecoder{}
+
+// RegisterRecordDecoder registers the decoder for records written with an old schema version,
+// which reads then migrate to the current api.Record as they decode them. Rewriting the
+// records, e.g. by compacting the log, writes them with RecordVersion. It isn't safe to call
+// concurrently with reads, so register decoders in an init function
+func RegisterRecordDecoder(version uint8, decode RecordDecoder) {
+	if version == 0 || version == RecordVersion || version > maxRecordVersion {
+		panic(fmt.Sprintf("log: can't register a decoder for record version %d", version))
+	}
+	recordDecoders[version] = decode
+}
+
+// migrate returns the payload of a record written with version as a payload of the current
+// version, decoding it with the version's decoder and marshaling the record it returns
+func migrate(version uint8, p []byte) ([]byte, error) {
+	if version == 0 || version == RecordVersion {
+		return p, nil
+	}
+	decode, ok := recordDecoders[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownRecordVersion, version)
+	}
+	record, err := decode(p)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(record)
+}
@@ -0,0 +1,142 @@
+package membership
+
+import (
+	"errors"
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// rpcAddrTag is the Serf tag each member advertises its RPC address under
+const rpcAddrTag = "rpc_addr"
+
+// Handler is told as members join and leave the cluster, e.g. to add and remove Raft voters.
+// DistributedLog implements it
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+type Config struct {
+	// NodeName identifies the member in the cluster and must be unique
+	NodeName string
+	// BindAddr is the host:port Serf gossips on
+	BindAddr string
+	// RPCAddr is the address peers connect to for the member's RPCs, passed to the handler
+	RPCAddr string
+	// StartJoinAddrs are the Serf addresses of existing members to join through.
+	// The cluster's first member leaves it empty
+	StartJoinAddrs []string
+}
+
+// Membership tracks the cluster's members with Serf, calling its handler as they come and go
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+// New starts a member and joins the cluster through config.StartJoinAddrs
+func New(handler Handler, config Config) (*Membership, error) {
+	m := &Membership{
+		Config:  config,
+		handler: handler,
+		logger:  zap.L().Named("membership"),
+	}
+	if err := m.setupSerf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = map[string]string{
+		rpcAddrTag: m.RPCAddr,
+	}
+	config.NodeName = m.NodeName
+	if m.serf, err = serf.Create(config); err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		if _, err = m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventHandler passes Serf's member events to the handler until Serf shuts down
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(member.Name, member.Tags[rpcAddrTag]); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns a point-in-time snapshot of the cluster's members
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the cluster the member is leaving and shuts Serf down
+func (m *Membership) Leave() error {
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
+}
+
+// logError logs a handler failure. Only the leader can change Raft's membership, so
+// followers' failures are expected and only logged at debug
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	log := m.logger.Error
+	if errors.Is(err, raft.ErrNotLeader) {
+		log = m.logger.Debug
+	}
+	log(msg, zap.Error(err), zap.String("name", member.Name), zap.String(rpcAddrTag, member.Tags[rpcAddrTag]))
+}
@@ -0,0 +1,86 @@
+package membership
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// the distributed log adds and removes Raft voters as members join and leave
+var _ Handler = (*log.DistributedLog)(nil)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	// the first member's handler hears about the two that joined
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+	join := <-handler.joins
+	require.Equal(t, "1", join["id"])
+	require.Equal(t, m[1].RPCAddr, join["addr"])
+
+	require.NoError(t, m[2].Leave())
+	require.Eventually(t, func() bool {
+		return len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "2", <-handler.leaves)
+}
+
+func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+	t.Helper()
+	id := len(members)
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		RPCAddr:  fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Leave() })
+	return append(members, m), h
+}
+
+// freePort returns a port nothing is listening on, for Serf to gossip on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// handler records the joins and leaves it's told about
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{"id": id, "addr": addr}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
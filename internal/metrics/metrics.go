@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics records the log's activity as Prometheus metrics, implementing log.Metrics
+type Metrics struct {
+	appends       prometheus.Counter
+	reads         prometheus.Counter
+	appendLatency prometheus.Histogram
+	readLatency   prometheus.Histogram
+	segments      prometheus.Gauge
+	storeBytes    prometheus.Gauge
+}
+
+// New creates the log's metrics and registers them with reg
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		appends: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_appends_total",
+			Help: "Total records appended to the log.",
+		}),
+		reads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_reads_total",
+			Help: "Total records read from the log.",
+		}),
+		appendLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_append_duration_seconds",
+			Help:    "Latency of appending a record to the log.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		readLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_read_duration_seconds",
+			Help:    "Latency of reading a record from the log.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		segments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proglog_segments",
+			Help: "Number of segments in the log.",
+		}),
+		storeBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "proglog_store_bytes",
+			Help: "Total bytes in the log's stores.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{
+		m.appends,
+		m.reads,
+		m.appendLatency,
+		m.readLatency,
+		m.segments,
+		m.storeBytes,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+var (
+	defaultOnce    sync.Once
+	defaultMetrics *Metrics
+)
+
+// Default returns the metrics registered with the default Prometheus registry,
+// registering them on the first call
+func Default() *Metrics {
+	defaultOnce.Do(func() {
+		var err error
+		if defaultMetrics, err = New(prometheus.DefaultRegisterer); err != nil {
+			// only a name clash with another collector can fail, which is a programming error
+			panic(err)
+		}
+	})
+	return defaultMetrics
+}
+
+func (m *Metrics) ObserveAppend(d time.Duration) {
+	m.appends.Inc()
+	m.appendLatency.Observe(d.Seconds())
+}
+
+func (m *Metrics) ObserveRead(d time.Duration) {
+	m.reads.Inc()
+	m.readLatency.Observe(d.Seconds())
+}
+
+func (m *Metrics) SetSegments(n int) {
+	m.segments.Set(float64(n))
+}
+
+func (m *Metrics) SetStoreBytes(n uint64) {
+	m.storeBytes.Set(float64(n))
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := New(prometheus.NewRegistry())
+	require.NoError(t, err)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Metrics = m
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, float64(1), testutil.ToFloat64(m.segments))
+
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = l.Read(0)
+	require.NoError(t, err)
+
+	require.Equal(t, float64(3), testutil.ToFloat64(m.appends))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.reads))
+	require.Equal(t, 1, testutil.CollectAndCount(m.appendLatency))
+	// each record fills a segment, so every append rolls over
+	require.Equal(t, float64(4), testutil.ToFloat64(m.segments))
+	require.Greater(t, testutil.ToFloat64(m.storeBytes), float64(0))
+
+	// truncating reports the smaller log
+	require.NoError(t, l.Truncate(2))
+	require.Equal(t, float64(2), testutil.ToFloat64(m.segments))
+}
+
+func TestNewRegistersOnce(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	_, err := New(reg)
+	require.NoError(t, err)
+	_, err = New(reg)
+	require.Error(t, err)
+}
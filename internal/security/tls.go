@@ -0,0 +1,54 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig names the files to build a *tls.Config from
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CAFile may hold several PEM certificates, so a new CA can be added ahead of rotating to it
+	CAFile        string
+	ServerAddress string
+	// Server requires and verifies client certificates against the CAs;
+	// otherwise the CAs verify the server's certificate
+	Server bool
+}
+
+// SetupTLSConfig builds a *tls.Config for mutual TLS from cfg
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	var err error
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		tlsConfig.Certificates = make([]tls.Certificate, 1)
+		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(
+			cfg.CertFile,
+			cfg.KeyFile,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
+		}
+		if cfg.Server {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = ca
+		}
+		tlsConfig.ServerName = cfg.ServerAddress
+	}
+	return tlsConfig, nil
+}
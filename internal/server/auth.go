@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// objectWildcard is the object LogService calls are authorized against, the whole log
+	objectWildcard = "*"
+	produceAction  = "produce"
+	consumeAction  = "consume"
+)
+
+// methodActions maps each LogService method to the action it's authorized as
+var methodActions = map[string]string{
+	"/" + api.LogService_ServiceDesc.ServiceName + "/Produce":       produceAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/ProduceStream": produceAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/Consume":       consumeAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/ConsumeStream": consumeAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/ConsumeBatch":  consumeAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/CommitOffset":  consumeAction,
+	"/" + api.LogService_ServiceDesc.ServiceName + "/FetchOffset":   consumeAction,
+}
+
+// AuthInterceptors returns server options that check every LogService call with the
+// authorizer, as produce or consume on the whole log. The caller is identified by the bearer
+// token in its authorization metadata, looked up in tokens (token to subject), or else by the
+// common name of its verified client certificate. Callers with neither get codes.Unauthenticated.
+// Other services, like health checks, and GetServers, which producers and consumers alike need
+// to find the leader, aren't authorized
+func AuthInterceptors(authorizer auth.Authorizer, tokens map[string]string) []grpc.ServerOption {
+	authorize := func(ctx context.Context, method string) error {
+		action, ok := methodActions[method]
+		if !ok {
+			return nil
+		}
+		subject, err := authenticate(ctx, tokens)
+		if err != nil {
+			return err
+		}
+		return authorizer.Authorize(subject, objectWildcard, action)
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// authenticate returns the subject of the caller from its bearer token or client certificate
+func authenticate(ctx context.Context, tokens map[string]string) (string, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token, ok := strings.CutPrefix(values[0], "Bearer ")
+			if !ok {
+				return "", status.Error(codes.Unauthenticated, "authorization isn't a bearer token")
+			}
+			subject, ok := tokens[token]
+			if !ok {
+				return "", status.Error(codes.Unauthenticated, "unknown bearer token")
+			}
+			return subject, nil
+		}
+	}
+	if cn, ok := clientCommonName(ctx); ok {
+		return cn, nil
+	}
+	return "", status.Error(codes.Unauthenticated, "no bearer token or client certificate")
+}
+
+// clientCommonName returns the common name of the caller's verified client certificate
+func clientCommonName(ctx context.Context) (string, bool) {
+	if p, ok := peer.FromContext(ctx); ok && p.AuthInfo != nil {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok &&
+			len(tlsInfo.State.VerifiedChains) > 0 {
+			return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName, true
+		}
+	}
+	return "", false
+}
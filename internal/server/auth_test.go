@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// writeTestFile writes contents to a temporary file, returning its name
+func writeTestFile(t *testing.T, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "auth")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+// newTestAuthorizer lets producer produce and nobody consume
+func newTestAuthorizer(t *testing.T) auth.Authorizer {
+	t.Helper()
+	a, err := auth.NewFileAuthorizer(writeTestFile(t, "producer,*,produce\n"))
+	require.NoError(t, err)
+	return a
+}
+
+func TestAuthInterceptors(t *testing.T) {
+	client, _, teardown := setupTest(t, AuthInterceptors(newTestAuthorizer(t), map[string]string{
+		"producer-token": "producer",
+		"consumer-token": "consumer",
+	})...)
+	defer teardown()
+	as := func(token string) context.Context {
+		if token == "" {
+			return context.Background()
+		}
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	record := &api.Record{Value: []byte("hello world")}
+
+	// an allowed producer
+	_, err := client.Produce(as("producer-token"), &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+
+	// a denied consumer, over both calls
+	_, err = client.Consume(as("consumer-token"), &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := client.ConsumeStream(as("consumer-token"), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Produce(as("consumer-token"), &api.ProduceRequest{Record: record})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// unauthenticated requests
+	for _, token := range []string{"", "unknown-token"} {
+		_, err = client.Produce(as(token), &api.ProduceRequest{Record: record})
+		require.Equal(t, codes.Unauthenticated, status.Code(err), token)
+	}
+}
+
+func TestAuthInterceptorsClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	opts := append(
+		AuthInterceptors(newTestAuthorizer(t), nil),
+		grpc.Creds(credentials.NewTLS(ca.tlsConfig("server", true))),
+	)
+	server, err := NewGRPCServer(newTLSTestLog(t), opts...)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	// the subject is the certificate's common name
+	produce := func(commonName string) error {
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(ca.tlsConfig(commonName, false))),
+		)
+		require.NoError(t, err)
+		defer cc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = api.NewLogServiceClient(cc).Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce("producer"))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce("consumer")))
+}
+
+func TestAuthInterceptorsACL(t *testing.T) {
+	acl, err := auth.New(
+		writeTestFile(t, `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`),
+		writeTestFile(t, "p, reader, *, consume\n"),
+	)
+	require.NoError(t, err)
+	client, _, teardown := setupTest(t, AuthInterceptors(acl, map[string]string{
+		"reader-token": "reader",
+	})...)
+	defer teardown()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer reader-token")
+
+	// the reader may only consume
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	srv, _ := setupHTTPTest(t)
+	defer srv.Shutdown(context.Background())
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	basicAuth, err := NewBasicAuth(map[string]string{"alice": string(hash)})
+	require.NoError(t, err)
+	handler := basicAuth.Middleware(srv.Handler)
+	serve := func(r *http.Request, user, password string) *httptest.ResponseRecorder {
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+	produce := func(user, password string) *httptest.ResponseRecorder {
+		b, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+		return serve(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b)), user, password)
+	}
+
+	// the right credentials get through
+	require.Equal(t, http.StatusOK, produce("alice", "secret").Code)
+	rec := serve(httptest.NewRequest(http.MethodGet, "/records", nil), "alice", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// a wrong password, an unknown user or no credentials are challenged
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}, {"", ""}} {
+		rec = produce(creds[0], creds[1])
+		require.Equal(t, http.StatusUnauthorized, rec.Code, creds)
+		require.Equal(t, `Basic realm="proglog", charset="UTF-8"`, rec.Header().Get("WWW-Authenticate"))
+	}
+	rec = serve(httptest.NewRequest(http.MethodGet, "/records", nil), "", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = serve(httptest.NewRequest(http.MethodGet, "/offsets/a", nil), "", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// probes don't need credentials
+	rec = serve(httptest.NewRequest(http.MethodGet, "/healthz", nil), "", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// only hashes are accepted in the config
+	_, err = NewBasicAuth(map[string]string{"alice": "secret"})
+	require.Error(t, err)
+}
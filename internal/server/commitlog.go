@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+)
+
+// CommitLog is the log the servers serve. *log.Log implements it, and so can fakes in tests
+// or a replicated log
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+var _ CommitLog = (*log.Log)(nil)
+
+// contextLog is implemented by logs whose appends and reads give up once a call's context is done
+type contextLog interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
+}
+
+// offsetLog is implemented by logs that keep consumer groups' committed offsets
+type offsetLog interface {
+	CommitOffset(group string, offset uint64) error
+	FetchOffset(group string) (uint64, error)
+}
+
+// errNoOffsets is returned for offset commits and fetches to a log that doesn't keep them
+var errNoOffsets = fmt.Errorf("the log doesn't keep consumer offsets")
+
+// commitOffset records the group's offset if the log keeps offsets
+func commitOffset(l CommitLog, group string, offset uint64) error {
+	ol, ok := l.(offsetLog)
+	if !ok {
+		return errNoOffsets
+	}
+	return ol.CommitOffset(group, offset)
+}
+
+// fetchOffset returns the group's committed offset if the log keeps offsets
+func fetchOffset(l CommitLog, group string) (uint64, error) {
+	ol, ok := l.(offsetLog)
+	if !ok {
+		return 0, errNoOffsets
+	}
+	return ol.FetchOffset(group)
+}
+
+// idempotentLog is implemented by logs that deduplicate retried produces by producer sequence #
+type idempotentLog interface {
+	AppendIdempotent(*api.Record) (uint64, error)
+}
+
+// errNoIdempotence is returned for idempotent produces to a log that doesn't deduplicate them
+var errNoIdempotence = fmt.Errorf("the log doesn't deduplicate produces")
+
+// appendIdempotent appends a record the producer gave the sequence #, returning the offset it
+// was first given if it's a retry, if the log deduplicates produces
+func appendIdempotent(ctx context.Context, l CommitLog, producer string, sequence uint64,
+	record *api.Record) (uint64, error) {
+	il, ok := l.(idempotentLog)
+	if !ok {
+		return 0, errNoIdempotence
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if record == nil {
+		return 0, fmt.Errorf("%w: no record", log.ErrInvalidRecord)
+	}
+	record.ProducerId, record.Sequence = producer, sequence
+	return il.AppendIdempotent(record)
+}
+
+// segmentLog is implemented by logs that describe their segments
+type segmentLog interface {
+	Segments() []log.SegmentInfo
+}
+
+// emptyLog is implemented by logs that report whether they hold any records
+type emptyLog interface {
+	Empty() bool
+}
+
+// partitionedLog is implemented by logs that host partitions, independent logs of their own
+type partitionedLog interface {
+	Partition(name string) (*log.Log, error)
+	LookupPartition(name string) (*log.Log, error)
+}
+
+// errNoPartitions is returned for requests to a partition of a log that doesn't host them
+var errNoPartitions = fmt.Errorf("the log doesn't host partitions")
+
+// partition returns the log of the named partition to read from if the log hosts partitions,
+// or the log itself for no name. Only produces create partitions, so a read of one that
+// hasn't been produced to is NOT_FOUND
+func partition(l CommitLog, name string) (CommitLog, error) {
+	return openPartition(l, name, false)
+}
+
+// producePartition returns the log of the named partition to append to like partition,
+// creating the partition if it doesn't exist
+func producePartition(l CommitLog, name string) (CommitLog, error) {
+	return openPartition(l, name, true)
+}
+
+func openPartition(l CommitLog, name string, create bool) (CommitLog, error) {
+	if name == "" {
+		return l, nil
+	}
+	pl, ok := l.(partitionedLog)
+	if !ok {
+		return nil, errNoPartitions
+	}
+	open := pl.LookupPartition
+	if create {
+		open = pl.Partition
+	}
+	p, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// healthLog is implemented by logs that report their health, the others are always healthy
+type healthLog interface {
+	Ready() error
+	Writable() error
+}
+
+// appendContext appends the record, giving up once ctx is done if the log supports it
+func appendContext(ctx context.Context, l CommitLog, record *api.Record) (uint64, error) {
+	if cl, ok := l.(contextLog); ok {
+		return cl.AppendContext(ctx, record)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.Append(record)
+}
+
+// readContext reads the record at off, giving up once ctx is done if the log supports it
+func readContext(ctx context.Context, l CommitLog, off uint64) (*api.Record, error) {
+	if cl, ok := l.(contextLog); ok {
+		return cl.ReadContext(ctx, off)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+// ready reports whether the log has loaded and can take writes
+func ready(l CommitLog) error {
+	if hl, ok := l.(healthLog); ok {
+		return hl.Ready()
+	}
+	return nil
+}
+
+// writable reports whether the log is open and can take writes
+func writable(l CommitLog) error {
+	if hl, ok := l.(healthLog); ok {
+		return hl.Writable()
+	}
+	return nil
+}
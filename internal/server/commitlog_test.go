@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeLog keeps records in memory and records each call made to it
+type fakeLog struct {
+	mu      sync.Mutex
+	records []*api.Record
+	calls   []string
+}
+
+func (l *fakeLog) call(format string, args ...interface{}) {
+	l.calls = append(l.calls, fmt.Sprintf(format, args...))
+}
+
+func (l *fakeLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.call("Append(%s)", record.Value)
+	record.Offset = uint64(len(l.records))
+	l.records = append(l.records, record)
+	return record.Offset, nil
+}
+
+func (l *fakeLog) Read(off uint64) (*api.Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.call("Read(%d)", off)
+	if off >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.records[off], nil
+}
+
+func (l *fakeLog) LowestOffset() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.call("LowestOffset()")
+	return 0, nil
+}
+
+func (l *fakeLog) HighestOffset() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.call("HighestOffset()")
+	if len(l.records) == 0 {
+		return 0, nil
+	}
+	return uint64(len(l.records) - 1), nil
+}
+
+// takeCalls returns the calls made since it was last called
+func (l *fakeLog) takeCalls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := l.calls
+	l.calls = nil
+	return calls
+}
+
+func TestHTTPFakeLog(t *testing.T) {
+	fake := &fakeLog{}
+	srv := NewHTTPServer("", fake, nil)
+	serve := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		b, err := json.Marshal(body)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(method, target, bytes.NewReader(b)))
+		return rec
+	}
+
+	rec := serve(http.MethodPost, "/", ProduceRequest{Record: Record{Value: []byte("hello")}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"Append(hello)"}, fake.takeCalls())
+
+	rec = serve(http.MethodGet, "/", ConsumeRequest{Offset: 0})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"Read(0)"}, fake.takeCalls())
+	rec = serve(http.MethodGet, "/", ConsumeRequest{Offset: 1})
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, []string{"Read(1)"}, fake.takeCalls())
+
+	// the fake hosts no partitions, so produces to one are unimplemented
+	rec = serve(http.MethodPost, "/", ProduceRequest{Record: Record{Value: []byte("a")}, Partition: "a"})
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+	require.Empty(t, fake.takeCalls())
+	for _, target := range []string{"/records?partition=a", "/info?partition=a", "/stream?partition=a"} {
+		rec = serve(http.MethodGet, target, nil)
+		require.Equal(t, http.StatusNotImplemented, rec.Code, target)
+		require.Empty(t, fake.takeCalls(), target)
+	}
+
+	rec = serve(http.MethodGet, "/records", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"LowestOffset()", "HighestOffset()", "Read(0)"}, fake.takeCalls())
+
+	// a log that doesn't report its health is healthy
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/healthz", nil).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/readyz", nil).Code)
+	require.NoError(t, srv.Shutdown(context.Background()))
+}
+
+func TestGRPCFakeLog(t *testing.T) {
+	fake := &fakeLog{}
+	l := bufconn.Listen(1024 * 1024)
+	server, err := NewGRPCServer(fake)
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+	cc, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogServiceClient(cc)
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), consume.Record.Value)
+	require.Equal(t, []string{"Append(hello)", "Read(0)"}, fake.takeCalls())
+
+	res, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	// registers the gzip compressor, so the server decompresses gzipped requests and gzips its
+	// responses to them
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+)
+
+// ResponseCompression compresses every response with one compressor, for clients that accept
+// it, rather than only the responses to compressed requests. It's compression on the wire,
+// separate from the compression records are stored with
+type ResponseCompression struct {
+	name    string
+	require bool
+}
+
+// NewResponseCompression compresses responses with the compressor registered as name, e.g.
+// "gzip". With require, calls from clients that don't accept it are rejected with
+// codes.FailedPrecondition rather than answered uncompressed
+func NewResponseCompression(name string, require bool) (*ResponseCompression, error) {
+	if encoding.GetCompressor(name) == nil {
+		return nil, fmt.Errorf("no %q compressor is registered", name)
+	}
+	return &ResponseCompression{name: name, require: require}, nil
+}
+
+// compress sets the call's response compressor if the client accepts it
+func (c *ResponseCompression) compress(ctx context.Context) error {
+	accepted, err := grpc.ClientSupportedCompressors(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range accepted {
+		if name == c.name {
+			return grpc.SetSendCompressor(ctx, c.name)
+		}
+	}
+	if c.require {
+		return status.Errorf(codes.FailedPrecondition, "the client must accept %s compression",
+			c.name)
+	}
+	return nil
+}
+
+// Interceptors returns server options that compress the responses of every call
+func (c *ResponseCompression) Interceptors() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := c.compress(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := c.compress(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
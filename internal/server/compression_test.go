@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/stats"
+)
+
+// payloadSizes records the uncompressed and compressed size of the last response the server sent
+type payloadSizes struct {
+	mu                 sync.Mutex
+	length, compressed int
+}
+
+func (p *payloadSizes) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (p *payloadSizes) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if out, ok := s.(*stats.OutPayload); ok {
+		p.mu.Lock()
+		p.length, p.compressed = out.Length, out.CompressedLength
+		p.mu.Unlock()
+	}
+}
+
+func (p *payloadSizes) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (p *payloadSizes) HandleConn(context.Context, stats.ConnStats) {}
+
+// wasCompressed reports whether the last response was compressed
+func (p *payloadSizes) wasCompressed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compressed < p.length
+}
+
+func TestCompression(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 100)
+	consume := func(client api.LogServiceClient, opts ...grpc.CallOption) {
+		res, err := client.ConsumeBatch(context.Background(), &api.ConsumeBatchRequest{
+			Offset: 0, MaxRecords: 10,
+		}, opts...)
+		require.NoError(t, err)
+		require.Len(t, res.Records, 10)
+		for _, record := range res.Records {
+			require.Equal(t, value, record.Value)
+		}
+	}
+	setup := func(opts ...grpc.ServerOption) (api.LogServiceClient, *payloadSizes, func()) {
+		sizes := &payloadSizes{}
+		client, _, teardown := setupTest(t, append(opts, grpc.StatsHandler(sizes))...)
+		for i := 0; i < 10; i++ {
+			_, err := client.Produce(context.Background(), &api.ProduceRequest{
+				Record: &api.Record{Value: value},
+			})
+			require.NoError(t, err)
+		}
+		return client, sizes, teardown
+	}
+
+	// by default only a client asking for gzip gets it
+	client, sizes, teardown := setup()
+	consume(client, grpc.UseCompressor(gzip.Name))
+	require.True(t, sizes.wasCompressed())
+	consume(client)
+	require.False(t, sizes.wasCompressed())
+	teardown()
+
+	// with response compression every client that accepts it does
+	compression, err := NewResponseCompression(gzip.Name, true)
+	require.NoError(t, err)
+	client, sizes, teardown = setup(compression.Interceptors()...)
+	defer teardown()
+	consume(client)
+	require.True(t, sizes.wasCompressed())
+
+	_, err = NewResponseCompression("unregistered", false)
+	require.Error(t, err)
+}
@@ -0,0 +1,16 @@
+package server
+
+// Config holds the settings for running the servers
+type Config struct {
+	// Addr is the address the HTTP server listens on
+	Addr string
+	// DataDir is the directory the commit log is stored in
+	DataDir string
+	// CertFile, KeyFile and CAFile enable mutual TLS when set
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// BasicAuth maps usernames to the bcrypt hashes of their passwords. When set, the produce
+	// and consume endpoints require HTTP Basic Auth with one of them
+	BasicAuth map[string]string
+}
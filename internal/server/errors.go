@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/magus-1/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCodes maps the log's errors to the gRPC codes and HTTP statuses they're sent with,
+// checked in order with errors.Is, so the two APIs agree on what each error means
+var errorCodes = []struct {
+	err  error
+	code codes.Code
+	http int
+}{
+	{log.ErrOffsetOutOfRange, codes.OutOfRange, http.StatusNotFound},
+	{log.ErrRecordTooLarge, codes.InvalidArgument, http.StatusBadRequest},
+	{log.ErrInvalidRecord, codes.InvalidArgument, http.StatusBadRequest},
+	{log.ErrOffsetMismatch, codes.FailedPrecondition, http.StatusConflict},
+	{log.ErrKeyNotFound, codes.NotFound, http.StatusNotFound},
+	{log.ErrNoCommittedOffset, codes.NotFound, http.StatusNotFound},
+	{errNoOffsets, codes.Unimplemented, http.StatusNotImplemented},
+	{log.ErrStaleSequence, codes.FailedPrecondition, http.StatusConflict},
+	{log.ErrDedupeDisabled, codes.Unimplemented, http.StatusNotImplemented},
+	{errNoIdempotence, codes.Unimplemented, http.StatusNotImplemented},
+	{log.ErrSegmentNotFound, codes.NotFound, http.StatusNotFound},
+	{log.ErrInvalidPartition, codes.InvalidArgument, http.StatusBadRequest},
+	{log.ErrPartitionNotFound, codes.NotFound, http.StatusNotFound},
+	{log.ErrTooManyPartitions, codes.ResourceExhausted, http.StatusInsufficientStorage},
+	{errNoPartitions, codes.Unimplemented, http.StatusNotImplemented},
+	{log.ErrBackpressure, codes.ResourceExhausted, http.StatusServiceUnavailable},
+	{log.ErrCircuitOpen, codes.Unavailable, http.StatusServiceUnavailable},
+	{log.ErrReadOnly, codes.FailedPrecondition, http.StatusMethodNotAllowed},
+	{log.ErrClosed, codes.Unavailable, http.StatusServiceUnavailable},
+	{log.ErrCorruptRecord, codes.DataLoss, http.StatusInternalServerError},
+	{log.ErrCorruptIndex, codes.DataLoss, http.StatusInternalServerError},
+	{log.ErrOutOfOrder, codes.DataLoss, http.StatusInternalServerError},
+	{context.DeadlineExceeded, codes.DeadlineExceeded, http.StatusGatewayTimeout},
+	{context.Canceled, codes.Canceled, http.StatusServiceUnavailable},
+}
+
+// errorStatus gives err the gRPC code of the log error it wraps, rather than UNKNOWN. Errors
+// that already carry a status, and those the log doesn't define, are returned as they are
+func errorStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return status.Error(c.code, err.Error())
+		}
+	}
+	return err
+}
+
+// httpStatus returns the HTTP status of the log error err wraps, 500 for any other error
+func httpStatus(err error) int {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.http
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+		http int
+	}{
+		{api.ErrOffsetOutOfRange{Offset: 3}, codes.OutOfRange, http.StatusNotFound},
+		{fmt.Errorf("%w: 100 bytes", log.ErrRecordTooLarge), codes.InvalidArgument, http.StatusBadRequest},
+		{fmt.Errorf("%w: bad", log.ErrInvalidRecord), codes.InvalidArgument, http.StatusBadRequest},
+		{log.ErrBackpressure, codes.ResourceExhausted, http.StatusServiceUnavailable},
+		{log.ErrReadOnly, codes.FailedPrecondition, http.StatusMethodNotAllowed},
+		{log.ErrClosed, codes.Unavailable, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: 0", log.ErrSegmentNotFound), codes.NotFound, http.StatusNotFound},
+		{log.ErrCorruptRecord, codes.DataLoss, http.StatusInternalServerError},
+		{context.DeadlineExceeded, codes.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("unknown"), codes.Unknown, http.StatusInternalServerError},
+	} {
+		require.Equal(t, tc.code, status.Code(errorStatus(tc.err)), tc.err.Error())
+		require.Equal(t, tc.http, httpStatus(tc.err), tc.err.Error())
+	}
+	require.NoError(t, errorStatus(nil))
+
+	// errors that already have a status keep it
+	err := status.Error(codes.PermissionDenied, "no")
+	require.Equal(t, err, errorStatus(err))
+}
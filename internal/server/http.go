@@ -1,44 +1,120 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// HTTPServer serves the log over JSON and closes it when shut down
+type HTTPServer struct {
+	*http.Server
+	Log CommitLog
+}
+
+// NewHTTPServer creates an HTTP server over the given log, serving TLS when tlsConfig isn't nil
+func NewHTTPServer(addr string, commitLog CommitLog, tlsConfig *tls.Config) *HTTPServer {
+	httpsrv := newHTTPServer(commitLog)
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	r.HandleFunc("/records", httpsrv.handleRecords).Methods("GET")
+	r.HandleFunc("/stream", httpsrv.handleStream).Methods("GET")
+	r.HandleFunc("/offsets/{group}", httpsrv.handleCommitOffset).Methods("POST")
+	r.HandleFunc("/offsets/{group}", httpsrv.handleFetchOffset).Methods("GET")
+	r.HandleFunc("/info", httpsrv.handleInfo).Methods("GET")
+	r.HandleFunc("/healthz", httpsrv.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", httpsrv.handleReadyz).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	return &HTTPServer{
+		Server: &http.Server{
+			Addr:      addr,
+			Handler:   r,
+			TLSConfig: tlsConfig,
+		},
+		Log: commitLog,
+	}
+}
 
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+// ListenAndServe serves over TLS when the server has a TLS config
+func (s *HTTPServer) ListenAndServe() error {
+	if s.TLSConfig != nil {
+		// the certificates come from the TLS config
+		return s.Server.ListenAndServeTLS("", "")
 	}
+	return s.Server.ListenAndServe()
+}
+
+// Serve serves l over TLS when the server has a TLS config
+func (s *HTTPServer) Serve(l net.Listener) error {
+	if s.TLSConfig != nil {
+		return s.Server.ServeTLS(l, "", "")
+	}
+	return s.Server.Serve(l)
+}
+
+// Shutdown stops accepting connections, waits for active requests to finish,
+// then flushes and closes the log, if it can be closed, so no buffered appends are lost
+func (s *HTTPServer) Shutdown(ctx context.Context) error {
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+	if c, ok := s.Log.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 type httpServer struct {
-	Log *Log
+	Log CommitLog
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(commitLog CommitLog) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log: commitLog,
 	}
 }
 
+// Record is the JSON form of a log record
+type Record struct {
+	Value  []byte `json:"value"`
+	Offset uint64 `json:"offset"`
+}
+
 type ProduceRequest struct {
-	// required for step 1 - unmarshal (record type on log.go)
+	// required for step 1 - unmarshal
 	Record Record `json:"record"`
+	// ProducerID and Sequence make the produce idempotent, as they do ProduceRequest's over gRPC
+	ProducerID string `json:"producer_id,omitempty"`
+	Sequence   uint64 `json:"sequence,omitempty"`
+	// Partition appends to the named partition rather than the log itself
+	Partition string `json:"partition,omitempty"`
 }
 type ProduceResponse struct {
 	Offset uint64 `json:"offset"`
 }
 type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
+	// Partition reads from the named partition rather than the log itself
+	Partition string `json:"partition,omitempty"`
 }
 type ConsumeResponse struct {
 	Record Record `json:"record"`
@@ -54,9 +130,20 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Step 2: use the struct to run endpoint logic & obtain result
-	off, err := s.Log.Append(req.Record)
+	record := &api.Record{Value: req.Record.Value}
+	commitLog, err := producePartition(s.Log, req.Partition)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	var off uint64
+	if req.ProducerID != "" {
+		off, err = appendIdempotent(r.Context(), commitLog, req.ProducerID, req.Sequence, record)
+	} else {
+		off, err = commitLog.Append(record)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
@@ -79,21 +166,372 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Step 2: use the struct to run endpoint logic & obtain result
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	commitLog, err := partition(s.Log, req.Partition)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
+	record, err := commitLog.Read(req.Offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
 	// Step 3: marshal request to JSON response
-	res := ConsumeResponse{Record: record}
+	res := ConsumeResponse{Record: Record{Value: record.Value, Offset: record.Offset}}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// InfoResponse describes the log for /info. The segment fields are zero for logs that don't
+// describe their segments, and Limits is only reported for a *log.Log. HighestOffset is 0 for
+// an empty log, which Empty tells apart from a log whose only record is at 0
+type InfoResponse struct {
+	LowestOffset      uint64      `json:"lowest_offset"`
+	HighestOffset     uint64      `json:"highest_offset"`
+	Empty             bool        `json:"empty"`
+	Segments          int         `json:"segments"`
+	StoreBytes        uint64      `json:"store_bytes"`
+	ActiveSegmentBase uint64      `json:"active_segment_base"`
+	Limits            *InfoLimits `json:"limits,omitempty"`
+}
+
+// InfoLimits are the limits the log is configured with, zero for those that aren't set
+type InfoLimits struct {
+	MaxStoreBytes     uint64 `json:"max_store_bytes"`
+	MaxIndexBytes     uint64 `json:"max_index_bytes"`
+	MaxRecordBytes    uint64 `json:"max_record_bytes"`
+	RetentionMaxBytes uint64 `json:"retention_max_bytes"`
+	// RetentionMaxAge is a duration, e.g. "24h0m0s"
+	RetentionMaxAge string `json:"retention_max_age"`
+}
+
+// handleInfo reports the log's offsets, segments and limits. The offsets and segments come
+// from one copy of the segments' descriptors, taken under the log's read lock, so they agree
+// with each other and the handler doesn't hold up appends. The partition query parameter
+// describes the named partition rather than the log itself
+func (s *httpServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	commitLog, err := partition(s.Log, r.URL.Query().Get("partition"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	var res InfoResponse
+	if sl, ok := commitLog.(segmentLog); ok {
+		segments := sl.Segments()
+		res.Segments = len(segments)
+		res.Empty = true
+		for _, seg := range segments {
+			res.StoreBytes += seg.StoreBytes
+			if seg.NextOffset > seg.BaseOffset {
+				res.Empty = false
+			}
+		}
+		if len(segments) > 0 {
+			first, active := segments[0], segments[len(segments)-1]
+			res.LowestOffset, res.ActiveSegmentBase = first.BaseOffset, active.BaseOffset
+			// as HighestOffset, an empty log has a highest offset of 0 whatever it starts at
+			if len(segments) > 1 || active.NextOffset > active.BaseOffset {
+				res.HighestOffset = active.NextOffset - 1
+			}
+		}
+	} else {
+		if res.LowestOffset, err = commitLog.LowestOffset(); err == nil {
+			res.HighestOffset, err = commitLog.HighestOffset()
+		}
+		if el, ok := commitLog.(emptyLog); ok {
+			res.Empty = el.Empty()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+	}
+	if l, ok := commitLog.(*log.Log); ok {
+		c := l.Config
+		res.Limits = &InfoLimits{
+			MaxStoreBytes:     c.Segment.MaxStoreBytes,
+			MaxIndexBytes:     c.Segment.MaxIndexBytes,
+			MaxRecordBytes:    c.Segment.MaxRecordBytes,
+			RetentionMaxBytes: c.Retention.MaxBytes,
+			RetentionMaxAge:   c.Retention.MaxAge.String(),
+		}
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleHealthz reports whether the log is open and writable
+func (s *httpServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := writable(s.Log); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// OffsetRequest commits a consumer group's offset, and OffsetResponse returns it
+type OffsetRequest struct {
+	Offset uint64 `json:"offset"`
+}
+type OffsetResponse struct {
+	Offset uint64 `json:"offset"`
+}
+
+// handleCommitOffset records the offset of the consumer group in the path
+func (s *httpServer) handleCommitOffset(w http.ResponseWriter, r *http.Request) {
+	var req OffsetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := commitOffset(s.Log, mux.Vars(r)["group"], req.Offset); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFetchOffset returns the offset the consumer group in the path last committed, 404 if
+// it hasn't
+func (s *httpServer) handleFetchOffset(w http.ResponseWriter, r *http.Request) {
+	off, err := fetchOffset(s.Log, mux.Vars(r)["group"])
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	if err = json.NewEncoder(w).Encode(OffsetResponse{Offset: off}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleReadyz reports whether the log has loaded its segments and can take writes
+func (s *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := ready(s.Log); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// the # of records a /records page holds unless the request sets a limit, and the most it may set
+const (
+	defaultRecordsLimit = 100
+	maxRecordsLimit     = 1000
+)
+
+// RecordsResponse is a page of /records. NextOffset is the cursor to pass back as the cursor
+// query parameter for the next page; past the end of the log it keeps pointing at the next
+// record to be appended, so polling it follows the tail
+type RecordsResponse struct {
+	Records    []Record `json:"records"`
+	NextOffset string   `json:"next_offset"`
+}
+
+// handleRecords streams a page of at most limit records from the from offset, or the cursor
+// of the previous page, to the to offset (inclusive), clamping the range to the offsets the log holds.
+// With wait, e.g. wait=30s, a page starting past the end of the log long-polls: it waits up to
+// that long for the record at from to be appended, returning an empty page if it isn't.
+// The partition query parameter reads the named partition rather than the log itself
+func (s *httpServer) handleRecords(w http.ResponseWriter, r *http.Request) {
+	// Step 1: parse the range from the query
+	commitLog, err := partition(s.Log, r.URL.Query().Get("partition"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	lowest, err := commitLog.LowestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	highest, err := commitLog.HighestOffset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("from") != "" && query.Get("cursor") != "" {
+		http.Error(w, "set from or cursor, not both", http.StatusBadRequest)
+		return
+	}
+	from, err := queryOffset(r, "from", lowest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if from, err = decodeCursor(cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	to, err := queryOffset(r, "to", highest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.Get("to") != "" && query.Get("cursor") == "" && from > to {
+		// a cursor past to just means the range is done
+		http.Error(w, fmt.Sprintf("from %d is after to %d", from, to), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryOffset(r, "limit", defaultRecordsLimit)
+	if err != nil || limit == 0 || limit > maxRecordsLimit {
+		http.Error(w, fmt.Sprintf("limit must be 1 to %d", maxRecordsLimit), http.StatusBadRequest)
+		return
+	}
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			http.Error(w, fmt.Sprintf("invalid wait: %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if wait > 0 {
+		_, err = waitRead(r.Context(), commitLog, from, wait)
+		if r.Context().Err() != nil {
+			// the client went away
+			return
+		}
+		if err != nil && !errors.Is(err, log.ErrOffsetOutOfRange) {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		// the page runs to whatever was appended during the wait
+		if highest, err = commitLog.HighestOffset(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if query.Get("to") == "" {
+			to = highest
+		}
+	}
+	if to > highest {
+		to = highest
+	}
+	if from < lowest {
+		from = lowest
+	}
+	if from <= to && to-from >= limit {
+		to = from + limit - 1
+	}
+
+	// Step 2: write each record as it's read rather than buffering the page
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write([]byte(`{"records":[`)); err != nil {
+		return
+	}
+	next := from
+	for off := from; off <= to; off++ {
+		record, err := commitLog.Read(off)
+		if errors.Is(err, log.ErrOffsetOutOfRange) {
+			// the log is empty
+			break
+		}
+		if err != nil {
+			// the status is already sent, so all we can do is cut the response short
+			return
+		}
+		b, err := json.Marshal(Record{Value: record.Value, Offset: record.Offset})
+		if err != nil {
+			return
+		}
+		if off != from {
+			b = append([]byte(","), b...)
+		}
+		if _, err = w.Write(b); err != nil {
+			return
+		}
+		next = off + 1
+	}
+	_, _ = fmt.Fprintf(w, `],"next_offset":%q}`, encodeCursor(next))
+}
+
+// how long a stream waits for the client to take a record before giving up on it
+var streamWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// handleStream upgrades to a WebSocket and sends each record from the from offset on as a JSON
+// Record message, following the log as records are appended until the client disconnects.
+// Records are read from the log as the client takes them, so a slow client falls behind without
+// holding up appends, and one that stops reading is disconnected after streamWriteTimeout.
+// The partition query parameter follows the named partition rather than the log itself
+func (s *httpServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	commitLog, err := partition(s.Log, r.URL.Query().Get("partition"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	from, err := queryOffset(r, "from", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied
+		return
+	}
+	defer conn.Close()
+
+	// the client only ever closes the connection, reading notices when it does
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = tail(ctx, commitLog, from, func(record *api.Record) error {
+		if err := conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+			return err
+		}
+		return conn.WriteJSON(Record{Value: record.Value, Offset: record.Offset})
+	})
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err != nil {
+		msg = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// encodeCursor makes an opaque cursor of off and its checksum, so a mangled cursor is
+// rejected rather than resuming somewhere else
+func encodeCursor(off uint64) string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, off)
+	binary.BigEndian.PutUint32(b[8:], crc32.ChecksumIEEE(b[:8]))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the offset in a cursor made by encodeCursor
+func decodeCursor(cursor string) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) != 12 || binary.BigEndian.Uint32(b[8:]) != crc32.ChecksumIEEE(b[:8]) {
+		return 0, fmt.Errorf("invalid cursor: %q", cursor)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// queryOffset parses the offset in query parameter key, or returns def if it's unset
+func queryOffset(r *http.Request, key string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	off, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s offset: %q", key, v)
+	}
+	return off, nil
+}
@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/magus-1/proglog/internal/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func setupHTTPTest(t *testing.T) (*HTTPServer, string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewHTTPServer(l.Addr().String(), clog, nil)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	return srv, "http://" + l.Addr().String()
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	srv, url := setupHTTPTest(t)
+
+	// signal once the slow request below is being handled
+	entered := make(chan struct{})
+	handler := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		handler.ServeHTTP(w, r)
+	})
+
+	// the request body is held open so the request stays in flight
+	body, bodyw := io.Pipe()
+	resc := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Post(url, "application/json", body)
+		require.NoError(t, err)
+		resc <- res
+	}()
+	<-entered
+
+	shutdownc := make(chan error, 1)
+	go func() {
+		shutdownc <- srv.Shutdown(context.Background())
+	}()
+
+	// new connections are refused while the active request is still running
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", srv.Addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case err := <-shutdownc:
+		t.Fatalf("shutdown finished before the active request: %v", err)
+	default:
+	}
+
+	// finishing the request lets it complete and the shutdown return
+	req, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = bodyw.Write(req)
+	require.NoError(t, err)
+	require.NoError(t, bodyw.Close())
+	res := <-resc
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var produce ProduceResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&produce))
+	require.Equal(t, uint64(0), produce.Offset)
+	require.NoError(t, <-shutdownc)
+
+	// the append was flushed to disk when the log closed
+	served := srv.Log.(*log.Log)
+	clog, err := log.NewLog(served.Dir, served.Config)
+	require.NoError(t, err)
+	record, err := clog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestHTTPProduceConsume(t *testing.T) {
+	srv, url := setupHTTPTest(t)
+	defer srv.Shutdown(context.Background())
+
+	req, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	res, err := http.Post(url, "application/json", bytes.NewReader(req))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	consume := func(off uint64) *http.Response {
+		req, err := json.Marshal(ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		r, err := http.NewRequest(http.MethodGet, url, bytes.NewReader(req))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		return res
+	}
+	res = consume(0)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var got ConsumeResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	require.Equal(t, []byte("hello world"), got.Record.Value)
+	require.Equal(t, http.StatusNotFound, consume(1).StatusCode)
+}
+
+func TestHTTPOffsets(t *testing.T) {
+	srv, url := setupHTTPTest(t)
+	defer srv.Shutdown(context.Background())
+
+	fetch := func(group string) *http.Response {
+		res, err := http.Get(url + "/offsets/" + group)
+		require.NoError(t, err)
+		return res
+	}
+	require.Equal(t, http.StatusNotFound, fetch("a").StatusCode)
+	req, err := json.Marshal(OffsetRequest{Offset: 42})
+	require.NoError(t, err)
+	res, err := http.Post(url+"/offsets/a", "application/json", bytes.NewReader(req))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res = fetch("a")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var got OffsetResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&got))
+	require.Equal(t, uint64(42), got.Offset)
+	require.Equal(t, http.StatusNotFound, fetch("b").StatusCode)
+}
+
+func TestHTTPInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-info-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	// two records per segment
+	c.Segment.MaxStoreBytes = 64
+	c.Retention.MaxAge = time.Hour
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := NewHTTPServer("", clog, nil)
+	info := func() InfoResponse {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/info", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var got InfoResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		return got
+	}
+
+	// an empty log says so, as its highest offset is 0 either way
+	got := info()
+	require.True(t, got.Empty)
+	require.Equal(t, uint64(0), got.HighestOffset)
+
+	for i := 0; i < 5; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	got = info()
+	var storeBytes uint64
+	for _, s := range clog.Segments() {
+		storeBytes += s.StoreBytes
+	}
+	require.Equal(t, InfoResponse{
+		LowestOffset:      0,
+		HighestOffset:     4,
+		Segments:          3,
+		StoreBytes:        storeBytes,
+		ActiveSegmentBase: 4,
+		Limits: &InfoLimits{
+			MaxStoreBytes:   64,
+			MaxIndexBytes:   1024,
+			RetentionMaxAge: "1h0m0s",
+		},
+	}, got)
+}
+
+func TestHTTPRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-records-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv := NewHTTPServer("", clog, nil)
+
+	get := func(target string) (int, []Record) {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var res RecordsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res.Records
+	}
+
+	// an empty log has no records to return
+	code, records := get("/records")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, records)
+
+	for i := 0; i < 5; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	code, records = get("/records?from=1&to=3")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []Record{
+		{Value: []byte{1}, Offset: 1},
+		{Value: []byte{2}, Offset: 2},
+		{Value: []byte{3}, Offset: 3},
+	}, records)
+
+	// to clamps to the highest offset
+	code, records = get("/records?from=3&to=100")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(4), records[1].Offset)
+
+	// from past the end is an empty range
+	code, records = get("/records?from=10&to=20")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, records)
+
+	// bad parameters
+	code, _ = get("/records?from=3&to=1")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/records?from=abc")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/records?limit=0")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHTTPRecordsWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-records-wait-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv := NewHTTPServer("", clog, nil)
+
+	get := func(target string) (int, RecordsResponse) {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var res RecordsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+
+	// the record is appended part way through the wait
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = clog.Append(&api.Record{Value: []byte("hello world")})
+	}()
+	code, res := get("/records?from=0&wait=10s")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []Record{{Value: []byte("hello world"), Offset: 0}}, res.Records)
+
+	// nothing is appended, so the wait runs out with an empty page
+	start := time.Now()
+	code, res = get("/records?from=1&wait=100ms")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, res.Records)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	from, err := decodeCursor(res.NextOffset)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), from)
+
+	code, _ = get("/records?wait=soon")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHTTPRecordsCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-records-cursor-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv := NewHTTPServer("", clog, nil)
+	for i := 0; i < 5; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	get := func(target string) (int, RecordsResponse) {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var res RecordsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		}
+		return rec.Code, res
+	}
+
+	// follow the cursor through pages of two
+	var offsets []uint64
+	code, res := get("/records?limit=2")
+	for len(res.Records) > 0 {
+		require.Equal(t, http.StatusOK, code)
+		require.LessOrEqual(t, len(res.Records), 2)
+		for _, record := range res.Records {
+			offsets = append(offsets, record.Offset)
+		}
+		code, res = get("/records?limit=2&cursor=" + res.NextOffset)
+	}
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+
+	// at the end the cursor stays put until more records are appended
+	end := res.NextOffset
+	_, res = get("/records?cursor=" + end)
+	require.Empty(t, res.Records)
+	require.Equal(t, end, res.NextOffset)
+	_, err = clog.Append(&api.Record{Value: []byte{5}})
+	require.NoError(t, err)
+	_, res = get("/records?cursor=" + end)
+	require.Equal(t, []Record{{Value: []byte{5}, Offset: 5}}, res.Records)
+
+	// cursors are validated
+	code, _ = get("/records?cursor=bogus")
+	require.Equal(t, http.StatusBadRequest, code)
+	b, err := base64.RawURLEncoding.DecodeString(end)
+	require.NoError(t, err)
+	b[7]++
+	code, _ = get("/records?cursor=" + base64.RawURLEncoding.EncodeToString(b))
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/records?from=1&cursor=" + end)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHTTPStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-stream-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	_, err = clog.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	ts := httptest.NewServer(NewHTTPServer("", clog, nil).Handler)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/stream"
+
+	// a bad offset is refused before upgrading
+	_, res, err := websocket.DefaultDialer.Dial(url+"?from=abc", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?from=0", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// the stream starts at from, then follows records appended after connecting
+	var record Record
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, Record{Value: []byte("before"), Offset: 0}, record)
+	for i := 1; i < 3; i++ {
+		_, err = clog.Append(&api.Record{Value: []byte(fmt.Sprintf("after %d", i))})
+		require.NoError(t, err)
+		require.NoError(t, conn.ReadJSON(&record))
+		require.Equal(t, Record{Value: []byte(fmt.Sprintf("after %d", i)), Offset: uint64(i)}, record)
+	}
+
+	// once the client disconnects, the server stops streaming and closes its end
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+}
+
+func TestHTTPPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	_, err = clog.Append(&api.Record{Value: []byte("root")})
+	require.NoError(t, err)
+	orders, err := clog.Partition("orders")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = orders.Append(&api.Record{Value: []byte(fmt.Sprintf("order %d", i))})
+		require.NoError(t, err)
+	}
+	srv := NewHTTPServer("", clog, nil)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	// records and info describe the partition, not the log itself
+	rec := get("/records?partition=orders&from=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var records RecordsResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&records))
+	require.Equal(t, []Record{
+		{Value: []byte("order 1"), Offset: 1},
+		{Value: []byte("order 2"), Offset: 2},
+	}, records.Records)
+	rec = get("/info?partition=orders")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var info InfoResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	require.Equal(t, uint64(2), info.HighestOffset)
+	require.Equal(t, http.StatusBadRequest, get("/records?partition=../orders").Code)
+	require.Equal(t, http.StatusBadRequest, get("/info?partition=../orders").Code)
+
+	// reads of a partition that hasn't been produced to don't create it
+	for _, target := range []string{"/records?partition=refunds", "/info?partition=refunds",
+		"/stream?partition=refunds"} {
+		require.Equal(t, http.StatusNotFound, get(target).Code, target)
+	}
+	rec = httptest.NewRecorder()
+	body, err := json.Marshal(ConsumeRequest{Partition: "refunds"})
+	require.NoError(t, err)
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.NoDirExists(t, path.Join(dir, "partitions", "refunds"))
+
+	// and the stream follows the partition
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/stream?partition=orders&from=2"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var record Record
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, Record{Value: []byte("order 2"), Offset: 2}, record)
+	_, res, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(ts.URL, "http")+"/stream?partition=../orders", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHTTPHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-health-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	srv := NewHTTPServer("", clog, nil)
+	status := func(target string) int {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusOK, status("/healthz"))
+	require.Equal(t, http.StatusOK, status("/readyz"))
+
+	// the log's directory going away makes it unwritable, and coming back recovers
+	moved := dir + "-moved"
+	require.NoError(t, os.Rename(dir, moved))
+	require.Equal(t, http.StatusServiceUnavailable, status("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+	require.NoError(t, os.Rename(moved, dir))
+	require.Equal(t, http.StatusOK, status("/readyz"))
+
+	require.NoError(t, clog.Close())
+	require.Equal(t, http.StatusServiceUnavailable, status("/healthz"))
+	require.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Metrics = metrics.Default()
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := NewHTTPServer("", clog, nil)
+
+	body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "proglog_appends_total")
+	require.Contains(t, rec.Body.String(), "proglog_segments 1")
+}
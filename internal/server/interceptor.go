@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// requestIDKey is the metadata key carrying a call's request ID, in both directions
+const requestIDKey = "x-request-id"
+
+type requestIDContextKey struct{}
+
+// RequestID returns the ID of the request ctx belongs to, set by the logging interceptors
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// LoggingInterceptors returns server options that log every call to logger with its
+// method, duration, offset and error. Each call gets the request ID the client sent in its
+// x-request-id metadata, or a new one, which is put in the call's context and sent back in
+// the trailers
+func LoggingInterceptors(logger *zap.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryLoggingInterceptor(logger)),
+		grpc.ChainStreamInterceptor(streamLoggingInterceptor(logger)),
+	}
+}
+
+func unaryLoggingInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, id := withRequestID(ctx)
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(requestIDKey, id))
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		fields := []zap.Field{
+			zap.String("method", info.FullMethod),
+			zap.String("request_id", id),
+			zap.Duration("duration", time.Since(start)),
+		}
+		// the offset produced or consumed
+		if r, ok := resp.(*api.ProduceResponse); ok {
+			fields = append(fields, zap.Uint64("offset", r.Offset))
+		} else if r, ok := req.(*api.ConsumeRequest); ok {
+			fields = append(fields, zap.Uint64("offset", r.Offset))
+		} else if r, ok := req.(*api.ConsumeBatchRequest); ok {
+			fields = append(fields, zap.Uint64("offset", r.Offset))
+		}
+		logCall(logger, err, fields)
+		return resp, err
+	}
+}
+
+func streamLoggingInterceptor(logger *zap.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx, id := withRequestID(ss.Context())
+		ss.SetTrailer(metadata.Pairs(requestIDKey, id))
+		start := time.Now()
+		err := handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+		logCall(logger, err, []zap.Field{
+			zap.String("method", info.FullMethod),
+			zap.String("request_id", id),
+			zap.Duration("duration", time.Since(start)),
+		})
+		return err
+	}
+}
+
+// requestIDStream gives a stream's handler the context carrying its request ID
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+// withRequestID returns ctx with the request ID from its incoming metadata, or a new one
+func withRequestID(ctx context.Context) (context.Context, string) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDKey); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestIDContextKey{}, id), id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	// crypto/rand only fails if the OS has no randomness to give
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logCall logs a finished call at info level, or at error level with its code if it failed
+func logCall(logger *zap.Logger, err error, fields []zap.Field) {
+	if err == nil {
+		logger.Info("finished call", fields...)
+		return
+	}
+	fields = append(fields, zap.String("code", status.Code(err).String()), zap.Error(err))
+	logger.Error("finished call", fields...)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestLoggingInterceptors(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	client, _, teardown := setupTest(t, LoggingInterceptors(zap.New(core))...)
+	defer teardown()
+	ctx := context.Background()
+
+	// a request ID is generated and returned in the trailers
+	var trailer metadata.MD
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	ids := trailer.Get(requestIDKey)
+	require.Len(t, ids, 1)
+	require.Len(t, ids[0], 32)
+
+	entries := logs.TakeAll()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "/log.v1.LogService/Produce", fields["method"])
+	require.Equal(t, ids[0], fields["request_id"])
+	require.Equal(t, uint64(0), fields["offset"])
+	require.Contains(t, fields, "duration")
+
+	// the client's own request ID is kept, and failures are logged as errors
+	ctx = metadata.AppendToOutgoingContext(ctx, requestIDKey, "client-id")
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1}, grpc.Trailer(&trailer))
+	require.Error(t, err)
+	require.Equal(t, []string{"client-id"}, trailer.Get(requestIDKey))
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	fields = entries[0].ContextMap()
+	require.Equal(t, "/log.v1.LogService/Consume", fields["method"])
+	require.Equal(t, "client-id", fields["request_id"])
+	require.Equal(t, uint64(1), fields["offset"])
+	require.Equal(t, "OutOfRange", fields["code"])
+
+	// streams get request IDs too
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	ids = stream.Trailer().Get(requestIDKey)
+	require.Len(t, ids, 1)
+	entries = logs.TakeAll()
+	require.Len(t, entries, 1)
+	fields = entries[0].ContextMap()
+	require.Equal(t, "/log.v1.LogService/ProduceStream", fields["method"])
+	require.Equal(t, ids[0], fields["request_id"])
+}
+
+func TestTracingInterceptors(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client, _, teardown := setupTest(t, TracingInterceptors(tp)...)
+	defer teardown()
+
+	// the call continues the trace in the client's traceparent
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "client")
+	md := metadata.MD{}
+	propagation.TraceContext{}.Inject(ctx, metadataCarrier(md))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	require.Equal(t, "/log.v1.LogService/Produce", spans[0].Name())
+	require.Equal(t, trace.SpanKindServer, spans[0].SpanKind())
+	require.Equal(t, parent.SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	require.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+	require.Contains(t, spans[0].Attributes(), attribute.Int64("proglog.offset", 0))
+	require.Equal(t, "/log.v1.LogService/Consume", spans[1].Name())
+	require.Contains(t, spans[1].Attributes(), attribute.String("rpc.grpc.status_code", "OutOfRange"))
+	require.Equal(t, otelcodes.Error, spans[1].Status().Code)
+}
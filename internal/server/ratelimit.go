@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ProduceLimiter limits produces with a token bucket for each client, identified by the common
+// name of its verified client certificate. Clients without one share a single bucket
+type ProduceLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewProduceLimiter allows each client perSecond produces a second on average, and bursts of up
+// to burst at once
+func NewProduceLimiter(perSecond float64, burst int) *ProduceLimiter {
+	return &ProduceLimiter{
+		limit:    rate.Limit(perSecond),
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow takes a token from the client's bucket, reporting whether there was one
+func (l *ProduceLimiter) allow(client string) bool {
+	l.mu.Lock()
+	limiter, ok := l.limiters[client]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[client] = limiter
+	}
+	l.mu.Unlock()
+	return limiter.Allow()
+}
+
+// Interceptors returns server options that reject Produce calls, and each record sent on a
+// ProduceStream, with codes.ResourceExhausted once the caller's bucket is empty
+func (l *ProduceLimiter) Interceptors() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if methodActions[info.FullMethod] == produceAction && !l.allow(grpcClient(ctx)) {
+				return nil, errRateLimited
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if methodActions[info.FullMethod] == produceAction {
+				ss = &limitedStream{ServerStream: ss, limiter: l, client: grpcClient(ss.Context())}
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+var errRateLimited = status.Error(codes.ResourceExhausted, "produce rate limit exceeded")
+
+// grpcClient identifies the caller by its client certificate, or as anonymous
+func grpcClient(ctx context.Context) string {
+	cn, _ := clientCommonName(ctx)
+	return cn
+}
+
+// limitedStream takes a token for each message the client sends
+type limitedStream struct {
+	grpc.ServerStream
+	limiter *ProduceLimiter
+	client  string
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !s.limiter.allow(s.client) {
+		return errRateLimited
+	}
+	return nil
+}
+
+// Middleware wraps an HTTP handler from NewHTTPServer, rejecting produces (POST /) with
+// 429 Too Many Requests once the caller's bucket is empty
+func (l *ProduceLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/" && !l.allow(httpClient(r)) {
+			http.Error(w, "produce rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpClient identifies the caller by its client certificate, or as anonymous
+func httpClient(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return ""
+}
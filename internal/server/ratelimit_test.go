@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProduceLimiterGRPC(t *testing.T) {
+	client, _, teardown := setupTest(t, NewProduceLimiter(10, 2).Interceptors()...)
+	defer teardown()
+	ctx := context.Background()
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		return err
+	}
+
+	// the burst goes through, then produces are rejected until the bucket refills
+	require.NoError(t, produce())
+	require.NoError(t, produce())
+	require.Equal(t, codes.ResourceExhausted, status.Code(produce()))
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return produce() == nil
+	}, time.Second, 20*time.Millisecond)
+
+	// streamed records each take a token
+	time.Sleep(250 * time.Millisecond)
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}))
+	}
+	for i := 0; i < 2; i++ {
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestProduceLimiterHTTP(t *testing.T) {
+	srv, _ := setupHTTPTest(t)
+	defer srv.Shutdown(context.Background())
+	handler := NewProduceLimiter(10, 2).Middleware(srv.Handler)
+	produce := func(client string) int {
+		b, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+		if client != "" {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: client}},
+			}}}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, produce("noisy"))
+	require.Equal(t, http.StatusOK, produce("noisy"))
+	require.Equal(t, http.StatusTooManyRequests, produce("noisy"))
+
+	// other clients, and anonymous ones, have buckets of their own
+	require.Equal(t, http.StatusOK, produce("quiet"))
+	require.Equal(t, http.StatusOK, produce(""))
+
+	// reads aren't limited
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/records", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.Eventually(t, func() bool {
+		return produce("noisy") == http.StatusOK
+	}, time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// how long ConsumeStream waits before checking for new records once it has caught up
+var streamPollInterval = 10 * time.Millisecond
+
+// NewGRPCServer creates a gRPC server with the LogService registered over the given log.
+// Pass grpc.Creds to serve over TLS, LoggingInterceptors(logger)... to log each call and
+// TracingInterceptors(tp)... to trace them
+func NewGRPCServer(commitLog CommitLog, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	return NewClusterGRPCServer(commitLog, nil, opts...)
+}
+
+// ServerGetter reports the servers in the log's cluster for GetServers. DistributedLog implements it
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// NewClusterGRPCServer is NewGRPCServer for a node of a cluster, answering GetServers from
+// servers. With nil servers the node reports itself as a standalone leader
+func NewClusterGRPCServer(commitLog CommitLog, servers ServerGetter, opts ...grpc.ServerOption) (
+	*grpc.Server, error) {
+	gsrv := grpc.NewServer(opts...)
+	srv := newgrpcServer(commitLog)
+	srv.servers = servers
+	api.RegisterLogServiceServer(gsrv, srv)
+	healthpb.RegisterHealthServer(gsrv, newHealthServer(commitLog))
+	return gsrv, nil
+}
+
+// healthServer serves the standard gRPC health check, reporting SERVING once the log is ready
+type healthServer struct {
+	*health.Server
+	log CommitLog
+}
+
+func newHealthServer(commitLog CommitLog) *healthServer {
+	h := &healthServer{
+		Server: health.NewServer(),
+		log:    commitLog,
+	}
+	h.update()
+	return h
+}
+
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (
+	*healthpb.HealthCheckResponse, error) {
+	// the log can become unready at any time, e.g. if its directory is unwritable
+	h.update()
+	return h.Server.Check(ctx, req)
+}
+
+// update sets the serving status of the server and the LogService from the log's readiness
+func (h *healthServer) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if ready(h.log) != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.SetServingStatus("", status)
+	h.SetServingStatus(api.LogService_ServiceDesc.ServiceName, status)
+}
+
+type grpcServer struct {
+	api.UnimplementedLogServiceServer
+	Log     CommitLog
+	servers ServerGetter
+}
+
+func newgrpcServer(commitLog CommitLog) *grpcServer {
+	return &grpcServer{
+		Log: commitLog,
+	}
+}
+
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
+	*api.ProduceResponse, error) {
+	// append the record and return the offset the log assigned it
+	// ErrBackpressure comes back RESOURCE_EXHAUSTED, so the client should back off and retry
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "no record")
+	}
+	commitLog, err := producePartition(s.Log, req.Partition)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	var off uint64
+	if req.ProducerId != "" {
+		// a retry of the producer's last produce gets the offset it was first given
+		off, err = appendIdempotent(ctx, commitLog, req.ProducerId, req.Sequence, req.Record)
+	} else {
+		off, err = appendContext(ctx, commitLog, req.Record)
+	}
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
+	*api.ConsumeResponse, error) {
+	// an out of range offset comes back as api.ErrOffsetOutOfRange, which
+	// carries its own codes.OutOfRange status, unless the request waits for it
+	commitLog, err := partition(s.Log, req.Partition)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	record, err := waitRead(ctx, commitLog, req.Offset, req.Wait.AsDuration())
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return &api.ConsumeResponse{Record: record}, nil
+}
+
+// maxConsumeWait caps how long a long-polling consume waits for its record
+const maxConsumeWait = 5 * time.Minute
+
+// waitRead reads the record at off, waiting up to wait, at most maxConsumeWait, for it to be
+// appended if it's past the end of the log. It returns a nil record if the wait runs out first,
+// ctx's error if ctx is done first, and api.ErrOffsetOutOfRange at once for records already
+// removed from the log, which won't be appended again
+func waitRead(ctx context.Context, commitLog CommitLog, off uint64, wait time.Duration) (
+	*api.Record, error) {
+	if wait > maxConsumeWait {
+		wait = maxConsumeWait
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		record, err := readContext(ctx, commitLog, off)
+		if !errors.Is(err, log.ErrOffsetOutOfRange) || wait <= 0 {
+			return record, err
+		}
+		lowest, lerr := commitLog.LowestOffset()
+		if lerr != nil {
+			return nil, lerr
+		}
+		if off < lowest {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return nil, nil
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// maxBatchRecords caps the # of records a ConsumeBatch returns, however many it asks for
+const maxBatchRecords = 1000
+
+// ConsumeBatch returns up to req.MaxRecords records from req.Offset on, fewer if the log ends
+// first, so catching up takes a round trip per batch rather than per record. An offset past
+// the end of the log gets an empty batch, one already removed from the log OUT_OF_RANGE
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (
+	*api.ConsumeBatchResponse, error) {
+	max := req.MaxRecords
+	if max == 0 || max > maxBatchRecords {
+		max = maxBatchRecords
+	}
+	commitLog, err := partition(s.Log, req.Partition)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	lowest, err := commitLog.LowestOffset()
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	if req.Offset < lowest {
+		return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
+	}
+	res := &api.ConsumeBatchResponse{}
+	for off := req.Offset; uint64(len(res.Records)) < max; off++ {
+		record, err := readContext(ctx, commitLog, off)
+		if errors.Is(err, log.ErrOffsetOutOfRange) {
+			// the end of the log
+			break
+		}
+		if err != nil {
+			return nil, errorStatus(err)
+		}
+		res.Records = append(res.Records, record)
+	}
+	return res, nil
+}
+
+// CommitOffset records the offset of a consumer group, which FetchOffset returns until the
+// group commits another, INVALID_ARGUMENT without a group
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (
+	*api.CommitOffsetResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "no consumer group")
+	}
+	if err := commitOffset(s.Log, req.Group, req.Offset); err != nil {
+		return nil, errorStatus(err)
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset returns the offset a consumer group last committed, NOT_FOUND if it hasn't
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (
+	*api.FetchOffsetResponse, error) {
+	off, err := fetchOffset(s.Log, req.Group)
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.LogService_ConsumeStreamServer) error {
+	// follow the log from the requested offset, like tail -f
+	commitLog, err := partition(s.Log, req.Partition)
+	if err != nil {
+		return errorStatus(err)
+	}
+	return tail(stream.Context(), commitLog, req.Offset, func(record *api.Record) error {
+		return stream.Send(&api.ConsumeResponse{Record: record})
+	})
+}
+
+// tail sends each record from off on, waiting for the next to be appended once it has caught
+// up, until ctx is done or send fails. Records are read from the log at send's pace, so a slow
+// consumer falls behind without holding up appends
+func tail(ctx context.Context, commitLog CommitLog, off uint64, send func(*api.Record) error) error {
+	for {
+		record, err := readContext(ctx, commitLog, off)
+		if ctx.Err() != nil {
+			// the client went away
+			return nil
+		}
+		if errors.Is(err, log.ErrOffsetOutOfRange) {
+			// past the end of the log: wait for the record to be appended
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(streamPollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			return errorStatus(err)
+		}
+		if err = send(record); err != nil {
+			return err
+		}
+		off++
+	}
+}
+
+func (s *grpcServer) ProduceStream(stream api.LogService_ProduceStreamServer) error {
+	// each record is appended as it arrives, so everything received before
+	// the client closes the stream is already committed
+	committed := 0
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			// tell the client how much of the batch made it into the log
+			stream.SetTrailer(metadata.Pairs("committed", strconv.Itoa(committed)))
+			st := status.Convert(err)
+			return status.Errorf(st.Code(), "committed %d records before failing: %s", committed, st.Message())
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		committed++
+	}
+}
+
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (
+	*api.GetServersResponse, error) {
+	if s.servers == nil {
+		// a standalone server leads itself, at whatever address the client dialed
+		var addr string
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[":authority"]) > 0 {
+			addr = md[":authority"][0]
+		}
+		return &api.GetServersResponse{Servers: []*api.Server{{RpcAddr: addr, IsLeader: true}}}, nil
+	}
+	servers, err := s.servers.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
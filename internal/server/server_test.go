@@ -0,0 +1,408 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, client api.LogServiceClient,
+	){
+		"produce and consume a record succeeds":   testProduceConsume,
+		"produce without a record fails":          testProduceNoRecord,
+		"consume past log boundary fails":         testConsumePastBoundary,
+		"consume waits for an appended record":    testConsumeWait,
+		"consume wait times out empty":            testConsumeWaitTimeout,
+		"consume stream follows appends":          testConsumeStream,
+		"consume batch stops at the log's end":    testConsumeBatch,
+		"produce stream appends in order":         testProduceStream,
+		"get servers reports a standalone leader": testGetServers,
+		"offsets are committed per group":         testCommitFetchOffset,
+		"a retried produce is deduplicated":       testIdempotentProduce,
+		"partitions have their own offsets":       testPartitions,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, _, teardown := setupTest(t)
+			defer teardown()
+			fn(t, client)
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	_, cc, teardown := setupTest(t)
+	defer teardown()
+	client := healthpb.NewHealthClient(cc)
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{
+			Service: service,
+		})
+		require.NoError(t, err)
+		return res.Status
+	}
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, check(api.LogService_ServiceDesc.ServiceName))
+}
+
+func setupTest(t *testing.T, opts ...grpc.ServerOption) (api.LogServiceClient, *grpc.ClientConn, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	c := log.Config{}
+	c.Producers.Dedupe = true
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	// serve over an in-memory listener so the test needs no ports
+	l := bufconn.Listen(1024 * 1024)
+	server, err := NewGRPCServer(clog, opts...)
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+
+	cc, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	return api.NewLogServiceClient(cc), cc, func() {
+		_ = cc.Close()
+		server.Stop()
+		_ = clog.Remove()
+		os.RemoveAll(dir)
+	}
+}
+
+func testProduceConsume(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	want := &api.Record{
+		Value: []byte("hello world"),
+	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+}
+
+func testProduceNoRecord(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the stream fails too, and the server carries on serving
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+}
+
+func TestAppendIdempotentNoRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotent-no-record-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Producers.Dedupe = true
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	_, err = appendIdempotent(context.Background(), clog, "producer", 1, nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(errorStatus(err)))
+	require.Equal(t, http.StatusBadRequest, httpStatus(err))
+}
+
+func testConsumePastBoundary(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset + 1,
+	})
+	require.Nil(t, consume)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func testConsumeWait(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	go func() {
+		// the record is appended part way through the wait
+		time.Sleep(50 * time.Millisecond)
+		_, _ = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+	}()
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: 0,
+		Wait:   durationpb.New(10 * time.Second),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	require.Equal(t, uint64(0), consume.Record.Offset)
+}
+
+func testConsumeWaitTimeout(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	start := time.Now()
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: 0,
+		Wait:   durationpb.New(100 * time.Millisecond),
+	})
+	require.NoError(t, err)
+	require.Nil(t, consume.Record)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// the client's deadline still applies
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset: 0,
+		Wait:   durationpb.New(10 * time.Second),
+	})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func testConsumeBatch(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	// asking for more than there are returns what there is
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0, MaxRecords: 50})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 20)
+	for i, record := range res.Records {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 5, MaxRecords: 10})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 10)
+	require.Equal(t, uint64(14), res.Records[9].Offset)
+
+	// past the end is an empty batch
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 20})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+}
+
+func testConsumeStream(t *testing.T, client api.LogServiceClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	go func() {
+		// the stream starts before any of these exist
+		for _, record := range records {
+			_, _ = client.Produce(ctx, &api.ProduceRequest{Record: record})
+		}
+	}()
+
+	for i, record := range records {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, record.Value, res.Record.Value)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+}
+
+func testProduceStream(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	const n = 1000
+	go func() {
+		for i := 0; i < n; i++ {
+			_ = stream.Send(&api.ProduceRequest{
+				Record: &api.Record{Value: []byte("hello world")},
+			})
+		}
+		_ = stream.CloseSend()
+	}()
+
+	for i := 0; i < n; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: n - 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(n-1), consume.Record.Offset)
+}
+
+func testGetServers(t *testing.T, client api.LogServiceClient) {
+	res, err := client.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, 1)
+	require.True(t, res.Servers[0].IsLeader)
+	// the address the client dialed
+	require.Equal(t, "bufnet", res.Servers[0].RpcAddr)
+}
+
+func testCommitFetchOffset(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	_, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "a"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	for group, off := range map[string]uint64{"a": 3, "b": 7} {
+		_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: group, Offset: off})
+		require.NoError(t, err)
+	}
+	for group, want := range map[string]uint64{"a": 3, "b": 7} {
+		res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: group})
+		require.NoError(t, err)
+		require.Equal(t, want, res.Offset)
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Offset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testIdempotentProduce(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	produce := func(seq uint64, value string) (uint64, error) {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:     &api.Record{Value: []byte(value)},
+			ProducerId: "producer",
+			Sequence:   seq,
+		})
+		if err != nil {
+			return 0, err
+		}
+		return res.Offset, nil
+	}
+	// a produce without a record fails before it's deduplicated
+	_, err := client.Produce(ctx, &api.ProduceRequest{ProducerId: "producer", Sequence: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	first, err := produce(1, "first")
+	require.NoError(t, err)
+	// the retry gets the same offset, and isn't appended again
+	retry, err := produce(1, "first")
+	require.NoError(t, err)
+	require.Equal(t, first, retry)
+	next, err := produce(2, "second")
+	require.NoError(t, err)
+	require.Equal(t, first+1, next)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: next})
+	require.NoError(t, err)
+	require.Equal(t, "second", string(res.Record.Value))
+	require.Equal(t, "producer", res.Record.ProducerId)
+
+	// sequence #s older than the last can't be deduplicated
+	_, err = produce(1, "first")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testPartitions(t *testing.T, client api.LogServiceClient) {
+	ctx := context.Background()
+	produce := func(partition, value string) uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:    &api.Record{Value: []byte(value)},
+			Partition: partition,
+		})
+		require.NoError(t, err)
+		return res.Offset
+	}
+	// each partition counts from 0, apart from the log itself and each other
+	require.Equal(t, uint64(0), produce("", "root"))
+	require.Equal(t, uint64(0), produce("a", "a0"))
+	require.Equal(t, uint64(1), produce("a", "a1"))
+	require.Equal(t, uint64(0), produce("b", "b0"))
+
+	// and consumes only read their own partition's records
+	consume := func(partition string, off uint64) (string, error) {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off, Partition: partition})
+		if err != nil {
+			return "", err
+		}
+		return string(res.Record.Value), nil
+	}
+	for partition, want := range map[string][]string{
+		"":  {"root"},
+		"a": {"a0", "a1"},
+		"b": {"b0"},
+	} {
+		for off, value := range want {
+			got, err := consume(partition, uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+		}
+		_, err := consume(partition, uint64(len(want)))
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+
+		batch, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Partition: partition})
+		require.NoError(t, err)
+		var got []string
+		for _, record := range batch.Records {
+			got = append(got, string(record.Value))
+		}
+		require.Equal(t, want, got)
+	}
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("bad")},
+		Partition: "../a",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// reads of a partition that hasn't been produced to don't create it, so they keep
+	// failing NOT_FOUND rather than finding it empty
+	for i := 0; i < 2; i++ {
+		_, err = consume("c", 0)
+		require.Equal(t, codes.NotFound, status.Code(err))
+		_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Partition: "c"})
+		require.Equal(t, codes.NotFound, status.Code(err))
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Partition: "c"})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.NotFound, status.Code(err))
+	}
+}
+
+// a cluster's nodes answer GetServers from the distributed log
+var _ ServerGetter = (*log.DistributedLog)(nil)
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"github.com/magus-1/proglog/internal/log"
+	"github.com/magus-1/proglog/internal/security"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA signs certificates for tests and writes them as PEM files under dir
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// CAFile is the PEM file holding the CA's certificate
+	CAFile string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ca := &testCA{t: t, dir: dir}
+	ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	require.NoError(t, err)
+	ca.cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca.CAFile = ca.write("ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(name, typ string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(ca.t, ioutil.WriteFile(path, b, 0600))
+	return path
+}
+
+// issue signs a certificate for commonName, returning its cert and key files
+func (ca *testCA) issue(commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ca.t, err)
+	return ca.write(commonName+".pem", "CERTIFICATE", der),
+		ca.write(commonName+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// tlsConfig builds a server or client TLS config presenting commonName's certificate,
+// or no certificate when commonName is empty
+func (ca *testCA) tlsConfig(commonName string, server bool) *tls.Config {
+	cfg := security.TLSConfig{
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        server,
+	}
+	if commonName != "" {
+		cfg.CertFile, cfg.KeyFile = ca.issue(commonName)
+	}
+	tlsConfig, err := security.SetupTLSConfig(cfg)
+	require.NoError(ca.t, err)
+	return tlsConfig
+}
+
+func newTLSTestLog(t *testing.T) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tls-log-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	return clog
+}
+
+func TestGRPCMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server, err := NewGRPCServer(
+		newTLSTestLog(t),
+		grpc.Creds(credentials.NewTLS(ca.tlsConfig("server", true))),
+	)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	produce := func(tlsConfig *tls.Config) error {
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		)
+		require.NoError(t, err)
+		defer cc.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = api.NewLogServiceClient(cc).Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce(ca.tlsConfig("client", false)))
+	// a client without a certificate fails the handshake
+	require.Error(t, produce(ca.tlsConfig("", false)))
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := NewHTTPServer(l.Addr().String(), newTLSTestLog(t), ca.tlsConfig("server", true))
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Shutdown(context.Background())
+
+	get := func(tlsConfig *tls.Config) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		res, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	require.NoError(t, get(ca.tlsConfig("client", false)))
+	err = get(ca.tlsConfig("", false))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "certificate required")
+}
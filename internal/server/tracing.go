@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/magus-1/proglog/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tracerName names the tracer the server's spans come from
+const tracerName = "github.com/magus-1/proglog/internal/server"
+
+// TracingInterceptors returns server options that trace every call with tp, continuing the
+// trace the client sent in its W3C traceparent metadata. The spans are in the calls' contexts,
+// so a log configured with the same provider traces its appends and reads as their children
+func TracingInterceptors(tp trace.TracerProvider) []grpc.ServerOption {
+	tracer := tp.Tracer(tracerName)
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryTracingInterceptor(tracer)),
+		grpc.ChainStreamInterceptor(streamTracingInterceptor(tracer)),
+	}
+}
+
+func unaryTracingInterceptor(tracer trace.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startCallSpan(ctx, tracer, info.FullMethod)
+		resp, err := handler(ctx, req)
+		// the offset produced or consumed
+		if r, ok := resp.(*api.ProduceResponse); ok {
+			span.SetAttributes(attribute.Int64("proglog.offset", int64(r.Offset)))
+		} else if r, ok := req.(*api.ConsumeRequest); ok {
+			span.SetAttributes(attribute.Int64("proglog.offset", int64(r.Offset)))
+		} else if r, ok := req.(*api.ConsumeBatchRequest); ok {
+			span.SetAttributes(attribute.Int64("proglog.offset", int64(r.Offset)))
+		}
+		endCallSpan(span, err)
+		return resp, err
+	}
+}
+
+func streamTracingInterceptor(tracer trace.Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx, span := startCallSpan(ss.Context(), tracer, info.FullMethod)
+		err := handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+		endCallSpan(span, err)
+		return err
+	}
+}
+
+// startCallSpan starts a server span for method, as a child of the span in ctx's incoming metadata
+func startCallSpan(ctx context.Context, tracer trace.Tracer, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = propagation.TraceContext{}.Extract(ctx, metadataCarrier(md))
+	return tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.method", method)),
+	)
+}
+
+// endCallSpan records the call's gRPC code on span, then ends it
+func endCallSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vs := metadata.MD(c).Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}